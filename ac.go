@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	ACModelGree   = "gree"
+	ACModelCoolix = "coolix"
+
+	ACModeAuto = "auto"
+	ACModeCool = "cool"
+	ACModeDry  = "dry"
+	ACModeFan  = "fan"
+	ACModeHeat = "heat"
+
+	ACFanAuto   = "auto"
+	ACFanLow    = "low"
+	ACFanMedium = "medium"
+	ACFanHigh   = "high"
+)
+
+var ErrACModelUnknown = errors.New("unknown air conditioner model")
+
+//	ACState is the desired state of an air conditioner
+//	AC remotes send the whole state in every frame instead of buttons
+type ACState struct {
+	ID         int `json:"-" gorm:"primary_key"`
+	InfraredID int `json:"infrared_id" gorm:"unique"`
+
+	Mode        string `json:"mode"`
+	Temperature int    `json:"temperature"`
+	Fan         string `json:"fan"`
+	Swing       bool   `json:"swing"`
+	Power       bool   `json:"power"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ACCapabilities struct {
+	Modes          []string `json:"modes"`
+	Fans           []string `json:"fans"`
+	MinTemperature int      `json:"min_temperature"`
+	MaxTemperature int      `json:"max_temperature"`
+	Swing          bool     `json:"swing"`
+}
+
+//	ACModel synthesises the frames of an air conditioner protocol
+//	previous is the state last sent, for protocols with toggle commands
+type ACModel interface {
+	Capabilities() ACCapabilities
+	Frequency() int
+	Encode(previous, next ACState) (timings []int, err error)
+}
+
+var ACModels = map[string]ACModel{
+	ACModelGree:   greeModel{},
+	ACModelCoolix: coolixModel{},
+}
+
+func DefaultACState(infraredID int) ACState {
+	return ACState{
+		InfraredID:  infraredID,
+		Mode:        ACModeCool,
+		Temperature: 24,
+		Fan:         ACFanAuto,
+	}
+}
+
+//	Validate checks state against what the model supports
+func (c ACCapabilities) Validate(state ACState) error {
+	if !contains(c.Modes, state.Mode) {
+		return fmt.Errorf("mode %q not supported, expected one of %v", state.Mode, c.Modes)
+	}
+	if !contains(c.Fans, state.Fan) {
+		return fmt.Errorf("fan %q not supported, expected one of %v", state.Fan, c.Fans)
+	}
+	if state.Temperature < c.MinTemperature || state.Temperature > c.MaxTemperature {
+		return fmt.Errorf("temperature %d out of range [%d, %d]", state.Temperature, c.MinTemperature, c.MaxTemperature)
+	}
+	if state.Swing && !c.Swing {
+		return fmt.Errorf("swing not supported")
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//	greeModel encodes the 8 byte state of Gree (YB0F2, YAW1F) remotes
+type greeModel struct{}
+
+var greeTiming = pulseDistance{
+	headerMark:  9000,
+	headerSpace: 4500,
+	bitMark:     620,
+	zeroSpace:   540,
+	oneSpace:    1600,
+}
+
+func (greeModel) Capabilities() ACCapabilities {
+	return ACCapabilities{
+		Modes:          []string{ACModeAuto, ACModeCool, ACModeDry, ACModeFan, ACModeHeat},
+		Fans:           []string{ACFanAuto, ACFanLow, ACFanMedium, ACFanHigh},
+		MinTemperature: 16,
+		MaxTemperature: 30,
+		Swing:          true,
+	}
+}
+
+func (greeModel) Frequency() int {
+	return 38000
+}
+
+func (greeModel) Encode(previous, next ACState) (timings []int, err error) {
+	modes := map[string]byte{ACModeAuto: 0, ACModeCool: 1, ACModeDry: 2, ACModeFan: 3, ACModeHeat: 4}
+	fans := map[string]byte{ACFanAuto: 0, ACFanLow: 1, ACFanMedium: 2, ACFanHigh: 3}
+	state := []byte{0x00, 0x00, 0x20, 0x50, 0x00, 0x20, 0x00, 0x00}
+	state[0] = modes[next.Mode] | fans[next.Fan]<<4
+	if next.Power {
+		state[0] |= 1 << 3
+	}
+	if next.Swing {
+		state[0] |= 1 << 6
+		state[4] = 0x01
+	}
+	state[1] = byte(next.Temperature - 16)
+	//Soma de verificação: nibbles baixos dos bytes 0 a 3 e altos dos bytes 4 a 6
+	sum := byte(10)
+	for _, b := range state[0:4] {
+		sum += b & 0x0F
+	}
+	for _, b := range state[4:7] {
+		sum += b >> 4
+	}
+	state[7] = sum << 4
+
+	timings = []int{greeTiming.headerMark, greeTiming.headerSpace}
+	timings = greeTiming.appendBits(timings, bytesLSB(state[0:4]))
+	//Rodapé de 3 bits e intervalo entre os dois blocos
+	timings = greeTiming.appendBits(timings, "010")
+	timings = append(timings, greeTiming.bitMark, 19980)
+	timings = greeTiming.appendBits(timings, bytesLSB(state[4:8]))
+	return append(timings, greeTiming.bitMark), nil
+}
+
+//	coolixModel encodes the 24 bit state of Midea/Coolix remotes
+//	Swing is a separate toggle frame sent after the state frame when it changes
+type coolixModel struct{}
+
+var coolixTiming = pulseDistance{
+	headerMark:  4692,
+	headerSpace: 4416,
+	bitMark:     552,
+	zeroSpace:   552,
+	oneSpace:    1656,
+}
+
+const (
+	coolixOff         = 0xB27BE0
+	coolixSwingToggle = 0xB26BE0
+	coolixGap         = 5244
+)
+
+func (coolixModel) Capabilities() ACCapabilities {
+	return ACCapabilities{
+		Modes:          []string{ACModeAuto, ACModeCool, ACModeDry, ACModeFan, ACModeHeat},
+		Fans:           []string{ACFanAuto, ACFanLow, ACFanMedium, ACFanHigh},
+		MinTemperature: 17,
+		MaxTemperature: 30,
+		Swing:          true,
+	}
+}
+
+func (coolixModel) Frequency() int {
+	return 38000
+}
+
+func (coolixModel) Encode(previous, next ACState) (timings []int, err error) {
+	//Código de temperatura de 17 a 30 graus
+	temperatures := []uint32{0x0, 0x1, 0x3, 0x2, 0x6, 0x7, 0x5, 0x4, 0xC, 0xD, 0x9, 0x8, 0xA, 0xB}
+	modes := map[string]uint32{ACModeCool: 0, ACModeDry: 1, ACModeFan: 1, ACModeAuto: 2, ACModeHeat: 3}
+	fans := map[string]uint32{ACFanAuto: 0x5, ACFanLow: 0x4, ACFanMedium: 0x2, ACFanHigh: 0x1}
+
+	code := uint32(coolixOff)
+	if next.Power {
+		fan := fans[next.Fan]
+		if next.Mode == ACModeAuto || next.Mode == ACModeDry {
+			fan = 0
+		}
+		temperature := temperatures[next.Temperature-17]
+		if next.Mode == ACModeFan {
+			temperature = 0xE
+		}
+		code = 0xB20000 | (fan<<5|0x1F)<<8 | temperature<<4 | modes[next.Mode]<<2
+	}
+	timings = coolixFrame(code)
+	if next.Power && next.Swing != previous.Swing {
+		timings = append(timings, coolixGap)
+		timings = append(timings, coolixFrame(coolixSwingToggle)...)
+	}
+	return timings, nil
+}
+
+//	coolixFrame sends every byte followed by its inverse, and the message twice
+func coolixFrame(code uint32) (timings []int) {
+	bits := ""
+	for shift := uint(16); ; shift -= 8 {
+		b := byte(code >> shift)
+		bits += lircBits(uint64(b), 8) + lircBits(uint64(^b), 8)
+		if shift == 0 {
+			break
+		}
+	}
+	for k := 0; k < 2; k++ {
+		if k > 0 {
+			timings = append(timings, coolixGap)
+		}
+		timings = append(timings, coolixTiming.headerMark, coolixTiming.headerSpace)
+		timings = coolixTiming.appendBits(timings, bits)
+		timings = append(timings, coolixTiming.bitMark)
+	}
+	return timings
+}
+
+//	SetAC validates and sends the full state of an air conditioner and stores it
+//	The emitter is held from reading the previous state until the new one is stored
+func (i *InfraredManager) SetAC(ctx context.Context, device Infrared, next ACState) (state ACState, err error) {
+	model, ok := ACModels[device.Model]
+	if !ok {
+		return state, ErrACModelUnknown
+	}
+	if err := model.Capabilities().Validate(next); err != nil {
+		return state, err
+	}
+	release, err := i.LockEmitter(ctx, device.Pin)
+	if err != nil {
+		return state, err
+	}
+	defer release()
+	previous, err := i.Repository.ReadACState(device.ID)
+	if err == ErrNotFound {
+		previous, err = DefaultACState(device.ID), nil
+	}
+	if err != nil {
+		return state, err
+	}
+	timings, err := model.Encode(previous, next)
+	if err != nil {
+		return state, err
+	}
+	if err := i.sendTimings(ctx, device.Pin, model.Frequency(), timings); err != nil {
+		return state, err
+	}
+	next.ID = previous.ID
+	next.InfraredID = device.ID
+	return i.Repository.WriteACState(next)
+}
+
+type ACResponse struct {
+	State        ACState        `json:"state"`
+	Capabilities ACCapabilities `json:"capabilities"`
+}
+
+func (i *InfraredManager) readAC(w http.ResponseWriter, r *http.Request) (device Infrared, state ACState, ok bool) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	device, err := i.Repository.ReadInfraredByID(id)
+	if err == nil && device.Type != TypeAC {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeError(w, i.Logger, "reading ac", err)
+		return device, state, false
+	}
+	if _, ok := ACModels[device.Model]; !ok {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{"error": ErrACModelUnknown.Error()})
+		return device, state, false
+	}
+	state, err = i.Repository.ReadACState(device.ID)
+	if err == ErrNotFound {
+		state, err = DefaultACState(device.ID), nil
+	}
+	if err != nil {
+		writeError(w, i.Logger, "reading ac state", err)
+		return device, state, false
+	}
+	return device, state, true
+}
+
+func (i *InfraredManager) ACHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	device, state, ok := i.readAC(w, r)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(ACResponse{
+		State:        state,
+		Capabilities: ACModels[device.Model].Capabilities(),
+	})
+}
+
+//	SetACHandler applies {mode, temperature, fan, swing, power}; omitted fields keep their current value
+func (i *InfraredManager) SetACHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	device, state, ok := i.readAC(w, r)
+	if !ok {
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		i.Logger.Printf("decoding ac state: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	model := ACModels[device.Model]
+	if err := model.Capabilities().Validate(state); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	state, err := i.SetAC(r.Context(), device, state)
+	if err != nil {
+		i.Logger.Printf("setting ac %d: %v\n", device.ID, err)
+		w.WriteHeader(transmitStatus(err))
+		return
+	}
+	json.NewEncoder(w).Encode(ACResponse{
+		State:        state,
+		Capabilities: model.Capabilities(),
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func (r *infraredRepository) ReadACState(infraredID int) (ACState, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state, ok := r.acStates[infraredID]
+	if !ok {
+		return state, ErrNotFound
+	}
+	return state, nil
+}
+
+func (r *infraredRepository) WriteACState(state ACState) (ACState, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state.ID = state.InfraredID
+	r.acStates[state.InfraredID] = state
+	return state, nil
+}
+
+//	pulseBits reads the bits of mark and space pairs, a long space being a 1
+func pulseBits(t *testing.T, timings []int, mark, threshold int) string {
+	t.Helper()
+	bits := make([]byte, 0, len(timings)/2)
+	for k := 0; k+1 < len(timings); k += 2 {
+		if timings[k] != mark {
+			t.Fatalf("mark %d at %d, want %d", timings[k], k, mark)
+		}
+		bits = append(bits, '0')
+		if timings[k+1] > threshold {
+			bits[len(bits)-1] = '1'
+		}
+	}
+	return string(bits)
+}
+
+func bitsLSB(bits string) (b []byte) {
+	for k := 0; k+8 <= len(bits); k += 8 {
+		var v byte
+		for i := 0; i < 8; i++ {
+			v |= (bits[k+i] - '0') << uint(i)
+		}
+		b = append(b, v)
+	}
+	return b
+}
+
+func bitsMSB(bits string) (v uint64) {
+	for _, c := range bits {
+		v = v<<1 | uint64(c-'0')
+	}
+	return v
+}
+
+//	TestGreeFrame checks the 8 state bytes of Gree frames; the last nibble
+//	is the checksum: 10 plus the low nibbles of bytes 0 to 3 and the high
+//	nibbles of bytes 4 to 6
+func TestGreeFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		state ACState
+		bytes [8]byte
+	}{
+		//10 + 9+8 + 2 = 29
+		{"cool 24 auto", ACState{Power: true, Mode: ACModeCool, Temperature: 24, Fan: ACFanAuto}, [8]byte{0x09, 0x08, 0x20, 0x50, 0x00, 0x20, 0x00, 0xD0}},
+		//10 + 0xC+0xE + 2 = 38
+		{"heat 30 high swing", ACState{Power: true, Mode: ACModeHeat, Temperature: 30, Fan: ACFanHigh, Swing: true}, [8]byte{0x7C, 0x0E, 0x20, 0x50, 0x01, 0x20, 0x00, 0x60}},
+		//10 + 0xA+0 + 2 = 22
+		{"dry 16 medium", ACState{Power: true, Mode: ACModeDry, Temperature: 16, Fan: ACFanMedium}, [8]byte{0x2A, 0x00, 0x20, 0x50, 0x00, 0x20, 0x00, 0x60}},
+		//10 + 1+8 + 2 = 21
+		{"off", ACState{Mode: ACModeCool, Temperature: 24, Fan: ACFanAuto}, [8]byte{0x01, 0x08, 0x20, 0x50, 0x00, 0x20, 0x00, 0x50}},
+	}
+	for _, tt := range tests {
+		timings, err := greeModel{}.Encode(DefaultACState(1), tt.state)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		//Cabeçalho, 4 bytes, rodapé 010, intervalo, 4 bytes e a marca final
+		if len(timings) != 2+64+6+2+64+1 || timings[0] != 9000 || timings[1] != 4500 || timings[73] != 19980 {
+			t.Fatalf("%s: frame of %d timings: %v", tt.name, len(timings), timings)
+		}
+		first := pulseBits(t, timings[2:72], greeTiming.bitMark, 1000)
+		if first[32:] != "010" {
+			t.Errorf("%s: footer %s, want 010", tt.name, first[32:])
+		}
+		got := append(bitsLSB(first[:32]), bitsLSB(pulseBits(t, timings[74:138], greeTiming.bitMark, 1000))...)
+		if string(got) != string(tt.bytes[:]) {
+			t.Errorf("%s: bytes % X, want % X", tt.name, got, tt.bytes)
+		}
+	}
+}
+
+//	coolixCodes reads the messages of Coolix timings, checking that every
+//	byte is followed by its inverse and that every message is sent twice
+func coolixCodes(t *testing.T, timings []int) (codes []uint32) {
+	t.Helper()
+	const frame = 2 + 96 + 1
+	for len(timings) > 0 {
+		if len(timings) < 2*frame+1 || timings[frame] != coolixGap {
+			t.Fatalf("message of %d timings", len(timings))
+		}
+		var message []uint64
+		for copy := 0; copy < 2; copy++ {
+			f := timings[copy*(frame+1):]
+			if f[0] != coolixTiming.headerMark || f[1] != coolixTiming.headerSpace {
+				t.Fatalf("header %v", f[:2])
+			}
+			bits := pulseBits(t, f[2:98], coolixTiming.bitMark, 1000)
+			message = append(message, bitsMSB(bits))
+		}
+		if message[0] != message[1] {
+			t.Errorf("copies differ: %X and %X", message[0], message[1])
+		}
+		var code uint32
+		for shift := uint(40); ; shift -= 16 {
+			b, inverse := byte(message[0]>>shift), byte(message[0]>>(shift-8))
+			if b != ^inverse {
+				t.Errorf("byte %02X followed by %02X", b, inverse)
+			}
+			code = code<<8 | uint32(b)
+			if shift == 8 {
+				break
+			}
+		}
+		codes = append(codes, code)
+		if timings = timings[2*frame+1:]; len(timings) > 0 {
+			if timings[0] != coolixGap {
+				t.Fatalf("gap %d between messages", timings[0])
+			}
+			timings = timings[1:]
+		}
+	}
+	return codes
+}
+
+func TestCoolixFrame(t *testing.T) {
+	off := DefaultACState(1)
+	tests := []struct {
+		name            string
+		previous, state ACState
+		codes           []uint32
+	}{
+		//Código de desligar dos controles Midea/Coolix
+		{"off", off, ACState{Mode: ACModeCool, Temperature: 24, Fan: ACFanAuto}, []uint32{0xB27BE0}},
+		{"cool 24 auto", off, ACState{Power: true, Mode: ACModeCool, Temperature: 24, Fan: ACFanAuto}, []uint32{0xB2BF40}},
+		{"heat 30 high", off, ACState{Power: true, Mode: ACModeHeat, Temperature: 30, Fan: ACFanHigh}, []uint32{0xB23FBC}},
+		//Nos modos auto e dry o ventilador é fixo
+		{"dry 20", off, ACState{Power: true, Mode: ACModeDry, Temperature: 20, Fan: ACFanHigh}, []uint32{0xB21F24}},
+		{"auto 25", off, ACState{Power: true, Mode: ACModeAuto, Temperature: 25, Fan: ACFanLow}, []uint32{0xB21FC8}},
+		//No modo ventilação a temperatura não é enviada
+		{"fan medium", off, ACState{Power: true, Mode: ACModeFan, Temperature: 17, Fan: ACFanMedium}, []uint32{0xB25FE4}},
+		//Swing é um comando alternado, enviado só quando muda
+		{"swing on", off, ACState{Power: true, Mode: ACModeCool, Temperature: 17, Fan: ACFanLow, Swing: true}, []uint32{0xB29F00, 0xB26BE0}},
+		{"swing kept", ACState{Power: true, Swing: true}, ACState{Power: true, Mode: ACModeCool, Temperature: 17, Fan: ACFanLow, Swing: true}, []uint32{0xB29F00}},
+		{"swing while off", off, ACState{Mode: ACModeCool, Temperature: 24, Fan: ACFanAuto, Swing: true}, []uint32{0xB27BE0}},
+	}
+	for _, tt := range tests {
+		timings, err := coolixModel{}.Encode(tt.previous, tt.state)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		codes := coolixCodes(t, timings)
+		if len(codes) != len(tt.codes) {
+			t.Errorf("%s: codes %X, want %X", tt.name, codes, tt.codes)
+			continue
+		}
+		for k := range codes {
+			if codes[k] != tt.codes[k] {
+				t.Errorf("%s: codes %X, want %X", tt.name, codes, tt.codes)
+				break
+			}
+		}
+	}
+}
+
+func TestACValidate(t *testing.T) {
+	for name, model := range ACModels {
+		capabilities := model.Capabilities()
+		valid := ACState{Mode: ACModeCool, Fan: ACFanAuto, Temperature: capabilities.MinTemperature}
+		if err := capabilities.Validate(valid); err != nil {
+			t.Errorf("%s: %+v: %v", name, valid, err)
+		}
+		valid.Temperature = capabilities.MaxTemperature
+		if err := capabilities.Validate(valid); err != nil {
+			t.Errorf("%s: %+v: %v", name, valid, err)
+		}
+		for _, invalid := range []ACState{
+			{Mode: ACModeCool, Fan: ACFanAuto, Temperature: capabilities.MinTemperature - 1},
+			{Mode: ACModeCool, Fan: ACFanAuto, Temperature: capabilities.MaxTemperature + 1},
+			{Mode: "turbo", Fan: ACFanAuto, Temperature: 24},
+			{Mode: ACModeCool, Fan: "ultra", Temperature: 24},
+			{Mode: "", Fan: ACFanAuto, Temperature: 24},
+		} {
+			if err := capabilities.Validate(invalid); err == nil {
+				t.Errorf("%s: accepted %+v", name, invalid)
+			}
+		}
+	}
+	capabilities := ACModels[ACModelGree].Capabilities()
+	capabilities.Swing = false
+	if err := capabilities.Validate(ACState{Mode: ACModeCool, Fan: ACFanAuto, Temperature: 24, Swing: true}); err == nil {
+		t.Error("accepted swing on a model without it")
+	}
+}
+
+func TestSetAC(t *testing.T) {
+	i, transmitter := testInfraredManager(t)
+	repository := newInfraredRepository()
+	i.Repository = repository
+	device := Infrared{ID: 1, Type: TypeAC, Model: ACModelCoolix, Pin: 17}
+
+	if _, err := i.SetAC(context.Background(), Infrared{ID: 2, Type: TypeAC, Model: "unknown", Pin: 17}, DefaultACState(2)); err != ErrACModelUnknown {
+		t.Errorf("unknown model: %v, want ErrACModelUnknown", err)
+	}
+	if _, err := i.SetAC(context.Background(), device, ACState{Power: true, Mode: ACModeCool, Fan: ACFanAuto, Temperature: 31}); err == nil {
+		t.Error("sent a temperature out of range")
+	}
+	if n := len(transmitter.Frames()); n != 0 {
+		t.Fatalf("%d frames sent for invalid states", n)
+	}
+
+	next := ACState{Power: true, Mode: ACModeCool, Fan: ACFanAuto, Temperature: 24, Swing: true}
+	state, err := i.SetAC(context.Background(), device, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := repository.ReadACState(device.ID); stored != state || !stored.Swing || stored.InfraredID != device.ID {
+		t.Errorf("stored %+v, answered %+v", stored, state)
+	}
+	//O swing já ligado não é alternado de novo
+	next.Temperature = 25
+	if _, err := i.SetAC(context.Background(), device, next); err != nil {
+		t.Fatal(err)
+	}
+	frames := transmitter.Frames()
+	if len(frames) != 2 || len(frames[1].Pulses) >= len(frames[0].Pulses) {
+		t.Errorf("%d frames; the second should carry no swing toggle", len(frames))
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	//Versão do formato do arquivo de backup
+	BackupVersion = 1
+
+	BackupKDF        = "pbkdf2-sha256"
+	BackupIterations = 200000
+
+	//A senha vai num cabeçalho para não aparecer em logs de URL
+	BackupPassphraseHeader = "X-Backup-Passphrase"
+	ConfigBackupPassphrase = "BACKUP_PASSPHRASE"
+)
+
+var (
+	ErrBackupVersion    = errors.New("unsupported backup version")
+	ErrBackupPassphrase = errors.New("wrong backup passphrase")
+	ErrBackupNotEmpty   = errors.New("restore needs a device without configuration")
+	errBackupDryRun     = errors.New("dry run")
+)
+
+//	Responsibilities:
+//	*	To export and to import the whole configuration of the controller
+//	BackupManager
+type BackupManager struct {
+	LogFile *os.File
+	Logger  *log.Logger
+
+	Repository
+}
+
+//	Backup is the archive of every configuration record
+//	IDs are the ones of the exporting device and only link records together
+type Backup struct {
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	Relays    []Relay    `json:"relays"`
+	Infrared  []Infrared `json:"infrared"`
+	ACStates  []ACState  `json:"ac_states"`
+	RGBStates []RGBState `json:"rgb_states"`
+	Bindings  []Binding  `json:"bindings"`
+	Macros    []Macro    `json:"macros"`
+	Schedules []Schedule `json:"schedules"`
+
+	Secrets *SealedSecrets `json:"secrets,omitempty"`
+}
+
+//	BackupSecrets are only exported on request, sealed with a passphrase
+//	Secret carries Info.Secret, which Info never serialises
+type BackupSecrets struct {
+	Info     Info     `json:"info"`
+	Secret   string   `json:"secret"`
+	Customer Customer `json:"customer"`
+}
+
+//	SealedSecrets is BackupSecrets encrypted with AES-256-GCM under a key
+//	derived from the passphrase
+type SealedSecrets struct {
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+//	RestoreReport tells what a restore wrote, or would write in a dry run,
+//	and the new ID given to every old one
+type RestoreReport struct {
+	DryRun    bool        `json:"dry_run"`
+	Relays    map[int]int `json:"relays"`
+	Infrared  map[int]int `json:"infrared"`
+	Commands  int         `json:"commands"`
+	States    int         `json:"states"`
+	Bindings  map[int]int `json:"bindings"`
+	Macros    map[int]int `json:"macros"`
+	Schedules map[int]int `json:"schedules"`
+	Secrets   bool        `json:"secrets"`
+}
+
+func NewBackupManager() *BackupManager {
+	return &BackupManager{}
+}
+
+func (b *BackupManager) Initialize(logPath string, repository Repository) error {
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	b.LogFile = f
+	b.Logger = log.New(b.LogFile, "", log.Ldate|log.Ltime)
+	b.Repository = repository
+	b.Logger.Printf("BackupManager started.\n")
+	return nil
+}
+
+func (b *BackupManager) Close() {
+	b.Logger.Printf("BackupManager closed.\n")
+	b.LogFile.Close()
+}
+
+//	ExportBackup reads every configuration record of repository
+//	Secrets are included only when passphrase is not empty
+func ExportBackup(repository Repository, passphrase string) (backup Backup, err error) {
+	backup = Backup{Version: BackupVersion, CreatedAt: time.Now()}
+	if backup.Relays, err = repository.ReadRelay(); err != nil {
+		return backup, err
+	}
+	if backup.Infrared, err = repository.ReadInfrared(); err != nil {
+		return backup, err
+	}
+	for _, device := range backup.Infrared {
+		ac, err := repository.ReadACState(device.ID)
+		if err == nil {
+			backup.ACStates = append(backup.ACStates, ac)
+		} else if err != ErrNotFound {
+			return backup, err
+		}
+		rgb, err := repository.ReadRGBState(device.ID)
+		if err == nil {
+			backup.RGBStates = append(backup.RGBStates, rgb)
+		} else if err != ErrNotFound {
+			return backup, err
+		}
+	}
+	if backup.Bindings, err = repository.ReadBinding(); err != nil {
+		return backup, err
+	}
+	if backup.Macros, err = repository.ReadMacro(); err != nil {
+		return backup, err
+	}
+	if backup.Schedules, err = repository.ReadSchedule(); err != nil {
+		return backup, err
+	}
+	if passphrase == "" {
+		return backup, nil
+	}
+
+	var secrets BackupSecrets
+	if secrets.Info, err = repository.ReadInfo(); err != nil && err != ErrNotFound {
+		return backup, err
+	}
+	if secrets.Customer, err = repository.ReadCustomer(); err != nil && err != ErrNotFound {
+		return backup, err
+	}
+	backup.Secrets, err = SealSecrets(secrets, passphrase)
+	return backup, err
+}
+
+//	Validate checks the version of backup and that every reference points to
+//	a record in the archive
+func (backup Backup) Validate() error {
+	if backup.Version < 1 || backup.Version > BackupVersion {
+		return fmt.Errorf("%v: %d", ErrBackupVersion, backup.Version)
+	}
+	relays := make(map[int]bool)
+	pins := make(map[int]bool)
+	for _, relay := range backup.Relays {
+		if pins[relay.RelayPin] {
+			return fmt.Errorf("relay %d: pin %d used twice", relay.ID, relay.RelayPin)
+		}
+		relays[relay.ID], pins[relay.RelayPin] = true, true
+	}
+	infrared := make(map[int]bool)
+	for _, device := range backup.Infrared {
+		infrared[device.ID] = true
+	}
+	for _, state := range backup.ACStates {
+		if !infrared[state.InfraredID] {
+			return fmt.Errorf("ac state: unknown infrared device %d", state.InfraredID)
+		}
+	}
+	for _, state := range backup.RGBStates {
+		if !infrared[state.InfraredID] {
+			return fmt.Errorf("rgb state: unknown infrared device %d", state.InfraredID)
+		}
+	}
+	macros := make(map[int]bool)
+	for _, macro := range backup.Macros {
+		macros[macro.ID] = true
+		for _, step := range macro.Steps {
+			if !infrared[step.InfraredID] {
+				return fmt.Errorf("macro %d: unknown infrared device %d", macro.ID, step.InfraredID)
+			}
+		}
+	}
+	for _, binding := range backup.Bindings {
+		for _, action := range binding.Actions {
+			switch {
+			case action.Type == ActionRelay && !relays[action.RelayID]:
+				return fmt.Errorf("binding %d: unknown relay %d", binding.ID, action.RelayID)
+			case action.Type == ActionInfrared && !infrared[action.InfraredID]:
+				return fmt.Errorf("binding %d: unknown infrared device %d", binding.ID, action.InfraredID)
+			case action.Type == ActionMacro && !macros[action.MacroID]:
+				return fmt.Errorf("binding %d: unknown macro %d", binding.ID, action.MacroID)
+			}
+		}
+	}
+	for _, schedule := range backup.Schedules {
+		if schedule.Type == ScheduleTypeMacro && !macros[schedule.MacroID] {
+			return fmt.Errorf("schedule %d: unknown macro %d", schedule.ID, schedule.MacroID)
+		}
+	}
+	return nil
+}
+
+func backupKey(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func SealSecrets(secrets BackupSecrets, passphrase string) (*SealedSecrets, error) {
+	secrets.Secret = secrets.Info.Secret
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+	sealed := &SealedSecrets{
+		KDF:        BackupKDF,
+		Iterations: BackupIterations,
+		Salt:       make([]byte, 16),
+	}
+	if _, err := rand.Read(sealed.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := backupKey(passphrase, sealed.Salt, sealed.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(sealed.Nonce); err != nil {
+		return nil, err
+	}
+	sealed.Ciphertext = aead.Seal(nil, sealed.Nonce, plaintext, nil)
+	return sealed, nil
+}
+
+func (sealed *SealedSecrets) Open(passphrase string) (secrets BackupSecrets, err error) {
+	if sealed.KDF != BackupKDF {
+		return secrets, fmt.Errorf("secrets: unknown key derivation %q", sealed.KDF)
+	}
+	aead, err := backupKey(passphrase, sealed.Salt, sealed.Iterations)
+	if err != nil {
+		return secrets, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return secrets, fmt.Errorf("secrets: invalid nonce")
+	}
+	plaintext, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, nil)
+	if err != nil {
+		return secrets, ErrBackupPassphrase
+	}
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return secrets, err
+	}
+	if secrets.Secret == "" {
+		//Backups antigos levavam o segredo dentro de info
+		var legacy struct {
+			Info struct {
+				Secret string `json:"secret"`
+			} `json:"info"`
+		}
+		json.Unmarshal(plaintext, &legacy)
+		secrets.Secret = legacy.Info.Secret
+	}
+	secrets.Info.Secret = secrets.Secret
+	return secrets, nil
+}
+
+//	Restore validates backup and writes it into an empty database in a single
+//	transaction, rolled back at the end of a dry run
+//	Secrets are restored only when passphrase is given
+func (dm *DatabaseManager) Restore(backup Backup, passphrase string, dryRun bool) (report RestoreReport, err error) {
+	if err := backup.Validate(); err != nil {
+		return report, err
+	}
+	var secrets *BackupSecrets
+	if backup.Secrets != nil && passphrase != "" {
+		opened, err := backup.Secrets.Open(passphrase)
+		if err != nil {
+			return report, err
+		}
+		secrets = &opened
+	}
+	err = dm.transaction(func(tx *gorm.DB) error {
+		report, err = restoreBackup(tx, backup, secrets)
+		if err == nil && dryRun {
+			return errBackupDryRun
+		}
+		return err
+	})
+	report.DryRun = dryRun
+	switch err {
+	case errBackupDryRun:
+		return report, nil
+	case ErrBackupNotEmpty:
+		//Recusa do restore, não um erro do banco
+		return report, err
+	}
+	return report, dbError(err)
+}
+
+func restoreBackup(tx *gorm.DB, backup Backup, secrets *BackupSecrets) (report RestoreReport, err error) {
+	report = RestoreReport{
+		Relays:    make(map[int]int),
+		Infrared:  make(map[int]int),
+		Bindings:  make(map[int]int),
+		Macros:    make(map[int]int),
+		Schedules: make(map[int]int),
+	}
+	for _, model := range []interface{}{&Relay{}, &Infrared{}, &Binding{}, &Macro{}, &Schedule{}} {
+		count := 0
+		if err := tx.Model(model).Count(&count).Error; err != nil {
+			return report, err
+		}
+		if count > 0 {
+			return report, ErrBackupNotEmpty
+		}
+	}
+
+	for _, relay := range backup.Relays {
+		old := relay.ID
+		relay.ID, relay.DeletedAt = 0, nil
+		if err := tx.Create(&relay).Error; err != nil {
+			return report, err
+		}
+		report.Relays[old] = relay.ID
+	}
+	for _, device := range backup.Infrared {
+		old := device.ID
+		device.ID, device.DeletedAt = 0, nil
+		//Cópias, para não alterar o backup de quem chama, como num dry-run
+		device.Commands = append([]Command(nil), device.Commands...)
+		for k := range device.Commands {
+			device.Commands[k].ID = 0
+			device.Commands[k].InfraredID = 0
+		}
+		if err := tx.Create(&device).Error; err != nil {
+			return report, err
+		}
+		report.Infrared[old] = device.ID
+		report.Commands += len(device.Commands)
+	}
+	for _, state := range backup.ACStates {
+		state.ID, state.InfraredID = 0, report.Infrared[state.InfraredID]
+		if err := tx.Create(&state).Error; err != nil {
+			return report, err
+		}
+		report.States++
+	}
+	for _, state := range backup.RGBStates {
+		state.ID, state.InfraredID = 0, report.Infrared[state.InfraredID]
+		if err := tx.Create(&state).Error; err != nil {
+			return report, err
+		}
+		report.States++
+	}
+	//Macros antes das associações e agendamentos que as referenciam
+	for _, macro := range backup.Macros {
+		old := macro.ID
+		macro.ID, macro.DeletedAt = 0, nil
+		macro.Steps = append([]MacroStep(nil), macro.Steps...)
+		for k := range macro.Steps {
+			step := &macro.Steps[k]
+			step.ID, step.MacroID, step.InfraredID = 0, 0, report.Infrared[step.InfraredID]
+		}
+		if err := tx.Create(&macro).Error; err != nil {
+			return report, err
+		}
+		report.Macros[old] = macro.ID
+	}
+	for _, binding := range backup.Bindings {
+		old := binding.ID
+		binding.ID, binding.DeletedAt = 0, nil
+		binding.Actions = append([]BindingAction(nil), binding.Actions...)
+		for k := range binding.Actions {
+			action := &binding.Actions[k]
+			action.ID, action.BindingID = 0, 0
+			action.RelayID = report.Relays[action.RelayID]
+			action.InfraredID = report.Infrared[action.InfraredID]
+			action.MacroID = report.Macros[action.MacroID]
+		}
+		if err := tx.Create(&binding).Error; err != nil {
+			return report, err
+		}
+		report.Bindings[old] = binding.ID
+	}
+	for _, schedule := range backup.Schedules {
+		old := schedule.ID
+		schedule.ID, schedule.MacroID = 0, report.Macros[schedule.MacroID]
+		if err := tx.Create(&schedule).Error; err != nil {
+			return report, err
+		}
+		report.Schedules[old] = schedule.ID
+	}
+
+	if secrets == nil {
+		return report, nil
+	}
+	//Info e cliente substituem os do dispositivo novo
+	if err := tx.Delete(Info{}).Error; err != nil {
+		return report, err
+	}
+	if err := tx.Delete(Customer{}).Error; err != nil {
+		return report, err
+	}
+	secrets.Info.ID, secrets.Customer.ID = 0, 0
+	if err := tx.Create(&secrets.Info).Error; err != nil {
+		return report, err
+	}
+	if err := tx.Create(&secrets.Customer).Error; err != nil {
+		return report, err
+	}
+	report.Secrets = true
+	return report, nil
+}
+
+//	BackupHandler answers the archive; secrets are sealed with the passphrase
+//	header when ?secrets=true
+func (b *BackupManager) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	passphrase := ""
+	if r.URL.Query().Get("secrets") == "true" {
+		if passphrase = r.Header.Get(BackupPassphraseHeader); passphrase == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "secrets need the " + BackupPassphraseHeader + " header"})
+			return
+		}
+	}
+	backup, err := ExportBackup(b.Repository, passphrase)
+	if err != nil {
+		writeError(w, b.Logger, "exporting backup", err)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=juggernaut-backup.json")
+	json.NewEncoder(w).Encode(backup)
+}
+
+//	RestoreHandler restores an archive into this device; ?dry_run=true only
+//	validates it and reports what would be written
+func (b *BackupManager) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	var backup Backup
+	if err := json.NewDecoder(r.Body).Decode(&backup); err != nil {
+		b.Logger.Printf("decoding backup: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := backup.Validate(); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	report, err := b.Repository.Restore(backup, r.Header.Get(BackupPassphraseHeader), dryRun)
+	switch {
+	case err == ErrBackupNotEmpty:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	case err == ErrBackupPassphrase:
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	case err != nil:
+		writeError(w, b.Logger, "restoring backup", err)
+	default:
+		b.Logger.Printf("restored backup: %+v\n", report)
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSealSecrets(t *testing.T) {
+	secrets := BackupSecrets{
+		Info:     Info{UUID: "device", Identifier: "Casa", Secret: "5ec2e7"},
+		Customer: Customer{Name: "Ana", Account: "ana@example.com", Hash: "hash"},
+	}
+	sealed, err := SealSecrets(secrets, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed.Ciphertext, []byte("5ec2e7")) || bytes.Contains(sealed.Ciphertext, []byte("ana@example.com")) {
+		t.Fatal("secrets in clear in the ciphertext")
+	}
+	opened, err := sealed.Open("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Info != secrets.Info || opened.Customer != secrets.Customer {
+		t.Errorf("opened %+v, want %+v", opened, secrets)
+	}
+	if _, err := sealed.Open("wrong horse"); err != ErrBackupPassphrase {
+		t.Errorf("wrong passphrase: %v, want ErrBackupPassphrase", err)
+	}
+
+	tampered := *sealed
+	tampered.Ciphertext = append([]byte(nil), sealed.Ciphertext...)
+	tampered.Ciphertext[0] ^= 1
+	if _, err := tampered.Open("correct horse"); err != ErrBackupPassphrase {
+		t.Errorf("tampered ciphertext: %v, want ErrBackupPassphrase", err)
+	}
+	tampered = *sealed
+	tampered.Nonce = tampered.Nonce[1:]
+	if _, err := tampered.Open("correct horse"); err == nil || err == ErrBackupPassphrase {
+		t.Errorf("short nonce: %v", err)
+	}
+	tampered = *sealed
+	tampered.KDF = "scrypt"
+	if _, err := tampered.Open("correct horse"); err == nil || err == ErrBackupPassphrase {
+		t.Errorf("unknown key derivation: %v", err)
+	}
+
+	//Sal e nonce novos a cada exportação
+	again, err := SealSecrets(secrets, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again.Salt, sealed.Salt) || bytes.Equal(again.Nonce, sealed.Nonce) {
+		t.Error("salt or nonce reused")
+	}
+}
+
+//	TestSealSecretsLegacy opens secrets sealed when Info still serialised
+//	its secret
+func TestSealSecretsLegacy(t *testing.T) {
+	if out, _ := json.Marshal(Info{UUID: "device", Secret: "5ec2e7"}); bytes.Contains(out, []byte("5ec2e7")) {
+		t.Fatalf("info serialises its secret: %s", out)
+	}
+	plaintext := []byte(`{"info":{"uuid":"device","secret":"5ec2e7"},"customer":{"name":"Ana"}}`)
+	sealed := &SealedSecrets{KDF: BackupKDF, Iterations: 1000, Salt: []byte("salt")}
+	aead, err := backupKey("correct horse", sealed.Salt, sealed.Iterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	sealed.Ciphertext = aead.Seal(nil, sealed.Nonce, plaintext, nil)
+	opened, err := sealed.Open("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Info.UUID != "device" || opened.Info.Secret != "5ec2e7" || opened.Customer.Name != "Ana" {
+		t.Errorf("opened %+v", opened)
+	}
+}
+
+//	testBackup links every kind of record, with IDs as another device would
+//	have given them
+func testBackup() Backup {
+	return Backup{
+		Version:   BackupVersion,
+		Relays:    []Relay{{ID: 3, Name: "sala", Type: TypeLamp, RelayPin: 17}, {ID: 4, Name: "portão", RelayPin: 27}},
+		Infrared:  []Infrared{{ID: 5, Name: "tv", Type: TypeTV, Pin: 18, Commands: []Command{{ID: 9, InfraredID: 5, Button: 1, Protocol: ProtocolNEC, Code: NECCode(0x04, 0x08)}}}, {ID: 6, Name: "ar", Type: TypeAC, Model: ACModelGree, Pin: 22}},
+		ACStates:  []ACState{{ID: 2, InfraredID: 6, Power: true, Mode: ACModeCool, Temperature: 23, Fan: ACFanAuto}},
+		Macros:    []Macro{{ID: 7, Name: "cinema", Steps: []MacroStep{{ID: 1, MacroID: 7, InfraredID: 5, Button: 1, Repeat: 1}}}},
+		Bindings:  []Binding{{ID: 8, Name: "power", Protocol: ProtocolNEC, Address: 0x04, Command: 0x10, Actions: []BindingAction{{ID: 1, BindingID: 8, Type: ActionRelay, RelayID: 4, RelayCommand: CommandToggle}, {ID: 2, BindingID: 8, Position: 1, Type: ActionInfrared, InfraredID: 5, Button: 1}, {ID: 3, BindingID: 8, Position: 2, Type: ActionMacro, MacroID: 7}}}},
+		Schedules: []Schedule{{ID: 2, Type: ScheduleTypeMacro, Frequency: "daily", MacroID: 7}},
+	}
+}
+
+func TestBackupValidate(t *testing.T) {
+	if err := testBackup().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		corrupt func(b *Backup)
+		want    string
+	}{
+		{"old version", func(b *Backup) { b.Version = 0 }, "version"},
+		{"new version", func(b *Backup) { b.Version = BackupVersion + 1 }, "version"},
+		{"relay pin", func(b *Backup) { b.Relays[1].RelayPin = 17 }, "pin 17"},
+		{"ac state", func(b *Backup) { b.ACStates[0].InfraredID = 1 }, "infrared device 1"},
+		{"rgb state", func(b *Backup) { b.RGBStates = []RGBState{{InfraredID: 1}} }, "infrared device 1"},
+		{"macro step", func(b *Backup) { b.Macros[0].Steps[0].InfraredID = 1 }, "infrared device 1"},
+		{"binding relay", func(b *Backup) { b.Bindings[0].Actions[0].RelayID = 1 }, "relay 1"},
+		{"binding infrared", func(b *Backup) { b.Bindings[0].Actions[1].InfraredID = 1 }, "infrared device 1"},
+		{"binding macro", func(b *Backup) { b.Bindings[0].Actions[2].MacroID = 1 }, "macro 1"},
+		{"schedule macro", func(b *Backup) { b.Schedules[0].MacroID = 1 }, "macro 1"},
+	}
+	for _, tt := range tests {
+		backup := testBackup()
+		tt.corrupt(&backup)
+		if err := backup.Validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want an error naming %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+//	BLE payloads larger than a single ATT packet are sent as a message split
+//	in chunks. A message is
+//		length (2 bytes) | payload | CRC-32 IEEE of the payload (4 bytes)
+//	and each chunk is
+//		sequence (2 bytes) | up to capacity-2 bytes of the message
+//	Integers are big endian. Sequences start at 0 on every message, so a
+//	chunk with sequence 0 discards a message left incomplete
+const (
+	FrameHeaderSize = 2
+	FrameLengthSize = 2
+	FrameCRCSize    = 4
+	FrameMaxPayload = 1<<16 - 1
+)
+
+var (
+	ErrFrameTooLarge  = errors.New("frame payload too large")
+	ErrFrameCapacity  = errors.New("frame capacity too small")
+	ErrFrameCRC       = errors.New("frame checksum mismatch")
+	ErrFrameMalformed = errors.New("malformed frame")
+)
+
+//	Frames splits payload into chunks of at most capacity bytes
+func Frames(payload []byte, capacity int) ([][]byte, error) {
+	if len(payload) > FrameMaxPayload {
+		return nil, ErrFrameTooLarge
+	}
+	if capacity <= FrameHeaderSize {
+		return nil, ErrFrameCapacity
+	}
+	message := binary.BigEndian.AppendUint16(nil, uint16(len(payload)))
+	message = append(message, payload...)
+	message = binary.BigEndian.AppendUint32(message, crc32.ChecksumIEEE(payload))
+	size := capacity - FrameHeaderSize
+	if (len(message)+size-1)/size > 1<<16 {
+		return nil, ErrFrameTooLarge
+	}
+	var chunks [][]byte
+	for seq := 0; len(message) > 0; seq++ {
+		k := size
+		if k > len(message) {
+			k = len(message)
+		}
+		chunk := binary.BigEndian.AppendUint16(nil, uint16(seq))
+		chunks = append(chunks, append(chunk, message[:k]...))
+		message = message[k:]
+	}
+	return chunks, nil
+}
+
+//	WriteFrames writes payload to w, one chunk per write, as a notifier expects
+func WriteFrames(w io.Writer, capacity int, payload []byte) error {
+	chunks, err := Frames(payload, capacity)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//	FrameReader reassembles the chunks of one sender
+type FrameReader struct {
+	message  []byte
+	next     uint16
+	expected int
+}
+
+//	Push adds a chunk and returns the payload once its message is complete
+//	After an error the message is discarded and the reader waits for a new one
+func (f *FrameReader) Push(chunk []byte) (payload []byte, err error) {
+	if len(chunk) <= FrameHeaderSize {
+		f.Reset()
+		return nil, ErrFrameMalformed
+	}
+	seq := binary.BigEndian.Uint16(chunk)
+	if seq == 0 {
+		f.Reset()
+	} else if f.message == nil || seq != f.next {
+		expected := f.next
+		f.Reset()
+		return nil, fmt.Errorf("frame sequence %d, expected %d", seq, expected)
+	}
+	f.message = append(f.message, chunk[FrameHeaderSize:]...)
+	f.next = seq + 1
+	if f.expected == 0 && len(f.message) >= FrameLengthSize {
+		f.expected = FrameLengthSize + int(binary.BigEndian.Uint16(f.message)) + FrameCRCSize
+	}
+	if f.expected == 0 || len(f.message) < f.expected {
+		return nil, nil
+	}
+	message, expected := f.message, f.expected
+	f.Reset()
+	if len(message) > expected {
+		return nil, ErrFrameMalformed
+	}
+	payload = message[FrameLengthSize : expected-FrameCRCSize]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(message[expected-FrameCRCSize:]) {
+		return nil, ErrFrameCRC
+	}
+	return payload, nil
+}
+
+func (f *FrameReader) Reset() {
+	f.message, f.next, f.expected = nil, 0, 0
+}
+
+//	frameReaders keeps a reader per central and characteristic, since
+//	centrals may write to several characteristics at once
+type frameReaders struct {
+	readers map[string]map[string]*FrameReader
+	lock    sync.Mutex
+}
+
+func (fr *frameReaders) Push(central, characteristic string, chunk []byte) ([]byte, error) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	if fr.readers == nil {
+		fr.readers = make(map[string]map[string]*FrameReader)
+	}
+	if fr.readers[central] == nil {
+		fr.readers[central] = make(map[string]*FrameReader)
+	}
+	reader, ok := fr.readers[central][characteristic]
+	if !ok {
+		reader = &FrameReader{}
+		fr.readers[central][characteristic] = reader
+	}
+	return reader.Push(chunk)
+}
+
+func (fr *frameReaders) Forget(central string) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	delete(fr.readers, central)
+}
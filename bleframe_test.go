@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+//	chunkWriter keeps each write as a chunk, like a characteristic notifier
+type chunkWriter [][]byte
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	*w = append(*w, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func readFrames(t *testing.T, reader *FrameReader, chunks [][]byte) []byte {
+	t.Helper()
+	for i, chunk := range chunks {
+		payload, err := reader.Push(chunk)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if payload != nil {
+			if i != len(chunks)-1 {
+				t.Fatalf("payload complete at chunk %d of %d", i, len(chunks))
+			}
+			return payload
+		}
+	}
+	t.Fatal("payload incomplete after every chunk")
+	return nil
+}
+
+func TestFramesRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	//Capacidades a partir do mínimo, do ATT MTU padrão (23-3) e de MTUs negociados
+	for _, capacity := range []int{3, 4, 7, 20, 182, 244, 512} {
+		for _, size := range []int{0, 1, 2, 5, 19, 20, 21, 100, 1000, 4096} {
+			payload := make([]byte, size)
+			random.Read(payload)
+			var w chunkWriter
+			if err := WriteFrames(&w, capacity, payload); err != nil {
+				t.Fatalf("capacity %d, size %d: %v", capacity, size, err)
+			}
+			for _, chunk := range w {
+				if len(chunk) > capacity {
+					t.Fatalf("capacity %d: chunk of %d bytes", capacity, len(chunk))
+				}
+			}
+			var reader FrameReader
+			if got := readFrames(t, &reader, w); !bytes.Equal(got, payload) {
+				t.Errorf("capacity %d, size %d: payload changed", capacity, size)
+			}
+		}
+	}
+}
+
+func TestFramesLimits(t *testing.T) {
+	if _, err := Frames([]byte("x"), FrameHeaderSize); err != ErrFrameCapacity {
+		t.Errorf("capacity %d: %v, want ErrFrameCapacity", FrameHeaderSize, err)
+	}
+	if _, err := Frames(make([]byte, FrameMaxPayload+1), 20); err != ErrFrameTooLarge {
+		t.Errorf("payload of %d bytes: %v, want ErrFrameTooLarge", FrameMaxPayload+1, err)
+	}
+	//Com um byte por chunk o maior payload não cabe nas sequências
+	if _, err := Frames(make([]byte, FrameMaxPayload), FrameHeaderSize+1); err != ErrFrameTooLarge {
+		t.Errorf("more than 1<<16 chunks: %v, want ErrFrameTooLarge", err)
+	}
+	chunks, err := Frames(make([]byte, FrameMaxPayload), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reader FrameReader
+	if got := readFrames(t, &reader, chunks); len(got) != FrameMaxPayload {
+		t.Errorf("largest payload read as %d bytes", len(got))
+	}
+}
+
+func TestFrameReaderErrors(t *testing.T) {
+	payload := []byte("the quick brown fox jumps over the lazy dog")
+	chunks, err := Frames(payload, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		chunks [][]byte
+	}{
+		{"out of order", [][]byte{chunks[0], chunks[2], chunks[1]}},
+		{"duplicate", [][]byte{chunks[0], chunks[1], chunks[1]}},
+		{"without start", chunks[1:]},
+		{"header only", [][]byte{chunks[0], chunks[1][:FrameHeaderSize]}},
+	}
+	for _, tt := range tests {
+		var reader FrameReader
+		var failed bool
+		for _, chunk := range tt.chunks {
+			payload, err := reader.Push(chunk)
+			if payload != nil {
+				t.Fatalf("%s: returned a payload", tt.name)
+			}
+			if err != nil {
+				failed = true
+				break
+			}
+		}
+		if !failed {
+			t.Errorf("%s: no error", tt.name)
+		}
+		//Depois de um erro o leitor aceita a próxima mensagem
+		if got := readFrames(t, &reader, chunks); !bytes.Equal(got, payload) {
+			t.Errorf("%s: next message read as %q", tt.name, got)
+		}
+	}
+}
+
+func TestFrameReaderCRC(t *testing.T) {
+	for _, payload := range [][]byte{nil, []byte("relay on")} {
+		chunks, err := Frames(payload, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//Troca um bit do payload, ou do CRC quando não há payload
+		i, k := 1, FrameHeaderSize
+		if len(payload) == 0 {
+			i, k = len(chunks)-1, len(chunks[len(chunks)-1])-1
+		}
+		corrupted := append([]byte(nil), chunks[i]...)
+		corrupted[k] ^= 0x80
+		chunks = append(append(chunks[:i:i], corrupted), chunks[i+1:]...)
+		var reader FrameReader
+		for i, chunk := range chunks {
+			got, err := reader.Push(chunk)
+			if i < len(chunks)-1 && (got != nil || err != nil) {
+				t.Fatalf("chunk %d: %q, %v", i, got, err)
+			}
+			if i == len(chunks)-1 && (got != nil || err != ErrFrameCRC) {
+				t.Errorf("payload %q: %q, %v, want ErrFrameCRC", payload, got, err)
+			}
+		}
+	}
+}
+
+//	TestFrameReaderRestart sends a new message before the previous one ends,
+//	as an app does after a write times out
+func TestFrameReaderRestart(t *testing.T) {
+	first, err := Frames([]byte("abandoned message"), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Frames([]byte("retried message"), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reader FrameReader
+	for _, chunk := range first[:3] {
+		if payload, err := reader.Push(chunk); payload != nil || err != nil {
+			t.Fatalf("%q, %v", payload, err)
+		}
+	}
+	if got := readFrames(t, &reader, second); string(got) != "retried message" {
+		t.Errorf("read %q after restarting", got)
+	}
+}
+
+func TestFrameReadersInterleaved(t *testing.T) {
+	var readers frameReaders
+	a, _ := Frames([]byte("ssid from a"), 5)
+	b, _ := Frames([]byte("ssid from b"), 5)
+	c, _ := Frames([]byte("status of a"), 5)
+	got := make(map[string]string)
+	for i := 0; i < len(a); i++ {
+		for _, w := range []struct {
+			central, characteristic string
+			chunks                  [][]byte
+		}{
+			{"a", "credentials", a},
+			{"b", "credentials", b},
+			{"a", "status", c},
+		} {
+			payload, err := readers.Push(w.central, w.characteristic, w.chunks[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if payload != nil {
+				got[w.central+" "+w.characteristic] = string(payload)
+			}
+		}
+	}
+	if got["a credentials"] != "ssid from a" || got["b credentials"] != "ssid from b" || got["a status"] != "status of a" {
+		t.Errorf("read %v", got)
+	}
+
+	readers.Push("a", "credentials", a[0])
+	readers.Forget("a")
+	if _, err := readers.Push("a", "credentials", a[1]); err == nil {
+		t.Error("continued a message of a forgotten central")
+	}
+}
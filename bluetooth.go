@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
-	"io"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/paypal/gatt"
@@ -20,9 +18,14 @@ type BluetoothManager struct {
 	LogFile *os.File
 	Logger  *log.Logger
 	Device  gatt.Device
-	*DatabaseManager
+	Repository
 	*DeviceManager
 	*SecurityManager
+	MacroManager *MacroManager
+	Network      NetworkBackend
+
+	frames       frameReaders
+	provisioning provisioning
 }
 
 func NewBluetoothManager() (bm *BluetoothManager) {
@@ -35,8 +38,8 @@ func NewBluetoothManager() (bm *BluetoothManager) {
 	}
 }
 
-func (bm *BluetoothManager) Initialize(logPath string, database *DatabaseManager,
-	deviceManager *DeviceManager, security *SecurityManager) error {
+func (bm *BluetoothManager) Initialize(logPath string, repository Repository,
+	deviceManager *DeviceManager, security *SecurityManager, macroManager *MacroManager) error {
 	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return err
@@ -62,9 +65,11 @@ func (bm *BluetoothManager) Initialize(logPath string, database *DatabaseManager
 		}
 	}
 	bm.Device.Init(onStateChanged)
-	bm.DatabaseManager = database
+	bm.Repository = repository
 	bm.DeviceManager = deviceManager
 	bm.SecurityManager = security
+	bm.MacroManager = macroManager
+	bm.Network = NewNetworkBackend()
 	bm.Logger.Printf("BluetoothManager started.\n")
 	return nil
 }
@@ -77,12 +82,17 @@ func (bm *BluetoothManager) Close() {
 func (bm *BluetoothManager) OnConnect() (f func(gatt.Central)) {
 	return func(c gatt.Central) {
 		bm.Logger.Printf("Device with ID %s connected.\n", c.ID())
+		bleConnections.Add(1)
+		bleConnectionTotal.Inc()
 	}
 }
 
 func (bm *BluetoothManager) OnDisconnect() (f func(gatt.Central)) {
 	return func(c gatt.Central) {
 		bm.Logger.Printf("Device with ID %s disconnected.\n", c.ID())
+		bleConnections.Add(-1)
+		bm.frames.Forget(c.ID())
+		bm.provisioning.forget(c.ID())
 	}
 }
 
@@ -91,7 +101,7 @@ func (bm *BluetoothManager) Service() *gatt.Service {
 
 	notifyTemperature := false
 	temperature := s.AddCharacteristic(gatt.MustParseUUID("aee5af4f-d1a8-4855-b770-b912519327d6"))
-	temperature.HandleWriteFunc(func(r gatt.Request, data []byte) (status byte) {
+	bm.HandleFramedWrite(temperature, func(r gatt.Request, data []byte) (status byte) {
 		if strings.ToLower(string(data)) == "y" {
 			notifyTemperature = true
 		}
@@ -104,21 +114,8 @@ func (bm *BluetoothManager) Service() *gatt.Service {
 			}
 			temperatureRead := bm.DeviceManager.Temperature()
 			bm.Logger.Printf("temperature read: %.2f\n", temperatureRead.TemperatureValue)
-			source, err := json.Marshal(temperatureRead)
-			if err != nil {
-				bm.Logger.Printf("marshalling temperature: %v\n", err)
-				continue
-			}
-			reader := bytes.NewReader(source)
-			transf := make([]byte, 20)
-			for {
-				k, err := reader.Read(transf)
-				if err == io.EOF {
-					fmt.Fprintf(notifier, "end")
-					break
-				}
-				bm.Logger.Printf("transf[:%d] = %q\n", k, transf[:k])
-				fmt.Fprintf(notifier, "%s", transf[:k])
+			if err := bm.Notify(notifier, temperatureRead); err != nil {
+				bm.Logger.Printf("notifying temperature: %v\n", err)
 			}
 			notifyTemperature = false
 		}
@@ -126,7 +123,7 @@ func (bm *BluetoothManager) Service() *gatt.Service {
 
 	notifyWifi := false
 	wifi := s.AddCharacteristic(gatt.MustParseUUID("351e784a-4099-405e-8031-e4b473e668a4"))
-	wifi.HandleWriteFunc(func(r gatt.Request, data []byte) (status byte) {
+	bm.HandleFramedWrite(wifi, func(r gatt.Request, data []byte) (status byte) {
 		if strings.ToLower(string(data)) == "y" {
 			notifyWifi = true
 			return gatt.StatusSuccess
@@ -147,24 +144,9 @@ func (bm *BluetoothManager) Service() *gatt.Service {
 			for _, wifi := range wifis {
 				bm.Logger.Println(wifi)
 			}
-			//Converte os Wifis para uma string JSON
-			source, err := json.Marshal(wifis)
-			if err != nil {
-				bm.Logger.Printf("marshalling wifis: %v\n", err)
-				continue
-			}
-			reader := bytes.NewReader(source)
-			//Buffer de transferência para enviar em pedaços
-			transf := make([]byte, 20)
-			for {
-				k, err := reader.Read(transf)
-				if err == io.EOF {
-					break
-				}
-				//registra o buffer de transferência
-				bm.Logger.Printf("transf[:%d] = %q\n", k, transf[:k])
-				//envia o buffer de transferência pelo notifier
-				fmt.Fprintf(notifier, "%s", transf[:k])
+			//Envia os Wifis como JSON, numa única mensagem
+			if err := bm.Notify(notifier, wifis); err != nil {
+				bm.Logger.Printf("notifying wifis: %v\n", err)
 			}
 			notifyWifi = false
 		}
@@ -172,7 +154,7 @@ func (bm *BluetoothManager) Service() *gatt.Service {
 
 	notifyNetwork := false
 	network := s.AddCharacteristic(gatt.MustParseUUID("1b9ee264-b8a7-4fa9-b001-fbae0e25c26d"))
-	network.HandleWriteFunc(func(r gatt.Request, data []byte) (status byte) {
+	bm.HandleFramedWrite(network, func(r gatt.Request, data []byte) (status byte) {
 		if strings.ToLower(string(data)) == "y" {
 			notifyNetwork = true
 		}
@@ -186,25 +168,68 @@ func (bm *BluetoothManager) Service() *gatt.Service {
 			network := bm.DeviceManager.Network()
 			bm.Logger.Println("Network read:")
 			bm.Logger.Println(network)
-			source, err := json.Marshal(network)
-			if err != nil {
-				bm.Logger.Printf("marshalling network: %v\n", err)
-				continue
-			}
-			reader := bytes.NewReader(source)
-			transf := make([]byte, 20)
-			for {
-				k, err := reader.Read(transf)
-				if err == io.EOF {
-					fmt.Fprintf(notifier, "end")
-					break
-				}
-				bm.Logger.Printf("transf[:%d] = %q\n", k, transf[:k])
-				fmt.Fprintf(notifier, "%s", transf[:k])
+			if err := bm.Notify(notifier, network); err != nil {
+				bm.Logger.Printf("notifying network: %v\n", err)
 			}
 			notifyNetwork = false
 		}
 	})
 
+	//Recebe o ID de uma macro a executar, ou "cancel <run>" para interrompê-la
+	macro := s.AddCharacteristic(gatt.MustParseUUID("5d8f3c1e-6a2b-4f7d-9e41-0c2a7b8d4f16"))
+	bm.HandleFramedWrite(macro, func(r gatt.Request, data []byte) (status byte) {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && strings.ToLower(fields[0]) == "cancel" {
+			run, err := strconv.Atoi(fields[1])
+			if err != nil || !bm.MacroManager.Cancel(run) {
+				return gatt.StatusUnexpectedError
+			}
+			return gatt.StatusSuccess
+		}
+		if len(fields) != 1 {
+			return gatt.StatusUnexpectedError
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return gatt.StatusUnexpectedError
+		}
+		run, err := bm.MacroManager.Start(id)
+		if err != nil {
+			bm.Logger.Printf("running macro %d: %v\n", id, err)
+			return gatt.StatusUnexpectedError
+		}
+		bm.Logger.Printf("running macro %d: run %d\n", id, run.Run)
+		return gatt.StatusSuccess
+	})
+
+	bm.ProvisioningCharacteristics(s)
+
 	return s
 }
+
+//	HandleFramedWrite calls f with each complete message written to c
+//	Chunks are acknowledged as they arrive; a malformed message is refused on
+//	the write that completes or breaks it
+func (bm *BluetoothManager) HandleFramedWrite(c *gatt.Characteristic, f func(r gatt.Request, data []byte) (status byte)) {
+	c.HandleWriteFunc(func(r gatt.Request, chunk []byte) (status byte) {
+		data, err := bm.frames.Push(r.Central.ID(), c.UUID().String(), chunk)
+		if err != nil {
+			bm.Logger.Printf("reading frame from %s on %s: %v\n", r.Central.ID(), c.UUID(), err)
+			return gatt.StatusUnexpectedError
+		}
+		if data == nil {
+			return gatt.StatusSuccess
+		}
+		return f(r, data)
+	})
+}
+
+//	Notify sends v as JSON in a single message, in chunks as large as the
+//	MTU of the central allows
+func (bm *BluetoothManager) Notify(notifier gatt.Notifier, v interface{}) error {
+	source, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteFrames(notifier, notifier.Cap(), source)
+}
@@ -1,6 +0,0 @@
-#ifndef _INFRARED_H
-#define _INFRARED_H
-
-int send(const char *pin, const char *signal);
-
-#endif
\ No newline at end of file
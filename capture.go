@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"time"
+
+	rpio "github.com/stianeikeland/go-rpio"
+)
+
+const (
+	//Pino de entrada do receptor TSOP48xx (antigo IR_PIN de c/irreceive.c)
+	DefaultIRReceivePin = 25
+	//Tempo máximo aguardando o início de um sinal, em Receive
+	DefaultIRReceiveTimeout = 10 * time.Second
+	//Silêncio, em microssegundos, que encerra a captura de um quadro
+	CaptureEndGap = 15000
+	//Número máximo de transições por captura
+	CaptureMaxTimings = 500
+	//Duração máxima de um quadro; um receptor travado em marca ou ruído contínuo não prendem a captura
+	CaptureMaxFrame = time.Second
+	//Intervalo entre consultas ao registrador de bordas enquanto não há sinal
+	CaptureIdlePoll = 250 * time.Microsecond
+)
+
+var (
+	ErrCaptureTimeout = errors.New("timed out waiting for infrared signal")
+	ErrCaptureNoise   = errors.New("infrared frame did not end")
+)
+
+//	IRReceiver captures one infrared frame as alternating mark and space
+//	durations in microseconds, starting with a mark
+type IRReceiver interface {
+	Capture(ctx context.Context) (timings []int, err error)
+}
+
+//	GPIOReceiver captures frames from a demodulating receiver on a GPIO pin
+//	While idle it sleeps between checks of the edge detection register; once
+//	a mark starts it polls the pin level until the frame ends
+//	It waits for a frame until ctx is done
+type GPIOReceiver struct {
+	Pin int
+	//Os receptores TSOP48xx mantêm a saída em nível baixo durante a portadora
+	ActiveHigh bool
+}
+
+func NewGPIOReceiver(pin int) *GPIOReceiver {
+	return &GPIOReceiver{
+		Pin: pin,
+	}
+}
+
+func (g *GPIOReceiver) Capture(ctx context.Context) (timings []int, err error) {
+	if err := openGPIO(); err != nil {
+		return nil, err
+	}
+	defer closeGPIO()
+
+	pin := rpio.Pin(g.Pin)
+	pin.Input()
+	pin.PullUp()
+	mark, start := rpio.Low, rpio.FallEdge
+	if g.ActiveHigh {
+		mark, start = rpio.High, rpio.RiseEdge
+	}
+
+	//Aguarda o início da primeira marca; a borda fica registrada enquanto a goroutine dorme
+	pin.Detect(start)
+	defer pin.Detect(rpio.NoEdge)
+	idle := time.NewTicker(CaptureIdlePoll)
+	defer idle.Stop()
+	for !pin.EdgeDetected() {
+		select {
+		case <-ctx.Done():
+			return nil, captureError(ctx)
+		case <-idle.C:
+		}
+	}
+	//A borda ocorreu em algum momento do último intervalo
+	edge := time.Now().Add(-CaptureIdlePoll / 2)
+
+	//Evita que o agendador troque a thread durante a medição
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return captureFrame(ctx, edge, func() (bool, time.Time) {
+		return pin.Read() == mark, time.Now()
+	})
+}
+
+//	captureFrame measures a frame that started with a mark at edge, from
+//	samples of the receiver level taken as fast as possible
+//	The frame ends after CaptureEndGap of space or CaptureMaxTimings
+//	transitions; a frame longer than CaptureMaxFrame is noise
+func captureFrame(ctx context.Context, edge time.Time, sample func() (mark bool, now time.Time)) (timings []int, err error) {
+	deadline := edge.Add(CaptureMaxFrame)
+	timings = make([]int, 0, CaptureMaxTimings)
+	level := true
+	for polls := 1; len(timings) < CaptureMaxTimings; polls++ {
+		current, now := sample()
+		if polls%1000 == 0 {
+			if ctx.Err() != nil {
+				return nil, captureError(ctx)
+			}
+			if now.After(deadline) {
+				return nil, ErrCaptureNoise
+			}
+		}
+		elapsed := int(now.Sub(edge) / time.Microsecond)
+		if current == level {
+			if !level && elapsed > CaptureEndGap {
+				break
+			}
+			continue
+		}
+		timings = append(timings, elapsed)
+		level = current
+		edge = now
+	}
+	return timings, nil
+}
+
+func captureError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrCaptureTimeout
+	}
+	return ctx.Err()
+}
+
+//	TimingReceiver hands out previously captured timing streams, one per
+//	Capture call, in place of the GPIO pin
+type TimingReceiver struct {
+	Frames chan []int
+}
+
+func NewTimingReceiver(frames ...[]int) *TimingReceiver {
+	t := &TimingReceiver{
+		Frames: make(chan []int, len(frames)),
+	}
+	for _, frame := range frames {
+		t.Frames <- frame
+	}
+	return t
+}
+
+func (t *TimingReceiver) Capture(ctx context.Context) (timings []int, err error) {
+	select {
+	case timings = <-t.Frames:
+		return timings, nil
+	case <-ctx.Done():
+		return nil, captureError(ctx)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+//	levelSampler samples the level of a receiver seeing timings, starting
+//	with a mark at start, advancing the clock by step on every sample
+func levelSampler(timings []int, step time.Duration, start time.Time) func() (bool, time.Time) {
+	now := start
+	return func() (bool, time.Time) {
+		now = now.Add(step)
+		elapsed := int(now.Sub(start) / time.Microsecond)
+		for k, micros := range timings {
+			if elapsed < micros {
+				return k%2 == 0, now
+			}
+			elapsed -= micros
+		}
+		return false, now
+	}
+}
+
+func TestCaptureFrame(t *testing.T) {
+	code := NECCode(0x04, 0x08)
+	frame, err := Encode(ProtocolNEC, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	timings, err := captureFrame(context.Background(), start, levelSampler(frame, 5*time.Microsecond, start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//A captura termina no silêncio depois da última marca, sem incluí-lo
+	checkTimings(t, timings, frame, 10)
+	if decoded := Decode(timings); decoded.Protocol != ProtocolNEC || decoded.Code != code {
+		t.Errorf("captured frame decoded as %s", decoded)
+	}
+
+	//Um segundo quadro separado por menos que o silêncio final faz parte da captura
+	repeated := append(append(append([]int(nil), frame...), CaptureEndGap/2), frame...)
+	timings, err = captureFrame(context.Background(), start, levelSampler(repeated, 5*time.Microsecond, start))
+	if err != nil || len(timings) != len(repeated) {
+		t.Errorf("frames %d µs apart: %d timings, %v; want %d", CaptureEndGap/2, len(timings), err, len(repeated))
+	}
+	separated := append(append(append([]int(nil), frame...), CaptureEndGap*2), frame...)
+	timings, err = captureFrame(context.Background(), start, levelSampler(separated, 5*time.Microsecond, start))
+	if err != nil || len(timings) != len(frame) {
+		t.Errorf("frames %d µs apart: %d timings, %v; want %d", CaptureEndGap*2, len(timings), err, len(frame))
+	}
+}
+
+func TestCaptureFrameBounds(t *testing.T) {
+	start := time.Now()
+	//Receptor preso em marca
+	stuck := []int{int(2 * CaptureMaxFrame / time.Microsecond)}
+	if _, err := captureFrame(context.Background(), start, levelSampler(stuck, 10*time.Microsecond, start)); err != ErrCaptureNoise {
+		t.Errorf("stuck mark: %v, want ErrCaptureNoise", err)
+	}
+
+	noise := make([]int, 2*CaptureMaxTimings)
+	for k := range noise {
+		noise[k] = 100
+	}
+	timings, err := captureFrame(context.Background(), start, levelSampler(noise, 10*time.Microsecond, start))
+	if err != nil || len(timings) != CaptureMaxTimings {
+		t.Errorf("continuous noise: %d timings, %v; want %d", len(timings), err, CaptureMaxTimings)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := captureFrame(ctx, start, levelSampler(stuck, 10*time.Microsecond, start)); err != context.Canceled {
+		t.Errorf("cancelled during a frame: %v, want context.Canceled", err)
+	}
+	ctx, cancel = context.WithDeadline(context.Background(), start)
+	defer cancel()
+	if _, err := captureFrame(ctx, start, levelSampler(stuck, 10*time.Microsecond, start)); err != ErrCaptureTimeout {
+		t.Errorf("deadline during a frame: %v, want ErrCaptureTimeout", err)
+	}
+}
+
+func TestTimingReceiver(t *testing.T) {
+	receiver := NewTimingReceiver([]int{1}, []int{2})
+	for _, want := range []int{1, 2} {
+		if timings, err := receiver.Capture(context.Background()); err != nil || len(timings) != 1 || timings[0] != want {
+			t.Errorf("captured %v, %v; want [%d]", timings, err, want)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := receiver.Capture(ctx); err != ErrCaptureTimeout {
+		t.Errorf("capture without frames: %v, want ErrCaptureTimeout", err)
+	}
+}
+
+//	TestReceiveTimeout checks that ReceiveTimeout bounds Receive with and
+//	without the background listener
+func TestReceiveTimeout(t *testing.T) {
+	i, _ := testInfraredManager(t)
+	i.ReceiveTimeout = 20 * time.Millisecond
+	if _, err := i.Receive(context.Background()); err != ErrCaptureTimeout {
+		t.Errorf("receive: %v, want ErrCaptureTimeout", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		i.Listen(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	waitFor(t, "the listener", func() bool {
+		i.subscribersLock.Lock()
+		defer i.subscribersLock.Unlock()
+		return i.listening
+	})
+	started := time.Now()
+	if _, err := i.Receive(context.Background()); err != ErrCaptureTimeout {
+		t.Errorf("receive while listening: %v, want ErrCaptureTimeout", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("receive while listening took %s", elapsed)
+	}
+}
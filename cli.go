@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+//	runCommand runs the maintenance command in args instead of the server
+//	and returns the exit status
+func runCommand(args []string) int {
+	switch args[0] {
+	case "migrations":
+		return migrationsCommand(args[1:])
+	case "backup":
+		return backupCommand(args[1:])
+	case "restore":
+		return restoreCommand(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+	fmt.Fprintf(os.Stderr, "commands: migrations, backup, restore\n")
+	return 2
+}
+
+//	migrationsCommand lists the migrations and their state, applying the
+//	pending ones with -apply or trying them with -dry-run
+func migrationsCommand(args []string) int {
+	flags := flag.NewFlagSet("migrations", flag.ContinueOnError)
+	apply := flags.Bool("apply", false, "apply pending migrations")
+	dryRun := flags.Bool("dry-run", false, "run pending migrations in a transaction that is rolled back")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	databaseManager := NewDatabaseManager()
+	if err := databaseManager.Connect("log/database", "DATABASE"); err != nil {
+		fmt.Fprintf(os.Stderr, "connecting to database: %v\n", err)
+		return 1
+	}
+	defer databaseManager.Close()
+
+	pending, err := databaseManager.PendingMigrations()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading migrations: %v\n", err)
+		return 1
+	}
+	isPending := make(map[int]bool)
+	for _, migration := range pending {
+		isPending[migration.Version] = true
+	}
+	for _, migration := range Migrations {
+		state := "applied"
+		if isPending[migration.Version] {
+			state = "pending"
+		}
+		fmt.Printf("%4d  %-20s %s\n", migration.Version, migration.Name, state)
+	}
+	if !*apply && !*dryRun {
+		return 0
+	}
+
+	applied, err := databaseManager.Migrate(*dryRun)
+	for _, migration := range applied {
+		if *dryRun {
+			fmt.Printf("would apply %d (%s)\n", migration.Version, migration.Name)
+		} else {
+			fmt.Printf("applied %d (%s)\n", migration.Version, migration.Name)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrating: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+//	backupCommand writes the configuration archive to -o, or to the standard
+//	output; secrets are included with -secrets, sealed with BACKUP_PASSPHRASE
+func backupCommand(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := flags.String("o", "", "archive file, standard output when empty")
+	secrets := flags.Bool("secrets", false, "include info and customer, sealed with "+ConfigBackupPassphrase)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	passphrase := ""
+	if *secrets {
+		if passphrase = os.Getenv(ConfigBackupPassphrase); passphrase == "" {
+			fmt.Fprintf(os.Stderr, "-secrets needs %s\n", ConfigBackupPassphrase)
+			return 2
+		}
+	}
+
+	databaseManager := NewDatabaseManager()
+	if err := databaseManager.Connect("log/database", "DATABASE"); err != nil {
+		fmt.Fprintf(os.Stderr, "connecting to database: %v\n", err)
+		return 1
+	}
+	defer databaseManager.Close()
+
+	backup, err := ExportBackup(databaseManager, passphrase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "exporting backup: %v\n", err)
+		return 1
+	}
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "creating archive: %v\n", err)
+			return 1
+		}
+		defer out.Close()
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(backup); err != nil {
+		fmt.Fprintf(os.Stderr, "writing archive: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+//	restoreCommand restores an archive into an empty device; -dry-run only
+//	validates it and prints what would be written
+func restoreCommand(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "validate and roll back instead of writing")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: restore [-dry-run] archive.json\n")
+		return 2
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening archive: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	var backup Backup
+	if err := json.NewDecoder(f).Decode(&backup); err != nil {
+		fmt.Fprintf(os.Stderr, "reading archive: %v\n", err)
+		return 1
+	}
+
+	databaseManager := NewDatabaseManager()
+	if err := databaseManager.Initialize("log/database", "DATABASE"); err != nil {
+		fmt.Fprintf(os.Stderr, "connecting to database: %v\n", err)
+		return 1
+	}
+	defer databaseManager.Close()
+
+	report, err := databaseManager.Restore(backup, os.Getenv(ConfigBackupPassphrase), *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restoring: %v\n", err)
+		return 1
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	return 0
+}
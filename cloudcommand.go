@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	CloudActionRelay    = "relay"
+	CloudActionInfrared = "infrared"
+	CloudActionMacro    = "macro"
+	CloudActionConfig   = "config"
+
+	CloudMessageCommand = "command"
+	CloudMessageAck     = "ack"
+	CloudMessageResult  = "result"
+
+	//Tolerância para relógios fora de sincronia
+	CloudCommandClockSkew = 30 * time.Second
+	//Validade máxima aceita, que também limita quanto tempo os IDs são lembrados
+	CloudCommandMaxLifetime = 10 * time.Minute
+
+	//IDs recebidos, guardados até expirarem para que um reinício não
+	//permita repetir um comando
+	DefaultCloudCommandSeenFile = "data/commands.jsonl"
+	ConfigCloudCommandSeenFile  = "CLOUD_COMMAND_SEEN_FILE"
+)
+
+var (
+	ErrCloudCommandDisabled  = errors.New("cloud commands disabled: device secret not enrolled")
+	ErrCloudCommandSignature = errors.New("invalid signature")
+	ErrCloudCommandExpired   = errors.New("command expired")
+	ErrCloudCommandLifetime  = errors.New("command expiry too far in the future")
+	ErrCloudCommandAction    = errors.New("unknown action")
+	ErrCloudCommandReplayed  = errors.New("command already received before a restart")
+)
+
+//	Responsibilities:
+//	*	To run commands sent by the cloud through the telemetry connection
+//	CloudCommandManager
+type CloudCommandManager struct {
+	LogFile *os.File
+	Logger  *log.Logger
+
+	Repository
+	RelayManager    *RelayManager
+	InfraredManager *InfraredManager
+	MacroManager    *MacroManager
+
+	results     map[string]*cloudCommandResult
+	resultsLock sync.Mutex
+	//Arquivo dos IDs recebidos, nil quando não são guardados
+	seen *os.File
+}
+
+//	CloudCommand is signed with the device credential (see DeviceCredential)
+//	as the hex HMAC-SHA256 of "<id>\n<action>\n<expires unix>\n<data>"
+type CloudCommand struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`
+	Action    string          `json:"action"`
+	Expires   time.Time       `json:"expires"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Signature string          `json:"signature"`
+}
+
+//	CloudReply is an ack, sent as soon as a command is accepted or refused,
+//	or the result of running it
+type CloudReply struct {
+	Type   string      `json:"type"`
+	ID     string      `json:"id"`
+	OK     bool        `json:"ok"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type CloudRelayData struct {
+	RelayID int    `json:"relay_id"`
+	Command string `json:"command"`
+}
+
+type CloudInfraredData struct {
+	InfraredID int `json:"infrared_id"`
+	Button     int `json:"button"`
+}
+
+type CloudMacroData struct {
+	MacroID int `json:"macro_id"`
+}
+
+//	cloudCommandResult is kept until the command expires, so that a command
+//	sent again, after a reconnection, is answered instead of run twice
+type cloudCommandResult struct {
+	expires time.Time
+	reply   *CloudReply
+}
+
+//	cloudCommandSeen is a line of the file of received IDs
+type cloudCommandSeen struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+func NewCloudCommandManager() *CloudCommandManager {
+	return &CloudCommandManager{
+		results: make(map[string]*cloudCommandResult),
+	}
+}
+
+func (cm *CloudCommandManager) Initialize(logPath string, repository Repository, relayManager *RelayManager, infraredManager *InfraredManager, macroManager *MacroManager) error {
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	cm.LogFile = f
+	cm.Logger = log.New(cm.LogFile, "", log.Ldate|log.Ltime)
+	cm.Repository = repository
+	cm.RelayManager = relayManager
+	cm.InfraredManager = infraredManager
+	cm.MacroManager = macroManager
+	if err := cm.LoadSeen(envString(ConfigCloudCommandSeenFile, DefaultCloudCommandSeenFile), time.Now()); err != nil {
+		return err
+	}
+	cm.Logger.Printf("CloudCommandManager started.\n")
+	return nil
+}
+
+func (cm *CloudCommandManager) Close() {
+	if cm.seen != nil {
+		cm.seen.Close()
+	}
+	cm.Logger.Printf("CloudCommandManager closed.\n")
+	cm.LogFile.Close()
+}
+
+//	LoadSeen reads the IDs received by a previous run that have not expired,
+//	which are refused from now on, and keeps recording new IDs in path
+func (cm *CloudCommandManager) LoadSeen(path string, now time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var seen cloudCommandSeen
+			if err := json.Unmarshal(scanner.Bytes(), &seen); err != nil || now.After(seen.Expires.Add(CloudCommandClockSkew)) {
+				continue
+			}
+			cm.results[seen.ID] = &cloudCommandResult{
+				expires: seen.Expires,
+				reply:   &CloudReply{Type: CloudMessageResult, ID: seen.ID, Error: ErrCloudCommandReplayed.Error()},
+			}
+		}
+		f.Close()
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	cm.resultsLock.Lock()
+	defer cm.resultsLock.Unlock()
+	cm.seen = f
+	return cm.rewriteSeen()
+}
+
+//	rememberSeen appends id to the file before the command runs
+func (cm *CloudCommandManager) rememberSeen(id string, expires time.Time) error {
+	if cm.seen == nil {
+		return nil
+	}
+	line, err := json.Marshal(cloudCommandSeen{ID: id, Expires: expires})
+	if err != nil {
+		return err
+	}
+	if _, err := cm.seen.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return cm.seen.Sync()
+}
+
+//	rewriteSeen replaces the file with the IDs in memory, through a temporary
+//	file like TelemetryQueue; it is called holding resultsLock
+func (cm *CloudCommandManager) rewriteSeen() error {
+	if cm.seen == nil {
+		return nil
+	}
+	path := cm.seen.Name()
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for id, result := range cm.results {
+		if err := encoder.Encode(cloudCommandSeen{ID: id, Expires: result.expires}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	cm.seen.Close()
+	cm.seen, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+//	Handle runs message if it is a command, answering through reply, and
+//	returns false for any other message
+//	The command runs in its own goroutine, so reply must be safe to call
+//	concurrently with the other writes to the connection
+func (cm *CloudCommandManager) Handle(message []byte, reply func(CloudReply) error) bool {
+	var command CloudCommand
+	if err := json.Unmarshal(message, &command); err != nil || command.Type != CloudMessageCommand {
+		return false
+	}
+	send := func(r CloudReply) {
+		if err := reply(r); err != nil {
+			cm.Logger.Printf("replying to command %s: %v\n", command.ID, err)
+		}
+	}
+	if err := cm.Verify(command, time.Now()); err != nil {
+		cm.Logger.Printf("refusing command %s (%s): %v\n", command.ID, command.Action, err)
+		send(CloudReply{Type: CloudMessageAck, ID: command.ID, Error: err.Error()})
+		return true
+	}
+
+	cm.resultsLock.Lock()
+	now := time.Now()
+	expired := 0
+	for id, result := range cm.results {
+		if now.After(result.expires.Add(CloudCommandClockSkew)) {
+			delete(cm.results, id)
+			expired++
+		}
+	}
+	var err error
+	if expired > 0 {
+		err = cm.rewriteSeen()
+	}
+	result, seen := cm.results[command.ID]
+	if !seen && err == nil {
+		//Gravado antes de rodar: sem o registro, o comando poderia ser
+		//repetido depois de um reinício
+		if err = cm.rememberSeen(command.ID, command.Expires); err == nil {
+			cm.results[command.ID] = &cloudCommandResult{expires: command.Expires}
+		}
+	}
+	var previous *CloudReply
+	if seen {
+		previous = result.reply
+	}
+	cm.resultsLock.Unlock()
+	if err != nil && !seen {
+		cm.Logger.Printf("recording command %s: %v\n", command.ID, err)
+		send(CloudReply{Type: CloudMessageAck, ID: command.ID, Error: "recording command: " + err.Error()})
+		return true
+	}
+
+	send(CloudReply{Type: CloudMessageAck, ID: command.ID, OK: true})
+	if seen {
+		//Ainda em execução, o resultado será enviado quando terminar
+		if previous != nil {
+			send(*previous)
+		}
+		return true
+	}
+	go func() {
+		cm.Logger.Printf("running command %s (%s).\n", command.ID, command.Action)
+		r := CloudReply{Type: CloudMessageResult, ID: command.ID, OK: true}
+		value, err := cm.Run(command)
+		if err != nil {
+			cm.Logger.Printf("running command %s (%s): %v\n", command.ID, command.Action, err)
+			r.OK = false
+			r.Error = err.Error()
+		} else {
+			r.Result = value
+		}
+		cm.resultsLock.Lock()
+		if result, ok := cm.results[command.ID]; ok {
+			result.reply = &r
+		}
+		cm.resultsLock.Unlock()
+		send(r)
+	}()
+	return true
+}
+
+//	Verify checks the signature and expiry of command
+func (cm *CloudCommandManager) Verify(command CloudCommand, now time.Time) error {
+	info, err := cm.Repository.ReadInfo()
+	if err != nil {
+		return err
+	}
+	credential := DeviceCredential(info)
+	if credential == nil || !info.Enrolled {
+		return ErrCloudCommandDisabled
+	}
+	signature, err := hex.DecodeString(command.Signature)
+	if err != nil || !hmac.Equal(signature, command.Sign(credential)) {
+		return ErrCloudCommandSignature
+	}
+	if now.After(command.Expires.Add(CloudCommandClockSkew)) {
+		return ErrCloudCommandExpired
+	}
+	if command.Expires.After(now.Add(CloudCommandMaxLifetime + CloudCommandClockSkew)) {
+		return ErrCloudCommandLifetime
+	}
+	return nil
+}
+
+//	Sign returns the HMAC-SHA256 of command under credential
+func (command CloudCommand) Sign(credential []byte) []byte {
+	mac := hmac.New(sha256.New, credential)
+	mac.Write([]byte(command.ID + "\n" + command.Action + "\n" + strconv.FormatInt(command.Expires.Unix(), 10) + "\n"))
+	mac.Write(command.Data)
+	return mac.Sum(nil)
+}
+
+//	Run executes command, returning what is sent back as its result
+func (cm *CloudCommandManager) Run(command CloudCommand) (interface{}, error) {
+	switch command.Action {
+	case CloudActionRelay:
+		var data CloudRelayData
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, err
+		}
+		if data.Command != CommandToggle && data.Command != CommandOn && data.Command != CommandOff {
+			return nil, fmt.Errorf("relay command %q", data.Command)
+		}
+		relay, err := cm.Repository.ReadRelayByID(data.RelayID)
+		if err != nil {
+			return nil, err
+		}
+		cm.RelayManager.Operate(relay, data.Command)
+		return nil, nil
+	case CloudActionInfrared:
+		var data CloudInfraredData
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, err
+		}
+		device, err := cm.Repository.ReadInfraredByID(data.InfraredID)
+		if err != nil {
+			return nil, err
+		}
+		irCommand, err := cm.Repository.ReadCommand(data.InfraredID, data.Button)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), TransmitWait)
+		defer cancel()
+		return nil, cm.InfraredManager.SendCommand(ctx, device, irCommand)
+	case CloudActionMacro:
+		var data CloudMacroData
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, err
+		}
+		return cm.MacroManager.Start(data.MacroID)
+	case CloudActionConfig:
+		//Sem segredos: a configuração exportada como num backup sem senha
+		return ExportBackup(cm.Repository, "")
+	}
+	return nil, fmt.Errorf("%v: %q", ErrCloudCommandAction, command.Action)
+}
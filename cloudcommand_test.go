@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const cloudTestSecret = "00112233445566778899aabbccddeeff"
+
+//	cloudRepository adds the device info to the infrared fakes
+type cloudRepository struct {
+	*infraredRepository
+	info Info
+}
+
+func (r *cloudRepository) ReadInfo() (Info, error) {
+	return r.info, nil
+}
+
+func testCloudCommandManager(t *testing.T) (*CloudCommandManager, *RecordingTransmitter) {
+	t.Helper()
+	i, transmitter := testInfraredManager(t)
+	repository := &cloudRepository{
+		infraredRepository: newInfraredRepository(Infrared{ID: 1, Name: "tv", Pin: 17}),
+		info:               Info{Secret: cloudTestSecret, Enrolled: true},
+	}
+	repository.WriteCommand(Command{InfraredID: 1, Button: 1, Protocol: ProtocolNEC, Code: NECCode(0x01, 0x01)})
+	i.Repository = repository
+	cm := NewCloudCommandManager()
+	cm.Logger = log.New(ioutil.Discard, "", 0)
+	cm.Repository = repository
+	cm.InfraredManager = i
+	return cm, transmitter
+}
+
+//	signedCommand presses the tv button, signed with secret
+func signedCommand(id string, expires time.Time, secret string) CloudCommand {
+	command := CloudCommand{
+		Type:    CloudMessageCommand,
+		ID:      id,
+		Action:  CloudActionInfrared,
+		Expires: expires,
+		Data:    json.RawMessage(`{"infrared_id":1,"button":1}`),
+	}
+	credential, _ := hex.DecodeString(secret)
+	command.Signature = hex.EncodeToString(command.Sign(credential))
+	return command
+}
+
+func TestCloudCommandVerify(t *testing.T) {
+	now := time.Now()
+	valid := signedCommand("a", now.Add(time.Minute), cloudTestSecret)
+	tests := []struct {
+		name    string
+		command func() CloudCommand
+		info    Info
+		err     error
+	}{
+		{"valid", func() CloudCommand { return valid }, Info{}, nil},
+		{"missing signature", func() CloudCommand {
+			c := valid
+			c.Signature = ""
+			return c
+		}, Info{}, ErrCloudCommandSignature},
+		{"malformed signature", func() CloudCommand {
+			c := valid
+			c.Signature = "zz" + c.Signature[2:]
+			return c
+		}, Info{}, ErrCloudCommandSignature},
+		{"another secret", func() CloudCommand {
+			return signedCommand("a", now.Add(time.Minute), "ffeeddccbbaa99887766554433221100")
+		}, Info{}, ErrCloudCommandSignature},
+		{"data tampered", func() CloudCommand {
+			c := valid
+			c.Data = json.RawMessage(`{"infrared_id":1,"button":2}`)
+			return c
+		}, Info{}, ErrCloudCommandSignature},
+		{"expired within skew", func() CloudCommand {
+			return signedCommand("a", now.Add(-CloudCommandClockSkew+time.Second), cloudTestSecret)
+		}, Info{}, nil},
+		{"expired", func() CloudCommand {
+			return signedCommand("a", now.Add(-CloudCommandClockSkew-time.Second), cloudTestSecret)
+		}, Info{}, ErrCloudCommandExpired},
+		{"lifetime within skew", func() CloudCommand {
+			return signedCommand("a", now.Add(CloudCommandMaxLifetime+CloudCommandClockSkew-time.Second), cloudTestSecret)
+		}, Info{}, nil},
+		{"lifetime too long", func() CloudCommand {
+			return signedCommand("a", now.Add(CloudCommandMaxLifetime+CloudCommandClockSkew+time.Second), cloudTestSecret)
+		}, Info{}, ErrCloudCommandLifetime},
+		{"not enrolled", func() CloudCommand { return valid }, Info{Secret: cloudTestSecret}, ErrCloudCommandDisabled},
+		{"no secret", func() CloudCommand { return valid }, Info{Enrolled: true}, ErrCloudCommandDisabled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cm, _ := testCloudCommandManager(t)
+			if test.info != (Info{}) {
+				cm.Repository.(*cloudRepository).info = test.info
+			}
+			if err := cm.Verify(test.command(), now); err != test.err {
+				t.Errorf("Verify = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+//	handle sends command to cm and collects the replies until want arrive
+func handle(t *testing.T, cm *CloudCommandManager, command CloudCommand, want int) []CloudReply {
+	t.Helper()
+	message, err := json.Marshal(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies := make(chan CloudReply, 4)
+	if !cm.Handle(message, func(r CloudReply) error {
+		replies <- r
+		return nil
+	}) {
+		t.Fatalf("command %s not handled", command.ID)
+	}
+	var received []CloudReply
+	for len(received) < want {
+		select {
+		case r := <-replies:
+			received = append(received, r)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("command %s: %d replies, want %d", command.ID, len(received), want)
+		}
+	}
+	select {
+	case r := <-replies:
+		t.Fatalf("command %s: unexpected reply %+v", command.ID, r)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return received
+}
+
+func TestCloudCommandHandle(t *testing.T) {
+	cm, transmitter := testCloudCommandManager(t)
+	command := signedCommand("a", time.Now().Add(time.Minute), cloudTestSecret)
+
+	replies := handle(t, cm, command, 2)
+	if replies[0].Type != CloudMessageAck || !replies[0].OK {
+		t.Errorf("first ack %+v", replies[0])
+	}
+	if replies[1].Type != CloudMessageResult || !replies[1].OK {
+		t.Errorf("first result %+v", replies[1])
+	}
+
+	//Repetido, recebe o mesmo resultado sem rodar de novo
+	again := handle(t, cm, command, 2)
+	if again[0].Type != CloudMessageAck || !again[0].OK || again[1] != replies[1] {
+		t.Errorf("repeated command answered %+v, want an ack and %+v", again, replies[1])
+	}
+	if frames := len(transmitter.Frames()); frames != 1 {
+		t.Errorf("%d frames sent, want 1", frames)
+	}
+
+	forged := signedCommand("b", time.Now().Add(time.Minute), "ffeeddccbbaa99887766554433221100")
+	refused := handle(t, cm, forged, 1)
+	if refused[0].Type != CloudMessageAck || refused[0].OK || refused[0].Error != ErrCloudCommandSignature.Error() {
+		t.Errorf("forged command answered %+v", refused[0])
+	}
+
+	if cm.Handle([]byte(`{"type":"ping"}`), func(CloudReply) error { return nil }) {
+		t.Error("a message that is not a command was handled")
+	}
+}
+
+func TestCloudCommandRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data", "commands.jsonl")
+
+	cm, _ := testCloudCommandManager(t)
+	if err := cm.LoadSeen(path, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	command := signedCommand("a", time.Now().Add(time.Minute), cloudTestSecret)
+	handle(t, cm, command, 2)
+	cm.seen.Close()
+
+	//Um ID já vencido no arquivo não sobrevive ao reinício
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewEncoder(f).Encode(cloudCommandSeen{ID: "old", Expires: time.Now().Add(-time.Hour)})
+	f.Close()
+
+	restarted, transmitter := testCloudCommandManager(t)
+	if err := restarted.LoadSeen(path, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.seen.Close()
+	replies := handle(t, restarted, command, 2)
+	if replies[0].Type != CloudMessageAck || !replies[0].OK {
+		t.Errorf("replayed ack %+v", replies[0])
+	}
+	if replies[1].Type != CloudMessageResult || replies[1].OK || replies[1].Error != ErrCloudCommandReplayed.Error() {
+		t.Errorf("replayed result %+v, want %v", replies[1], ErrCloudCommandReplayed)
+	}
+	if frames := len(transmitter.Frames()); frames != 0 {
+		t.Errorf("replayed command sent %d frames", frames)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), `"id":"a"`) || strings.Contains(string(contents), `"id":"old"`) {
+		t.Errorf("seen file after restart:\n%s", contents)
+	}
+}
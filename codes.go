@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	CodeFormatLirc   = "lirc"
+	CodeFormatPronto = "pronto"
+)
+
+//	ProntoCode is one command of a device in Pronto hex
+type ProntoCode struct {
+	Name   string `json:"name"`
+	Button int    `json:"button"`
+	Pronto string `json:"pronto"`
+}
+
+//	ProntoDevice is the body of a Pronto import and the result of a Pronto export
+type ProntoDevice struct {
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	Pin      int          `json:"pin"`
+	Commands []ProntoCode `json:"commands"`
+}
+
+//	importCommand decodes timings into a Command, keeping them raw when no protocol matches
+func importCommand(name string, button, frequency int, timings []int) Command {
+	decoded := DecodeFrame(timings)
+	command := Command{
+		Name:     name,
+		Protocol: decoded.Protocol,
+		Code:     decoded.Code,
+		Button:   button,
+	}
+	if decoded.Protocol == ProtocolRaw {
+		command.Timings = FormatTimings(timings)
+	}
+	//O Pronto só representa a frequência aproximadamente
+	if def := ProtocolFrequency[decoded.Protocol]; frequency > 0 && math.Abs(float64(frequency-def)) > 0.02*float64(def) {
+		command.Frequency = frequency
+	}
+	return command
+}
+
+//	commandFrequency returns the carrier frequency a command is sent with
+func commandFrequency(command Command) int {
+	if command.Frequency > 0 {
+		return command.Frequency
+	}
+	return ProtocolFrequency[command.Protocol]
+}
+
+//	ImportLirc converts every remote of a lircd.conf into an Infrared device
+//	Buttons are numbered in the order the codes appear
+func ImportLirc(remotes []LircRemote, deviceType string, pin int) (devices []Infrared, err error) {
+	for _, remote := range remotes {
+		device := Infrared{
+			Name: remote.Name,
+			Type: deviceType,
+			Pin:  pin,
+		}
+		for k, code := range remote.Codes {
+			timings, err := remote.Timings(code)
+			if err != nil {
+				return nil, err
+			}
+			if len(timings) == 0 {
+				return nil, fmt.Errorf("lirc remote %s: code %s has no timings", remote.Name, code.Name)
+			}
+			device.Commands = append(device.Commands, importCommand(code.Name, k+1, remote.Frequency, timings))
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+//	ImportPronto converts a Pronto device into an Infrared device
+func ImportPronto(pronto ProntoDevice) (device Infrared, err error) {
+	device = Infrared{
+		Name: pronto.Name,
+		Type: pronto.Type,
+		Pin:  pronto.Pin,
+	}
+	for k, code := range pronto.Commands {
+		frequency, timings, err := ParsePronto(code.Pronto)
+		if err != nil {
+			return device, fmt.Errorf("command %s: %v", code.Name, err)
+		}
+		button := code.Button
+		if button == 0 {
+			button = k + 1
+		}
+		device.Commands = append(device.Commands, importCommand(code.Name, button, frequency, timings))
+	}
+	return device, nil
+}
+
+//	ExportLirc writes device as a lircd.conf remote
+//	Devices whose commands are all NEC or all Samsung are written with SPACE_ENC
+//	parameters, anything else as raw codes
+func ExportLirc(device Infrared) (remote LircRemote, err error) {
+	remote = LircRemote{
+		Name:      device.Name,
+		Frequency: 38000,
+		Gap:       108000,
+	}
+	protocol := ""
+	for k, command := range device.Commands {
+		if k == 0 {
+			protocol = command.Protocol
+		}
+		if command.Protocol != protocol || command.Frequency != 0 {
+			protocol = ""
+			break
+		}
+	}
+	timing, encoded := map[string]pulseDistance{ProtocolNEC: necTiming, ProtocolSamsung: samsungTiming}[protocol]
+	if encoded {
+		remote.Flags = []string{LircFlagSpaceEnc, "CONST_LENGTH"}
+		remote.Bits = timing.bits
+		remote.Header = [2]int{timing.headerMark, timing.headerSpace}
+		remote.One = [2]int{timing.bitMark, timing.oneSpace}
+		remote.Zero = [2]int{timing.bitMark, timing.zeroSpace}
+		remote.Ptrail = timing.bitMark
+		for _, command := range device.Commands {
+			remote.Codes = append(remote.Codes, LircCode{
+				Name: exportName(command),
+				Code: uint64(msbValue(command.Code)),
+			})
+		}
+		return remote, nil
+	}
+
+	remote.Flags = []string{LircFlagRawCodes}
+	remote.Gap = prontoTrailingGap
+	if len(device.Commands) > 0 {
+		//Um arquivo LIRC só tem uma frequência por controle
+		remote.Frequency = commandFrequency(device.Commands[0])
+	}
+	for _, command := range device.Commands {
+		timings, err := CommandTimings(command)
+		if err != nil {
+			return remote, fmt.Errorf("command %s: %v", exportName(command), err)
+		}
+		remote.Codes = append(remote.Codes, LircCode{
+			Name:    exportName(command),
+			Timings: timings,
+		})
+	}
+	return remote, nil
+}
+
+//	ExportPronto writes every command of device in Pronto hex
+func ExportPronto(device Infrared) (pronto ProntoDevice, err error) {
+	pronto = ProntoDevice{
+		Name:     device.Name,
+		Type:     device.Type,
+		Pin:      device.Pin,
+		Commands: make([]ProntoCode, 0, len(device.Commands)),
+	}
+	for _, command := range device.Commands {
+		timings, err := CommandTimings(command)
+		if err != nil {
+			return pronto, fmt.Errorf("command %s: %v", exportName(command), err)
+		}
+		pronto.Commands = append(pronto.Commands, ProntoCode{
+			Name:   command.Name,
+			Button: command.Button,
+			Pronto: FormatPronto(commandFrequency(command), timings),
+		})
+	}
+	return pronto, nil
+}
+
+func exportName(command Command) string {
+	if command.Name != "" {
+		return command.Name
+	}
+	return fmt.Sprintf("BUTTON_%d", command.Button)
+}
+
+func (i *InfraredManager) ImportLircHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	pin, _ := strconv.Atoi(r.URL.Query().Get("pin"))
+	remotes, err := ParseLirc(r.Body)
+	if err != nil {
+		i.Logger.Printf("importing lirc: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	devices, err := ImportLirc(remotes, r.URL.Query().Get("type"), pin)
+	if err != nil {
+		i.Logger.Printf("importing lirc: %v\n", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	for k := range devices {
+		if devices[k], err = i.Repository.CreateInfrared(devices[k]); err != nil {
+			writeError(w, i.Logger, "importing lirc", err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(devices)
+}
+
+func (i *InfraredManager) ImportProntoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	var pronto ProntoDevice
+	if err := json.NewDecoder(r.Body).Decode(&pronto); err != nil {
+		i.Logger.Printf("decoding pronto device: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	device, err := ImportPronto(pronto)
+	if err != nil {
+		i.Logger.Printf("importing pronto: %v\n", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	if device, err = i.Repository.CreateInfrared(device); err != nil {
+		writeError(w, i.Logger, "importing pronto", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(device)
+}
+
+func (i *InfraredManager) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	deviceID, _ := strconv.Atoi(mux.Vars(r)["device"])
+	device, err := i.Repository.ReadInfraredByID(deviceID)
+	if err != nil {
+		writeError(w, i.Logger, "exporting", err)
+		return
+	}
+	switch mux.Vars(r)["format"] {
+	case CodeFormatLirc:
+		remote, err := ExportLirc(device)
+		if err != nil {
+			i.Logger.Printf("exporting lirc: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		FormatLirc(w, remote)
+	case CodeFormatPronto:
+		pronto, err := ExportPronto(device)
+		if err != nil {
+			i.Logger.Printf("exporting pronto: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(pronto)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsePronto(t *testing.T) {
+	//NEC com endereço 0x04 e comando 0x08, portadora de 38 kHz
+	pronto := "0000 006D 0022 0000 0157 00AC 0016 0016 0016 0016 0016 0041 0016 0016 0016 0016 0016 0016 0016 0016 " +
+		"0016 0016 0016 0041 0016 0041 0016 0016 0016 0041 0016 0041 0016 0041 0016 0041 0016 0041 0016 0016 0016 0016 " +
+		"0016 0016 0016 0041 0016 0016 0016 0016 0016 0016 0016 0016 0016 0041 0016 0041 0016 0041 0016 0016 0016 0041 " +
+		"0016 0041 0016 0041 0016 0041 0016 05F7"
+	frequency, timings, err := ParsePronto(pronto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frequency < 37500 || frequency > 38500 {
+		t.Errorf("frequency %d, want about 38000", frequency)
+	}
+	checkDecoded(t, Decode(timings), Decoded{Protocol: ProtocolNEC, Address: 0x04, Command: 0x08, Bits: 32})
+}
+
+func TestParseProntoErrors(t *testing.T) {
+	tests := []struct{ name, pronto string }{
+		{"empty", ""},
+		{"short", "0000 006D 0000"},
+		{"no burst pairs", "0000 006D 0000 0000"},
+		{"not learned", "0100 006D 0001 0000 0010 0020"},
+		{"zero frequency", "0000 0000 0001 0000 0010 0020"},
+		{"count mismatch", "0000 006D 0002 0000 0010 0020"},
+		{"not hex", "0000 006D 0001 0000 0010 00G0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ParsePronto(tt.pronto); err == nil {
+				t.Errorf("ParsePronto(%q) succeeded", tt.pronto)
+			}
+		})
+	}
+}
+
+func TestProntoRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		frequency int
+		timings   []int
+	}{
+		{"nec capture", 38000, DecodeAll(fixture(t, "doc/remote.md", "Power On"))[0].Timings},
+		{"rc5", 36000, rc5Timings(5, 35, true)},
+		{"sirc", 40000, sircTimings(21, 1, 12)},
+		{"raw", 38000, []int{3000, 1500, 400, 1200, 400, 400, 800}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frequency, timings, err := ParsePronto(FormatPronto(tt.frequency, tt.timings))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(float64(frequency-tt.frequency)) > 0.02*float64(tt.frequency) {
+				t.Errorf("frequency %d, want %d", frequency, tt.frequency)
+			}
+			checkTimings(t, timings, tt.timings, 1000000/tt.frequency)
+			want := Decode(tt.timings)
+			if got := Decode(timings); got.Protocol != want.Protocol || got.Code != want.Code {
+				t.Errorf("decoded %s %q, want %s %q", got.Protocol, got.Code, want.Protocol, want.Code)
+			}
+		})
+	}
+}
+
+func TestParseLirc(t *testing.T) {
+	conf := `
+# Configuração gerada pelo irrecord
+begin remote
+  name  tv
+  bits           16
+  flags SPACE_ENC|CONST_LENGTH
+  eps            30
+  aeps          100
+  header       9000  4500
+  one           562  1687
+  zero          562   562
+  ptrail        562
+  pre_data_bits   16
+  pre_data       0x20DF
+  gap          108000
+  frequency    38000
+      begin codes
+          KEY_POWER                0x10EF
+          KEY_MUTE                 0x906F   # mudo
+      end codes
+end remote
+`
+	remotes, err := ParseLirc(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remotes) != 1 || len(remotes[0].Codes) != 2 {
+		t.Fatalf("parsed %+v", remotes)
+	}
+	devices, err := ImportLirc(remotes, TypeTV, 17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	power := devices[0].Commands[0]
+	if power.Name != "KEY_POWER" || power.Button != 1 || power.Protocol != ProtocolNEC ||
+		power.Code != "00100000110111110001000011101111" {
+		t.Errorf("imported %+v", power)
+	}
+
+	//Blocos e atributos fora de um remote são recusados em vez de derrubar a importação
+	for _, malformed := range []string{
+		"begin codes\n KEY_POWER 0x10EF\nend codes\n",
+		"begin raw_codes\n name KEY_POWER\n 9000 4500\nend raw_codes\n",
+		"end codes\nbits 16\n",
+		"begin remote\n name tv\nend remote\nbegin codes\n KEY_POWER 0x10EF\nend codes\n",
+		"begin remote\n name tv\nend remote\nend codes\nbits 16\n",
+	} {
+		if _, err := ParseLirc(strings.NewReader(malformed)); err == nil || !strings.Contains(err.Error(), "outside remote") {
+			t.Errorf("parsing %q: %v, want an error outside remote", malformed, err)
+		}
+	}
+}
+
+func TestImportLircHandlerMalformed(t *testing.T) {
+	i, _ := testInfraredManager(t)
+	w := httptest.NewRecorder()
+	i.ImportLircHandler(w, httptest.NewRequest("POST", "/api/infrared/import/lirc?type=tv&pin=17", strings.NewReader("end codes\nbits 16\n")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("malformed lircd.conf: %d, want 400", w.Code)
+	}
+}
+
+func TestLircRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		device Infrared
+	}{
+		{"nec", Infrared{Name: "living room tv", Commands: []Command{
+			{Name: "power", Button: 1, Protocol: ProtocolNEC, Code: NECCode(0x04, 0x08)},
+			{Name: "mute", Button: 2, Protocol: ProtocolNEC, Code: NECCode(0x04, 0x09)},
+		}}},
+		{"samsung", Infrared{Name: "tv", Commands: []Command{
+			{Name: "power", Button: 1, Protocol: ProtocolSamsung, Code: "11100000111000000100000010111111"},
+		}}},
+		{"raw and mixed", Infrared{Name: "ac", Commands: []Command{
+			{Name: "on", Button: 1, Protocol: ProtocolRaw, Timings: "3000 1500 400 1200 400 400 800"},
+			{Name: "power", Button: 2, Protocol: ProtocolRC5, Code: "11000000001100"},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, err := ExportLirc(tt.device)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var conf bytes.Buffer
+			if err := FormatLirc(&conf, remote); err != nil {
+				t.Fatal(err)
+			}
+			remotes, err := ParseLirc(&conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			devices, err := ImportLirc(remotes, TypeTV, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(devices) != 1 || len(devices[0].Commands) != len(tt.device.Commands) {
+				t.Fatalf("imported %+v from\n%s", devices, conf.String())
+			}
+			for k, want := range tt.device.Commands {
+				got := devices[0].Commands[k]
+				if got.Name != want.Name || got.Protocol != want.Protocol || got.Code != want.Code || got.Timings != want.Timings {
+					t.Errorf("command %d: imported %+v, want %+v", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func checkTimings(t *testing.T, got, want []int, tolerance int) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d timings, want %d", len(got), len(want))
+	}
+	for k := range want {
+		if math.Abs(float64(got[k]-want[k])) > float64(tolerance) {
+			t.Errorf("timing %d: %d, want %d", k, got[k], want[k])
+		}
+	}
+}
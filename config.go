@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+//	Configuration is read from the environment, like the DATABASE url
+const (
+	ConfigIRReceivePin     = "IR_RECEIVE_PIN"
+	ConfigIRReceiveTimeout = "IR_RECEIVE_TIMEOUT"
+)
+
+func envString(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+func envFloat(name string, def float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+//	envInterval is envDuration for the period of a ticker, which must be
+//	positive; zero or negative values fall back to def
+func envInterval(name string, def time.Duration) time.Duration {
+	if value := envDuration(name, def); value > 0 {
+		return value
+	}
+	return def
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEnvInterval(t *testing.T) {
+	const name = "TEST_INTERVAL"
+	defer os.Unsetenv(name)
+	for value, want := range map[string]time.Duration{
+		"":     time.Minute,
+		"90s":  90 * time.Second,
+		"0":    time.Minute,
+		"0s":   time.Minute,
+		"-5s":  time.Minute,
+		"soon": time.Minute,
+	} {
+		os.Setenv(name, value)
+		if got := envInterval(name, time.Minute); got != want {
+			t.Errorf("%q: %v, want %v", value, got, want)
+		}
+	}
+	//Outras durações aceitam zero, como um debounce desligado
+	os.Setenv(name, "0")
+	if got := envDuration(name, time.Minute); got != 0 {
+		t.Errorf("envDuration(0): %v", got)
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
@@ -18,16 +23,77 @@ import (
 */
 //	DatabaseManager
 type DatabaseManager struct {
+	Driver  string
 	Kernel  *gorm.DB
 	LogFile *os.File
 	Logger  *log.Logger
 }
 
+const (
+	DatabaseDriverPostgres = "postgres"
+	DatabaseDriverSQLite   = "sqlite3"
+
+	//Com sqlite3, a variável DATABASE é o caminho do arquivo
+	ConfigDatabaseDriver = "DATABASE_DRIVER"
+	DefaultSQLiteFile    = "juggernaut.db"
+
+	ConfigDatabaseConnectTimeout   = "DATABASE_CONNECT_TIMEOUT"
+	ConfigDatabaseConnectRetry     = "DATABASE_CONNECT_RETRY"
+	ConfigDatabaseMaxOpenConns     = "DATABASE_MAX_OPEN_CONNS"
+	ConfigDatabaseMaxIdleConns     = "DATABASE_MAX_IDLE_CONNS"
+	ConfigDatabaseConnMaxLifetime  = "DATABASE_CONN_MAX_LIFETIME"
+	DefaultDatabaseConnectTimeout  = 10 * time.Second
+	DefaultDatabaseConnectRetry    = 2 * time.Minute
+	DefaultDatabaseMaxOpenConns    = 4
+	DefaultDatabaseMaxIdleConns    = 2
+	DefaultDatabaseConnMaxLifetime = 30 * time.Minute
+)
+
+var (
+	ErrNotFound = errors.New("record not found")
+	ErrConflict = errors.New("record conflicts with an existing one")
+)
+
+//	DatabaseDrivers are the drivers compiled in; sqlite3 needs the sqlite build tag
+var DatabaseDrivers = map[string]bool{
+	DatabaseDriverPostgres: true,
+}
+
+//	Tag de compilação de cada driver opcional
+var databaseDriverTags = map[string]string{
+	DatabaseDriverSQLite: "sqlite",
+}
+
 func NewDatabaseManager() *DatabaseManager {
 	return &DatabaseManager{}
 }
 
 func (dm *DatabaseManager) Initialize(logPath string, env string) error {
+	if err := dm.Connect(logPath, env); err != nil {
+		return err
+	}
+	switch mode := envString(ConfigDatabaseMigrate, MigrateAuto); mode {
+	case MigrateAuto:
+		if _, err := dm.Migrate(false); err != nil {
+			return err
+		}
+	case MigrateDryRun:
+		//O esquema não muda no dry-run, então o servidor não pode atender
+		applied, err := dm.Migrate(true)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%s=%s: %d migrations would be applied, see %s; not serving", ConfigDatabaseMigrate, mode, len(applied), logPath)
+	case MigrateOff:
+	default:
+		return fmt.Errorf("%s: unknown mode %q", ConfigDatabaseMigrate, mode)
+	}
+	dm.Logger.Printf("DatabaseManager started.\n")
+	return nil
+}
+
+//	Connect opens the log and the database without touching the schema
+func (dm *DatabaseManager) Connect(logPath string, env string) error {
 	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return err
@@ -35,9 +101,21 @@ func (dm *DatabaseManager) Initialize(logPath string, env string) error {
 	dm.LogFile = f
 	dm.Logger = log.New(dm.LogFile, "", log.Ldate|log.Ltime)
 
-	dm.Kernel = dm.Open(dm.URL(env))
-	dm.Logger.Printf("DatabaseManager started.\n")
-	return nil
+	dm.Driver = envString(ConfigDatabaseDriver, DatabaseDriverPostgres)
+	if !DatabaseDrivers[dm.Driver] {
+		if tag, ok := databaseDriverTags[dm.Driver]; ok {
+			return fmt.Errorf("%s=%s: this binary was built without the %s tag; rebuild with CGO_ENABLED=1 go build -tags %s (see doc/build.md)", ConfigDatabaseDriver, dm.Driver, tag, tag)
+		}
+		return fmt.Errorf("%s=%s: unknown database driver", ConfigDatabaseDriver, dm.Driver)
+	}
+	source := envString(env, DefaultSQLiteFile)
+	if dm.Driver != DatabaseDriverSQLite {
+		if source, err = dm.URL(env); err != nil {
+			return err
+		}
+	}
+	dm.Kernel, err = dm.Open(dm.Driver, source)
+	return err
 }
 
 func (dm *DatabaseManager) Close() {
@@ -48,80 +126,271 @@ func (dm *DatabaseManager) Close() {
 	dm.LogFile.Close()
 }
 
-func (dm *DatabaseManager) CreateRelay(relay Relay) (created Relay) {
-	dm.Kernel.Create(&relay)
-	return relay
+//	dbError turns gorm and driver errors into ErrNotFound and ErrConflict
+//	It counts every error once, so it is applied once per operation; errors
+//	it already translated pass through, and a missing record is not counted
+func dbError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == ErrNotFound || gorm.IsRecordNotFoundError(err) {
+		return ErrNotFound
+	}
+	if err == ErrConflict {
+		return err
+	}
+	//Violação de unicidade: código 23505 no postgres
+	if e, ok := err.(*pq.Error); ok && e.Code == "23505" {
+		databaseErrors.Inc("conflict")
+		return ErrConflict
+	}
+	if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		databaseErrors.Inc("conflict")
+		return ErrConflict
+	}
+	databaseErrors.Inc("other")
+	return err
 }
 
-func (dm *DatabaseManager) ReadRelay() []Relay {
-	var relay []Relay
-	dm.Kernel.Find(&relay)
-	return relay
+//	deleted reports ErrNotFound when a delete matched no row; its result is
+//	passed to dbError by the caller
+func deleted(db *gorm.DB) error {
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
-func (dm *DatabaseManager) UpdateRelay(relay Relay) (updated Relay) {
-	dm.Kernel.Save(&relay)
-	return relay
+//	transaction runs f in a transaction, committed only if f succeeds
+func (dm *DatabaseManager) transaction(f func(tx *gorm.DB) error) error {
+	tx := dm.Kernel.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
 }
 
-func (dm *DatabaseManager) DeleteRelay(relay Relay) (deleted Relay) {
-	dm.Kernel.Delete(&relay)
-	return relay
+func (dm *DatabaseManager) CreateRelay(relay Relay) (created Relay, err error) {
+	err = dbError(dm.Kernel.Create(&relay).Error)
+	return relay, err
 }
 
-func (dm *DatabaseManager) ReadInfo() Info {
-	var info Info
-	dm.Kernel.First(&info)
-	return info
+func (dm *DatabaseManager) ReadRelay() (relay []Relay, err error) {
+	err = dbError(dm.Kernel.Find(&relay).Error)
+	return relay, err
 }
 
-func (dm *DatabaseManager) WriteInfo(info Info) Info {
-	dm.Kernel.Save(&info)
-	return info
+func (dm *DatabaseManager) ReadRelayByID(id int) (relay Relay, err error) {
+	err = dbError(dm.Kernel.First(&relay, id).Error)
+	return relay, err
 }
 
-func (dm *DatabaseManager) ReadCustomer() Customer {
-	var customer Customer
-	dm.Kernel.First(&customer)
-	return customer
+func (dm *DatabaseManager) UpdateRelay(relay Relay) (updated Relay, err error) {
+	err = dbError(dm.Kernel.Save(&relay).Error)
+	return relay, err
 }
 
-func (dm *DatabaseManager) WriteCustomer(customer Customer) Customer {
-	dm.Kernel.Save(&customer)
-	return customer
+func (dm *DatabaseManager) DeleteRelay(relay Relay) error {
+	return dbError(deleted(dm.Kernel.Delete(&relay)))
 }
 
-func (dm *DatabaseManager) Open(url string) *gorm.DB {
-	db, err := gorm.Open("postgres", url)
+func (dm *DatabaseManager) ReadInfo() (info Info, err error) {
+	err = dbError(dm.Kernel.First(&info).Error)
+	return info, err
+}
 
-	if err != nil {
-		panic(err)
+func (dm *DatabaseManager) WriteInfo(info Info) (Info, error) {
+	err := dbError(dm.Kernel.Save(&info).Error)
+	return info, err
+}
+
+func (dm *DatabaseManager) ReadCustomer() (customer Customer, err error) {
+	err = dbError(dm.Kernel.First(&customer).Error)
+	return customer, err
+}
+
+func (dm *DatabaseManager) WriteCustomer(customer Customer) (Customer, error) {
+	err := dbError(dm.Kernel.Save(&customer).Error)
+	return customer, err
+}
+
+func (dm *DatabaseManager) CreateInfrared(infrared Infrared) (created Infrared, err error) {
+	err = dbError(dm.Kernel.Create(&infrared).Error)
+	return infrared, err
+}
+
+func (dm *DatabaseManager) ReadInfrared() (infrared []Infrared, err error) {
+	err = dbError(dm.Kernel.Preload("Commands").Find(&infrared).Error)
+	return infrared, err
+}
+
+func (dm *DatabaseManager) ReadInfraredByID(id int) (infrared Infrared, err error) {
+	err = dbError(dm.Kernel.Preload("Commands").First(&infrared, id).Error)
+	return infrared, err
+}
+
+func (dm *DatabaseManager) ReadCommand(infraredID, button int) (command Command, err error) {
+	err = dbError(dm.Kernel.Where("infrared_id = ? AND button = ?", infraredID, button).First(&command).Error)
+	return command, err
+}
+
+//	WriteCommand replaces any command already learned for the same device button
+func (dm *DatabaseManager) WriteCommand(command Command) (Command, error) {
+	err := dm.transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("infrared_id = ? AND button = ?", command.InfraredID, command.Button).Delete(Command{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&command).Error
+	})
+	return command, dbError(err)
+}
+
+func (dm *DatabaseManager) ReadACState(infraredID int) (state ACState, err error) {
+	err = dbError(dm.Kernel.Where("infrared_id = ?", infraredID).First(&state).Error)
+	return state, err
+}
+
+func (dm *DatabaseManager) WriteACState(state ACState) (ACState, error) {
+	err := dbError(dm.Kernel.Save(&state).Error)
+	return state, err
+}
+
+func (dm *DatabaseManager) ReadRGBState(infraredID int) (state RGBState, err error) {
+	err = dbError(dm.Kernel.Where("infrared_id = ?", infraredID).First(&state).Error)
+	return state, err
+}
+
+func (dm *DatabaseManager) WriteRGBState(state RGBState) (RGBState, error) {
+	err := dbError(dm.Kernel.Save(&state).Error)
+	return state, err
+}
+
+func (dm *DatabaseManager) CreateBinding(binding Binding) (created Binding, err error) {
+	err = dbError(dm.Kernel.Create(&binding).Error)
+	return binding, err
+}
+
+func (dm *DatabaseManager) ReadBinding() (binding []Binding, err error) {
+	err = dbError(dm.Kernel.Preload("Actions", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}).Find(&binding).Error)
+	return binding, err
+}
+
+func (dm *DatabaseManager) DeleteBinding(binding Binding) error {
+	return dbError(dm.transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("binding_id = ?", binding.ID).Delete(BindingAction{}).Error; err != nil {
+			return err
+		}
+		return deleted(tx.Delete(&binding))
+	}))
+}
+
+func (dm *DatabaseManager) CreateMacro(macro Macro) (created Macro, err error) {
+	err = dbError(dm.Kernel.Create(&macro).Error)
+	return macro, err
+}
+
+func (dm *DatabaseManager) ReadMacro() (macro []Macro, err error) {
+	err = dbError(dm.Kernel.Preload("Steps", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}).Find(&macro).Error)
+	return macro, err
+}
+
+func (dm *DatabaseManager) ReadMacroByID(id int) (macro Macro, err error) {
+	err = dbError(dm.Kernel.Preload("Steps", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}).First(&macro, id).Error)
+	return macro, err
+}
+
+func (dm *DatabaseManager) DeleteMacro(macro Macro) error {
+	return dbError(dm.transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("macro_id = ?", macro.ID).Delete(MacroStep{}).Error; err != nil {
+			return err
+		}
+		return deleted(tx.Delete(&macro))
+	}))
+}
+
+func (dm *DatabaseManager) CreateSchedule(schedule Schedule) (created Schedule, err error) {
+	err = dbError(dm.Kernel.Create(&schedule).Error)
+	return schedule, err
+}
+
+func (dm *DatabaseManager) ReadSchedule() (schedule []Schedule, err error) {
+	err = dbError(dm.Kernel.Find(&schedule).Error)
+	return schedule, err
+}
+
+func (dm *DatabaseManager) DeleteSchedule(schedule Schedule) error {
+	return dbError(deleted(dm.Kernel.Delete(&schedule)))
+}
+
+//	Open connects with driver to source, a connection string for postgres
+//	and a file path, or ":memory:" for a throwaway database, for sqlite3
+//	The database may still be starting at boot, so failures are retried with
+//	exponential backoff for up to DATABASE_CONNECT_RETRY
+func (dm *DatabaseManager) Open(driver, source string) (db *gorm.DB, err error) {
+	deadline := time.Now().Add(envDuration(ConfigDatabaseConnectRetry, DefaultDatabaseConnectRetry))
+	backoff := time.Second
+	for {
+		db, err = gorm.Open(driver, source)
+		if err == nil {
+			break
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, fmt.Errorf("connecting to database: %v", err)
+		}
+		dm.Logger.Printf("connecting to database: %v; retrying in %s\n", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
 	}
 
 	db.LogMode(true)
 
-	db.AutoMigrate(&Relay{})
-	db.AutoMigrate(&Info{})
-	db.AutoMigrate(&Customer{})
-
-	return db
+	maxOpen := envInt(ConfigDatabaseMaxOpenConns, DefaultDatabaseMaxOpenConns)
+	if driver == DatabaseDriverSQLite {
+		//Cada conexão com ":memory:" abriria um banco diferente
+		maxOpen = 1
+	}
+	db.DB().SetMaxOpenConns(maxOpen)
+	db.DB().SetMaxIdleConns(envInt(ConfigDatabaseMaxIdleConns, DefaultDatabaseMaxIdleConns))
+	db.DB().SetConnMaxLifetime(envDuration(ConfigDatabaseConnMaxLifetime, DefaultDatabaseConnMaxLifetime))
+	return db, nil
 }
 
-func (dm *DatabaseManager) URL(env string) string {
-	databaseURL := os.Getenv(env)
-	dm.Logger.Printf("database URL: %s\n", databaseURL)
-	aux := strings.Split(databaseURL, "//")
-	if len(aux) == 0 {
-		panic("can not find database url")
+//	URL reads a postgres URL or key=value DSN from env and returns it as a DSN,
+//	adding connect_timeout when it is not set
+func (dm *DatabaseManager) URL(env string) (string, error) {
+	source := strings.TrimSpace(os.Getenv(env))
+	if source == "" {
+		return "", fmt.Errorf("database url: %s not set", env)
+	}
+	if strings.HasPrefix(source, "postgres://") || strings.HasPrefix(source, "postgresql://") {
+		dsn, err := pq.ParseURL(source)
+		if err != nil {
+			return "", fmt.Errorf("database url: %v", err)
+		}
+		source = dsn
 	}
-	aux = strings.Split(aux[1], "/")
-	dbName := aux[1]
-	aux = strings.Split(aux[0], ":")
-	user := aux[0]
-	port := aux[2]
-	aux = strings.Split(aux[1], "@")
-	password := aux[0]
-	host := aux[1]
-	replacer := strings.NewReplacer("{host}", host, "{port}", port, "{user}", user, "{dbname}", dbName, "{password}", password)
-	return replacer.Replace("host={host} port={port} user={user} dbname={dbname} password={password}")
+	if !strings.Contains(source, "connect_timeout=") {
+		timeout := envDuration(ConfigDatabaseConnectTimeout, DefaultDatabaseConnectTimeout)
+		source += fmt.Sprintf(" connect_timeout=%d", int(timeout.Seconds()))
+	}
+	dm.Logger.Printf("database URL: %s\n", dsnPassword.ReplaceAllString(source, "password=xxxxx"))
+	return source, nil
 }
+
+//	Senhas não vão para o log, estejam ou não entre aspas
+var dsnPassword = regexp.MustCompile(`password\s*=\s*('(\\.|[^'])*'?|(\\.|[^ ])*)`)
@@ -0,0 +1,11 @@
+// +build sqlite
+
+package main
+
+//	The sqlite3 driver needs cgo and github.com/mattn/go-sqlite3, so it is
+//	only built with the sqlite tag
+import _ "github.com/jinzhu/gorm/dialects/sqlite"
+
+func init() {
+	DatabaseDrivers[DatabaseDriverSQLite] = true
+}
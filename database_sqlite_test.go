@@ -0,0 +1,370 @@
+// +build sqlite
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//	testDatabase opens a throwaway SQLite database with every migration applied
+func testDatabase(t *testing.T) *DatabaseManager {
+	t.Helper()
+	dm := &DatabaseManager{Driver: DatabaseDriverSQLite, Logger: log.New(ioutil.Discard, "", 0)}
+	var err error
+	dm.Kernel, err = dm.Open(DatabaseDriverSQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm.Kernel.LogMode(false)
+	t.Cleanup(func() { dm.Kernel.Close() })
+	if _, err := dm.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	return dm
+}
+
+func TestMigrate(t *testing.T) {
+	dm := testDatabase(t)
+	pending, err := dm.PendingMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("%d migrations pending after Migrate", len(pending))
+	}
+	applied, err := dm.Migrate(false)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("second Migrate applied %d: %v", len(applied), err)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	dm := &DatabaseManager{Driver: DatabaseDriverSQLite, Logger: log.New(ioutil.Discard, "", 0)}
+	var err error
+	dm.Kernel, err = dm.Open(DatabaseDriverSQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dm.Kernel.Close()
+	dm.Kernel.LogMode(false)
+	pending, err := dm.PendingMigrations()
+	if err != nil || len(pending) != len(Migrations) {
+		t.Fatalf("%d migrations pending on an empty database: %v", len(pending), err)
+	}
+	applied, err := dm.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(Migrations) {
+		t.Errorf("dry run applied %d migrations, want %d", len(applied), len(Migrations))
+	}
+	if dm.Kernel.HasTable(&Relay{}) || dm.Kernel.HasTable(&SchemaMigration{}) {
+		t.Error("dry run changed the schema")
+	}
+}
+
+//	TestMigrateAutoMigrated applies the migrations to a database created by
+//	AutoMigrate, as on devices installed before versioned migrations
+func TestMigrateAutoMigrated(t *testing.T) {
+	dm := &DatabaseManager{Driver: DatabaseDriverSQLite, Logger: log.New(ioutil.Discard, "", 0)}
+	var err error
+	dm.Kernel, err = dm.Open(DatabaseDriverSQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dm.Kernel.Close()
+	dm.Kernel.LogMode(false)
+	//Info ganhou colunas depois, então fica para a migração
+	if err := dm.Kernel.AutoMigrate(&Relay{}, &Customer{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.CreateRelay(Relay{Name: "sala", RelayPin: 17}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	if relays, err := dm.ReadRelay(); err != nil || len(relays) != 1 {
+		t.Errorf("read %d relays after migrating: %v", len(relays), err)
+	}
+}
+
+//	TestMigrationsMatchModels fails when a model gains a column without a
+//	migration adding it
+func TestMigrationsMatchModels(t *testing.T) {
+	dm := testDatabase(t)
+	models := []interface{}{&Relay{}, &Info{}, &Customer{}, &Infrared{}, &Command{}, &ACState{}, &RGBState{},
+		&Binding{}, &BindingAction{}, &Macro{}, &MacroStep{}, &Schedule{}, &SchemaMigration{}}
+	for _, model := range models {
+		scope := dm.Kernel.NewScope(model)
+		table := scope.TableName()
+		if !dm.Kernel.Dialect().HasTable(table) {
+			t.Errorf("no migration creates %s", table)
+			continue
+		}
+		for _, field := range scope.GetModelStruct().StructFields {
+			if field.IsNormal && !field.IsIgnored && !dm.Kernel.Dialect().HasColumn(table, field.DBName) {
+				t.Errorf("no migration adds %s.%s", table, field.DBName)
+			}
+		}
+	}
+}
+
+func TestRepositoryRelay(t *testing.T) {
+	dm := testDatabase(t)
+	databaseErrors.Reset()
+	relay, err := dm.CreateRelay(Relay{Name: "sala", Type: "lamp", RelayPin: 17, StateAddress: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relay.ID == 0 {
+		t.Fatal("created relay has no ID")
+	}
+	if _, err := dm.CreateRelay(Relay{Name: "cozinha", RelayPin: 17}); err != ErrConflict {
+		t.Errorf("creating relay on a used pin: %v, want ErrConflict", err)
+	}
+	relay.Name = "quarto"
+	if _, err := dm.UpdateRelay(relay); err != nil {
+		t.Fatal(err)
+	}
+	read, err := dm.ReadRelayByID(relay.ID)
+	if err != nil || read.Name != "quarto" {
+		t.Errorf("read %+v: %v", read, err)
+	}
+	if err := dm.DeleteRelay(relay); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.ReadRelayByID(relay.ID); err != ErrNotFound {
+		t.Errorf("reading deleted relay: %v, want ErrNotFound", err)
+	}
+	if err := dm.DeleteRelay(relay); err != ErrNotFound {
+		t.Errorf("deleting relay twice: %v, want ErrNotFound", err)
+	}
+	//Um conflito conta uma vez; registros ausentes não são erros do banco
+	if out := metricOutput(t, databaseErrors); strings.Count(out, "\nshc_") != 1 || !strings.Contains(out, `{kind="conflict"} 1`) {
+		t.Errorf("database errors:\n%s", out)
+	}
+}
+
+func TestRepositoryInfrared(t *testing.T) {
+	dm := testDatabase(t)
+	device, err := dm.CreateInfrared(Infrared{Name: "tv", Type: TypeTV, Pin: 18})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []string{NECCode(0x04, 0x08), NECCode(0x04, 0x09)} {
+		command := Command{InfraredID: device.ID, Button: 1, Protocol: ProtocolNEC, Code: code}
+		if _, err := dm.WriteCommand(command); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read, err := dm.ReadInfraredByID(device.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Commands) != 1 || read.Commands[0].Code != NECCode(0x04, 0x09) {
+		t.Errorf("commands %+v, want the last one written", read.Commands)
+	}
+	if _, err := dm.ReadCommand(device.ID, 2); err != ErrNotFound {
+		t.Errorf("reading unlearned button: %v, want ErrNotFound", err)
+	}
+	if _, err := dm.ReadACState(device.ID); err != ErrNotFound {
+		t.Errorf("reading missing AC state: %v, want ErrNotFound", err)
+	}
+	state, err := dm.WriteACState(ACState{InfraredID: device.ID, Mode: "cool", Temperature: 23, Power: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Temperature = 21
+	if _, err := dm.WriteACState(state); err != nil {
+		t.Fatal(err)
+	}
+	if read, err := dm.ReadACState(device.ID); err != nil || read.Temperature != 21 {
+		t.Errorf("AC state %+v: %v", read, err)
+	}
+}
+
+func TestRepositoryBindingAndMacro(t *testing.T) {
+	dm := testDatabase(t)
+	databaseErrors.Reset()
+	binding, err := dm.CreateBinding(Binding{Name: "power", Protocol: ProtocolNEC, Address: 0x04, Command: 0x08,
+		Actions: []BindingAction{
+			{Position: 1, Type: "relay", RelayID: 1, RelayCommand: "toggle"},
+			{Position: 0, Type: "infrared", InfraredID: 1, Button: 1},
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindings, err := dm.ReadBinding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bindings) != 1 || len(bindings[0].Actions) != 2 || bindings[0].Actions[0].Position != 0 {
+		t.Errorf("read bindings %+v, want actions in position order", bindings)
+	}
+	if err := dm.DeleteBinding(binding); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.DeleteBinding(binding); err != ErrNotFound {
+		t.Errorf("deleting binding twice: %v, want ErrNotFound", err)
+	}
+
+	macro, err := dm.CreateMacro(Macro{Name: "cinema", Steps: []MacroStep{
+		{Position: 1, InfraredID: 1, Button: 2, Repeat: 1},
+		{Position: 0, InfraredID: 1, Button: 1, Repeat: 1, Delay: 500},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := dm.ReadMacroByID(macro.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Steps) != 2 || read.Steps[0].Button != 1 {
+		t.Errorf("read macro %+v, want steps in position order", read)
+	}
+	if err := dm.DeleteMacro(macro); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.ReadMacroByID(macro.ID); err != ErrNotFound {
+		t.Errorf("reading deleted macro: %v, want ErrNotFound", err)
+	}
+	if err := dm.DeleteMacro(macro); err != ErrNotFound {
+		t.Errorf("deleting macro twice: %v, want ErrNotFound", err)
+	}
+	if out := metricOutput(t, databaseErrors); strings.Contains(out, "\nshc_") {
+		t.Errorf("missing records counted as database errors:\n%s", out)
+	}
+}
+
+func TestRepositorySchedule(t *testing.T) {
+	dm := testDatabase(t)
+	schedule, err := dm.CreateSchedule(Schedule{Type: ScheduleTypeMacro, Frequency: "daily", MacroID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedules, err := dm.ReadSchedule()
+	if err != nil || len(schedules) != 1 {
+		t.Errorf("read %d schedules: %v", len(schedules), err)
+	}
+	if err := dm.DeleteSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.DeleteSchedule(schedule); err != ErrNotFound {
+		t.Errorf("deleting schedule twice: %v, want ErrNotFound", err)
+	}
+}
+
+func TestRepositoryInfo(t *testing.T) {
+	dm := testDatabase(t)
+	if _, err := dm.ReadInfo(); err != ErrNotFound {
+		t.Errorf("reading missing info: %v, want ErrNotFound", err)
+	}
+	if _, err := dm.WriteInfo(Info{UUID: "device", Environment: EnvironmentProduction}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := EnsureDeviceSecret(dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Enrolled = true
+	if _, err := dm.WriteInfo(info); err != nil {
+		t.Fatal(err)
+	}
+	if read, err := dm.ReadInfo(); err != nil || read.Secret != info.Secret || !read.Enrolled {
+		t.Errorf("read %+v: %v", read, err)
+	}
+}
+
+//	TestRestoreBackup restores an archive from another device, whose IDs are
+//	all taken by nothing here, and follows every reference to the new IDs
+func TestRestoreBackup(t *testing.T) {
+	dm := testDatabase(t)
+	databaseErrors.Reset()
+	backup := testBackup()
+	var err error
+	backup.Secrets, err = SealSecrets(BackupSecrets{
+		Info:     Info{UUID: "old", Secret: "5ec2e7", Enrolled: true},
+		Customer: Customer{Name: "Ana", Hash: "hash"},
+	}, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dm.Restore(backup, "wrong horse", false); err != ErrBackupPassphrase {
+		t.Errorf("wrong passphrase: %v, want ErrBackupPassphrase", err)
+	}
+	report, err := dm.Restore(backup, "correct horse", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || len(report.Relays) != 2 || report.Commands != 1 || report.States != 1 || !report.Secrets {
+		t.Errorf("dry run report %+v", report)
+	}
+	if relays, err := dm.ReadRelay(); err != nil || len(relays) != 0 {
+		t.Fatalf("dry run left %d relays: %v", len(relays), err)
+	}
+	if _, err := dm.ReadInfo(); err != ErrNotFound {
+		t.Fatalf("dry run left info: %v", err)
+	}
+
+	report, err = dm.Restore(backup, "correct horse", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relays, err := dm.ReadRelay()
+	if err != nil || len(relays) != 2 {
+		t.Fatalf("restored %d relays: %v", len(relays), err)
+	}
+	for _, relay := range relays {
+		if old := map[int]int{17: 3, 27: 4}[relay.RelayPin]; report.Relays[old] != relay.ID || relay.ID == old {
+			t.Errorf("relay on pin %d restored as %d, report %v", relay.RelayPin, relay.ID, report.Relays)
+		}
+	}
+	tv, ac := report.Infrared[5], report.Infrared[6]
+	if command, err := dm.ReadCommand(tv, 1); err != nil || command.Code != NECCode(0x04, 0x08) {
+		t.Errorf("command of the tv (%d): %+v, %v", tv, command, err)
+	}
+	if state, err := dm.ReadACState(ac); err != nil || state.Temperature != 23 {
+		t.Errorf("state of the ac (%d): %+v, %v", ac, state, err)
+	}
+	macro, err := dm.ReadMacroByID(report.Macros[7])
+	if err != nil || len(macro.Steps) != 1 || macro.Steps[0].InfraredID != tv {
+		t.Errorf("macro %+v: %v, want a step on device %d", macro, err, tv)
+	}
+	bindings, err := dm.ReadBinding()
+	if err != nil || len(bindings) != 1 || len(bindings[0].Actions) != 3 {
+		t.Fatalf("bindings %+v: %v", bindings, err)
+	}
+	if actions := bindings[0].Actions; actions[0].RelayID != report.Relays[4] || actions[1].InfraredID != tv || actions[2].MacroID != macro.ID {
+		t.Errorf("binding actions %+v, report %+v", actions, report)
+	}
+	schedules, err := dm.ReadSchedule()
+	if err != nil || len(schedules) != 1 || schedules[0].MacroID != macro.ID {
+		t.Errorf("schedules %+v: %v, want macro %d", schedules, err, macro.ID)
+	}
+	if info, err := dm.ReadInfo(); err != nil || info.UUID != "old" || info.Secret != "5ec2e7" || !info.Enrolled {
+		t.Errorf("info %+v: %v", info, err)
+	}
+
+	if _, err := dm.Restore(backup, "", false); err != ErrBackupNotEmpty {
+		t.Errorf("restoring twice: %v, want ErrBackupNotEmpty", err)
+	}
+	//Recusas do restore não são erros do banco
+	if out := metricOutput(t, databaseErrors); strings.Contains(out, "\nshc_") {
+		t.Errorf("refused restores counted as database errors:\n%s", out)
+	}
+
+	//Sem a senha, os segredos ficam de fora
+	other := testDatabase(t)
+	if report, err := other.Restore(backup, "", false); err != nil || report.Secrets {
+		t.Errorf("restore without passphrase: %+v, %v", report, err)
+	}
+	if _, err := other.ReadInfo(); err != ErrNotFound {
+		t.Errorf("info restored without passphrase: %v", err)
+	}
+}
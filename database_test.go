@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestURLRedactsPassword(t *testing.T) {
+	tests := []struct{ name, source string }{
+		{"plain", "host=db user=shc password=s3cr3t dbname=shc"},
+		{"quoted", "host=db password='s3cr3t with spaces' dbname=shc"},
+		{"escaped quote", `host=db password='s3cr3t \' with quote' dbname=shc`},
+		{"spaced equals", "host=db password = 's3cr3t spaced' dbname=shc"},
+		{"unterminated", "host=db password='s3cr3t to the end"},
+		{"url", "postgres://shc:s3cr3t%20with%20spaces@db/shc?sslmode=disable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged bytes.Buffer
+			dm := &DatabaseManager{Logger: log.New(&logged, "", 0)}
+			os.Setenv("TEST_DATABASE", tt.source)
+			defer os.Unsetenv("TEST_DATABASE")
+			dsn, err := dm.URL("TEST_DATABASE")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(dsn, "s3cr3t") {
+				t.Errorf("DSN %q lost the password", dsn)
+			}
+			if strings.Contains(logged.String(), "s3cr3t") || strings.Contains(logged.String(), "spaces") {
+				t.Errorf("logged %q", logged.String())
+			}
+			if !strings.Contains(logged.String(), "host=db") {
+				t.Errorf("logged %q, want the rest of the DSN", logged.String())
+			}
+		})
+	}
+}
+
+func TestConnectDriverNotBuilt(t *testing.T) {
+	if DatabaseDrivers[DatabaseDriverSQLite] {
+		t.Skip("built with the sqlite tag")
+	}
+	defer os.Unsetenv(ConfigDatabaseDriver)
+	for driver, want := range map[string]string{
+		DatabaseDriverSQLite: "-tags sqlite",
+		"mysql":              "unknown database driver",
+	} {
+		os.Setenv(ConfigDatabaseDriver, driver)
+		dm := NewDatabaseManager()
+		err := dm.Connect(filepath.Join(t.TempDir(), "database"), "TEST_DATABASE")
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v, want an error naming %q", driver, err, want)
+		}
+		if dm.Kernel != nil {
+			t.Errorf("%s: opened a database", driver)
+		}
+		dm.LogFile.Close()
+	}
+}
@@ -2,18 +2,31 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const (
 	EnvironmentDevelopment = "dev"
 	EnvironmentProduction  = "prod"
+
+	//Tempo máximo de uma leitura de sensor
+	SensorReadTimeout = 5 * time.Second
+)
+
+//	Comandos de leitura dos sensores, trocados nos testes
+var (
+	temperatureCommand    = "vcgencmd measure_temp"
+	analogVarianceCommand = "/home/pi/go/src/joaowiciuk/juggernaut/c/./avariance"
 )
 
 //	Responsibilities:
@@ -22,7 +35,7 @@ const (
 type DeviceManager struct {
 	LogFile *os.File
 	Logger  *log.Logger
-	*DatabaseManager
+	Repository
 }
 
 type Info struct {
@@ -31,6 +44,11 @@ type Info struct {
 	UUID        string `json:"uuid"`
 	Identifier  string `json:"identifier"`
 	Environment string `json:"environment"`
+	//Segredo aleatório gerado no próprio dispositivo, em hex, e registrado na
+	//nuvem; não é derivado dos outros campos. Nunca vai para o JSON: só os
+	//backups com senha o levam, em BackupSecrets
+	Secret   string `json:"-"`
+	Enrolled bool   `json:"enrolled,omitempty"`
 }
 
 type Temperature struct {
@@ -66,14 +84,14 @@ func NewDeviceManager() *DeviceManager {
 	return &DeviceManager{}
 }
 
-func (d *DeviceManager) Initialize(logPath string, databaseManager *DatabaseManager) (err error) {
+func (d *DeviceManager) Initialize(logPath string, repository Repository) (err error) {
 	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
 	d.LogFile = f
 	d.Logger = log.New(d.LogFile, "", log.Ldate|log.Ltime)
-	d.DatabaseManager = databaseManager
+	d.Repository = repository
 	d.Logger.Printf("DeviceManager started.\n")
 	return nil
 }
@@ -135,71 +153,80 @@ func (d *DeviceManager) Wifis() (wifis []Wifi) {
 	return wifis
 }
 
+//	Temperature reads the temperature, retrying until it succeeds
+//	Readings that must not block, like periodic samples, use ReadTemperature
 func (d *DeviceManager) Temperature() (temperature Temperature) {
-	done := false
-	var temp float64
-	for !done {
-		cmd := exec.Command("/bin/sh", "-c", "vcgencmd measure_temp")
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			d.Logger.Println(err)
-			time.Sleep(time.Second * 5)
-			continue
-		}
-		if err := cmd.Start(); err != nil {
-			d.Logger.Println(err)
-			time.Sleep(time.Second * 5)
-			continue
-		}
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(stdout)
-		output := buf.String()
-		if err := cmd.Wait(); err != nil {
-			d.Logger.Println(err)
-			time.Sleep(time.Second * 5)
-			continue
-		}
-		re := regexp.MustCompile(`temp=(.*)'C`)
-		submatches := re.FindAllStringSubmatch(output, -1)
-		temp, err = strconv.ParseFloat(submatches[0][1], 64)
-		if err != nil {
-			d.Logger.Println(err)
-			time.Sleep(time.Second * 5)
-			continue
+	for {
+		value, err := d.ReadTemperature()
+		if err == nil {
+			return Temperature{TemperatureValue: value}
 		}
-		done = true
-	}
-	return Temperature{
-		TemperatureValue: temp,
+		d.Logger.Println(err)
+		time.Sleep(time.Second * 5)
 	}
 }
 
+//	AnalogVariance reads the current sensor, retrying until it succeeds
+//	Readings that must not block, like periodic samples, use ReadAnalogVariance
 func (d *DeviceManager) AnalogVariance() float64 {
-	done := false
-	var analogVariance float64
-	for !done {
-		cmd := exec.Command("/bin/sh", "-c", "/home/pi/go/src/joaowiciuk/juggernaut/c/./avariance")
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			d.Logger.Println(err)
-			continue
-		}
-		if err := cmd.Start(); err != nil {
-			d.Logger.Println(err)
-			continue
+	for {
+		analogVariance, err := d.ReadAnalogVariance()
+		if err == nil {
+			d.Logger.Printf("Analog variance: %.3f\n", analogVariance)
+			return analogVariance
 		}
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(stdout)
-		output := buf.String()
-		analogVariance, err = strconv.ParseFloat(output, 64)
-		if err != nil {
-			d.Logger.Println(err)
-			continue
-		}
-		done = true
+		d.Logger.Println(err)
+		time.Sleep(time.Second * 1)
+	}
+}
+
+//	ReadTemperature reads the SoC temperature once, in degrees Celsius
+func (d *DeviceManager) ReadTemperature() (float64, error) {
+	output, err := sensorOutput(temperatureCommand)
+	if err != nil {
+		return 0, fmt.Errorf("reading temperature: %v", err)
+	}
+	submatches := regexp.MustCompile(`temp=(.*)'C`).FindStringSubmatch(output)
+	if submatches == nil {
+		return 0, fmt.Errorf("reading temperature: unexpected output %q", output)
 	}
-	d.Logger.Printf("Analog variance: %.3f\n", analogVariance)
-	return analogVariance
+	temperature, err := strconv.ParseFloat(submatches[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("reading temperature: %v", err)
+	}
+	return temperature, nil
+}
+
+//	ReadAnalogVariance reads the variance of the current sensor once, from
+//	which lampState tells whether lamps are on
+func (d *DeviceManager) ReadAnalogVariance() (float64, error) {
+	output, err := sensorOutput(analogVarianceCommand)
+	if err != nil {
+		return 0, fmt.Errorf("reading analog variance: %v", err)
+	}
+	analogVariance, err := strconv.ParseFloat(strings.TrimSpace(output), 64)
+	if err != nil {
+		return 0, fmt.Errorf("reading analog variance: %v", err)
+	}
+	return analogVariance, nil
+}
+
+//	sensorOutput runs command and returns its output; the command is killed
+//	after SensorReadTimeout and always waited for, so none is left behind
+func sensorOutput(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SensorReadTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	//Um neto que herdou a saída não pode segurar a espera
+	cmd.WaitDelay = time.Second
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("%s: %v", command, ctx.Err())
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", command, err)
+	}
+	return string(output), nil
 }
 
 func (d *DeviceManager) Network() (network Network) {
@@ -254,3 +281,108 @@ func (d *DeviceManager) IP() (ip string) {
 	}
 	return
 }
+
+//	Memory and disk sizes are in MiB, enough for reporting and stable between samples
+type MemoryUsage struct {
+	Total     uint64 `json:"total"`
+	Available uint64 `json:"available"`
+}
+
+type DiskUsage struct {
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+}
+
+type WirelessSignal struct {
+	Interface string  `json:"interface"`
+	Quality   float64 `json:"quality"`
+	Level     float64 `json:"level"` //dBm
+}
+
+//	BootTime is when the system started, from the btime line of /proc/stat
+func (d *DeviceManager) BootTime() (time.Time, error) {
+	data, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			seconds, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(seconds, 0).UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("/proc/stat: no btime")
+}
+
+//	Memory reads MemTotal and MemAvailable from /proc/meminfo
+func (d *DeviceManager) Memory() (memory MemoryUsage, err error) {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return memory, err
+	}
+	found := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			memory.Total = kb / 1024
+			found++
+		case "MemAvailable:":
+			memory.Available = kb / 1024
+			found++
+		}
+	}
+	if found != 2 {
+		return memory, fmt.Errorf("/proc/meminfo: missing MemTotal or MemAvailable")
+	}
+	return memory, nil
+}
+
+//	Disk returns the size and free space of the file system holding path
+func (d *DeviceManager) Disk(path string) (disk DiskUsage, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return disk, err
+	}
+	size := uint64(stat.Bsize)
+	return DiskUsage{
+		Total: uint64(stat.Blocks) * size / (1024 * 1024),
+		Free:  uint64(stat.Bavail) * size / (1024 * 1024),
+	}, nil
+}
+
+//	WirelessSignal reads the first interface of /proc/net/wireless, whose
+//	lines after the two of header are like
+//	wlan0: 0000   70.  -40.  -256        0      0      0      0      0        0
+func (d *DeviceManager) WirelessSignal() (signal WirelessSignal, err error) {
+	data, err := ioutil.ReadFile("/proc/net/wireless")
+	if err != nil {
+		return signal, err
+	}
+	for k, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if k < 2 || len(fields) < 4 {
+			continue
+		}
+		signal.Interface = strings.TrimSuffix(fields[0], ":")
+		if signal.Quality, err = strconv.ParseFloat(strings.TrimSuffix(fields[2], "."), 64); err != nil {
+			return signal, err
+		}
+		if signal.Level, err = strconv.ParseFloat(strings.TrimSuffix(fields[3], "."), 64); err != nil {
+			return signal, err
+		}
+		return signal, nil
+	}
+	return signal, fmt.Errorf("/proc/net/wireless: no wireless interface")
+}
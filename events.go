@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	EventRelay    = "relay"
+	EventSensor   = "sensor"
+	EventInfrared = "infrared"
+	EventSchedule = "schedule"
+	//Enviado quando os eventos desde o último ID recebido não estão mais guardados
+	EventReset = "reset"
+
+	//Eventos guardados para clientes que reconectam com Last-Event-ID
+	DefaultEventBuffer = 256
+	ConfigEventBuffer  = "EVENT_BUFFER"
+	//Leituras de sensores, feitas apenas enquanto há clientes conectados
+	DefaultEventSensorInterval = 10 * time.Second
+	ConfigEventSensorInterval  = "EVENT_SENSOR_INTERVAL"
+	EventHeartbeat             = 15 * time.Second
+	//Um cliente que acumula mais eventos que isso é desconectado e deve retomar
+	eventSubscriberBuffer = 64
+)
+
+//	Responsibilities:
+//	*	To push relay, sensor, infrared and schedule events to local clients
+//	EventManager
+type EventManager struct {
+	LogFile *os.File
+	Logger  *log.Logger
+
+	Repository
+	DeviceManager   *DeviceManager
+	InfraredManager *InfraredManager
+	Upgrader        websocket.Upgrader
+
+	events      []Event
+	size        int
+	lastID      uint64
+	subscribers map[*eventSubscriber]struct{}
+	listeners   []func(Event)
+	lock        sync.Mutex
+}
+
+type Event struct {
+	ID    uint64      `json:"id"`
+	Topic string      `json:"topic"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+//	RelayEvent is published with the command when a relay is operated and
+//	with the state when a measured state changes
+type RelayEvent struct {
+	RelayID int    `json:"relay_id"`
+	Name    string `json:"name"`
+	Command string `json:"command,omitempty"`
+	State   string `json:"state,omitempty"`
+}
+
+type SensorEvent struct {
+	Temperature    float64 `json:"temperature"`
+	AnalogVariance float64 `json:"analog_variance"`
+}
+
+type ScheduleEvent struct {
+	ScheduleID int    `json:"schedule_id"`
+	Type       string `json:"type"`
+	MacroID    int    `json:"macro_id,omitempty"`
+	Run        int    `json:"run,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type eventSubscriber struct {
+	topics map[string]bool
+	events chan Event
+}
+
+func NewEventManager() *EventManager {
+	return &EventManager{
+		subscribers: make(map[*eventSubscriber]struct{}),
+	}
+}
+
+func (em *EventManager) Initialize(logPath string, repository Repository, deviceManager *DeviceManager, infraredManager *InfraredManager) error {
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	em.LogFile = f
+	em.Logger = log.New(em.LogFile, "", log.Ldate|log.Ltime)
+	em.Repository = repository
+	em.DeviceManager = deviceManager
+	em.InfraredManager = infraredManager
+	em.size = envInt(ConfigEventBuffer, DefaultEventBuffer)
+	//Mesma política do restante da API, que responde a qualquer origem
+	em.Upgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	em.Logger.Printf("EventManager started.\n")
+	return nil
+}
+
+func (em *EventManager) Close() {
+	em.Logger.Printf("EventManager closed.\n")
+	em.LogFile.Close()
+}
+
+//	Publish stores an event and sends it to the subscribers of topic and to
+//	the listeners
+func (em *EventManager) Publish(topic string, data interface{}) {
+	em.lock.Lock()
+	em.lastID++
+	event := Event{ID: em.lastID, Topic: topic, Time: time.Now(), Data: data}
+	em.events = append(em.events, event)
+	if len(em.events) > em.size {
+		em.events = append(em.events[:0], em.events[len(em.events)-em.size:]...)
+	}
+	for s := range em.subscribers {
+		if len(s.topics) > 0 && !s.topics[topic] {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			em.Logger.Printf("dropping slow event subscriber.\n")
+			delete(em.subscribers, s)
+			close(s.events)
+		}
+	}
+	listeners := em.listeners
+	em.lock.Unlock()
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+//	Listen calls f with every event published from now on, from the
+//	publishing goroutine. Unlike subscribers, listeners are never dropped and
+//	do not start the sensor readings
+func (em *EventManager) Listen(f func(Event)) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+	em.listeners = append(em.listeners, f)
+}
+
+//	Subscribe returns the stored events after lastID, when resuming, and a
+//	channel with the next ones; it is closed when the subscriber falls behind
+//	or the manager stops. An empty topics receives every topic
+func (em *EventManager) Subscribe(topics []string, lastID uint64, resume bool) (backlog []Event, events <-chan Event, cancel func()) {
+	s := &eventSubscriber{
+		topics: make(map[string]bool),
+		events: make(chan Event, eventSubscriberBuffer),
+	}
+	for _, topic := range topics {
+		s.topics[topic] = true
+	}
+	em.lock.Lock()
+	defer em.lock.Unlock()
+	if resume {
+		//IDs recomeçam quando o processo reinicia, e os antigos saem do buffer
+		lost := lastID > em.lastID
+		if len(em.events) > 0 && lastID+1 < em.events[0].ID {
+			lost = true
+		}
+		if lost {
+			lastID = 0
+			backlog = append(backlog, Event{Topic: EventReset, Time: time.Now()})
+		}
+		for _, event := range em.events {
+			if event.ID > lastID && (len(s.topics) == 0 || s.topics[event.Topic]) {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+	em.subscribers[s] = struct{}{}
+	return backlog, s.events, func() {
+		em.lock.Lock()
+		defer em.lock.Unlock()
+		if _, ok := em.subscribers[s]; ok {
+			delete(em.subscribers, s)
+			close(s.events)
+		}
+	}
+}
+
+func (em *EventManager) subscribed() bool {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+	return len(em.subscribers) > 0
+}
+
+//	Run publishes received infrared frames and, while there are clients,
+//	sensor readings and measured relay state changes, so that a single
+//	reading serves every client. When ctx is done every stream is closed
+func (em *EventManager) Run(ctx context.Context) {
+	frames, cancel := em.InfraredManager.Subscribe()
+	defer cancel()
+	ticker := time.NewTicker(envInterval(ConfigEventSensorInterval, DefaultEventSensorInterval))
+	defer ticker.Stop()
+	states := make(map[int]string)
+	for {
+		select {
+		case <-ctx.Done():
+			em.lock.Lock()
+			for s := range em.subscribers {
+				delete(em.subscribers, s)
+				close(s.events)
+			}
+			em.lock.Unlock()
+			return
+		case decoded := <-frames:
+			em.Publish(EventInfrared, decoded)
+		case <-ticker.C:
+			if !em.subscribed() {
+				continue
+			}
+			em.sample(states)
+		}
+	}
+}
+
+//	sample publishes a reading of the sensors; a failed reading is skipped,
+//	so that a broken sensor does not hold the infrared frames and the close
+func (em *EventManager) sample(states map[int]string) {
+	temperature, err := em.DeviceManager.ReadTemperature()
+	if err != nil {
+		em.Logger.Printf("%v\n", err)
+		return
+	}
+	analogVariance, err := em.DeviceManager.ReadAnalogVariance()
+	if err != nil {
+		em.Logger.Printf("%v\n", err)
+		return
+	}
+	reading := SensorEvent{
+		Temperature:    temperature,
+		AnalogVariance: analogVariance,
+	}
+	em.Publish(EventSensor, reading)
+	relays, err := em.Repository.ReadRelay()
+	if err != nil {
+		em.Logger.Printf("reading relays: %v\n", err)
+		return
+	}
+	for _, relay := range relays {
+		if relay.Type != TypeLamp {
+			continue
+		}
+		state := lampState(relay, reading.AnalogVariance)
+		if states[relay.ID] != state {
+			states[relay.ID] = state
+			em.Publish(EventRelay, RelayEvent{RelayID: relay.ID, Name: relay.Name, State: state})
+		}
+	}
+}
+
+//	subscription reads ?topics=relay,sensor and the last event ID, from the
+//	Last-Event-ID header sent by EventSource or ?last_event_id=
+func subscription(r *http.Request) (topics []string, lastID uint64, resume bool, err error) {
+	if value := r.URL.Query().Get("topics"); value != "" {
+		for _, topic := range strings.Split(value, ",") {
+			switch topic = strings.TrimSpace(topic); topic {
+			case EventRelay, EventSensor, EventInfrared, EventSchedule:
+				topics = append(topics, topic)
+			default:
+				return nil, 0, false, fmt.Errorf("unknown topic %q", topic)
+			}
+		}
+	}
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	if value == "" {
+		return topics, 0, false, nil
+	}
+	lastID, err = strconv.ParseUint(value, 10, 64)
+	return topics, lastID, err == nil, err
+}
+
+//	StreamHandler sends the events as Server-Sent Events
+func (em *EventManager) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	topics, lastID, resume, err := subscription(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	backlog, events, cancel := em.Subscribe(topics, lastID, resume)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	write := func(event Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if event.ID != 0 {
+			fmt.Fprintf(w, "id: %d\n", event.ID)
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Topic, data)
+		return err
+	}
+	for _, event := range backlog {
+		if err := write(event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	heartbeat := time.NewTicker(EventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := write(event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			//Comentário, ignorado pelo EventSource, que mantém proxies conectados
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+//	WebsocketHandler sends the events as JSON messages
+func (em *EventManager) WebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	topics, lastID, resume, err := subscription(r)
+	if err != nil {
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	c, err := em.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		em.Logger.Printf("upgrading event stream: %v\n", err)
+		return
+	}
+	defer c.Close()
+	backlog, events, cancel := em.Subscribe(topics, lastID, resume)
+	defer cancel()
+
+	//Mensagens do cliente são ignoradas; a leitura detecta o fechamento e os pongs
+	c.SetReadDeadline(time.Now().Add(EventHeartbeat * 2))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(EventHeartbeat * 2))
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	write := func(event Event) error {
+		c.SetWriteDeadline(time.Now().Add(TelemetryWriteWait))
+		return c.WriteJSON(event)
+	}
+	for _, event := range backlog {
+		if err := write(event); err != nil {
+			return
+		}
+	}
+	heartbeat := time.NewTicker(EventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case event, ok := <-events:
+			if !ok {
+				c.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+					time.Now().Add(TelemetryWriteWait))
+				return
+			}
+			if err := write(event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(TelemetryWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
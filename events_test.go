@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestEventSample(t *testing.T) {
+	defer func(temperature, analogVariance string) {
+		temperatureCommand, analogVarianceCommand = temperature, analogVariance
+	}(temperatureCommand, analogVarianceCommand)
+	logger := log.New(ioutil.Discard, "", 0)
+	em := NewEventManager()
+	em.Logger = logger
+	em.DeviceManager = &DeviceManager{Logger: logger}
+	em.Repository = &telemetryRepository{relays: []Relay{
+		{ID: 1, Name: "sala", Type: TypeLamp},
+		{ID: 2, Name: "portão", Type: "gate"},
+	}}
+	var events []Event
+	em.Listen(func(event Event) { events = append(events, event) })
+	states := make(map[int]string)
+
+	temperatureCommand, analogVarianceCommand = "echo \"temp=48.3'C\"", "echo 0.010"
+	em.sample(states)
+	if len(events) != 2 || events[0].Topic != EventSensor || events[1].Topic != EventRelay {
+		t.Fatalf("published %+v, want a reading and the lamp state", events)
+	}
+	if reading := events[0].Data.(SensorEvent); reading.Temperature != 48.3 || reading.AnalogVariance != 0.010 {
+		t.Errorf("reading %+v", reading)
+	}
+	if relay := events[1].Data.(RelayEvent); relay.RelayID != 1 || relay.State != RelayOn {
+		t.Errorf("relay event %+v", relay)
+	}
+
+	//Estados iguais não são publicados de novo e leituras com falha são puladas
+	em.sample(states)
+	temperatureCommand = "exit 1"
+	em.sample(states)
+	temperatureCommand, analogVarianceCommand = "echo \"temp=48.3'C\"", "echo garbage"
+	em.sample(states)
+	if len(events) != 3 {
+		t.Errorf("published %+v, want one more reading", events[2:])
+	}
+}
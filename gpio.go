@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+
+	rpio "github.com/stianeikeland/go-rpio"
+)
+
+//	rpio maps the GPIO registers globally, so a Close while another goroutine
+//	is still reading a pin would unmap the memory under it
+var (
+	gpioLock  sync.Mutex
+	gpioUsers int
+)
+
+//	openGPIO maps the GPIO registers on first use
+func openGPIO() error {
+	gpioLock.Lock()
+	defer gpioLock.Unlock()
+	if gpioUsers == 0 {
+		if err := rpio.Open(); err != nil {
+			return err
+		}
+	}
+	gpioUsers++
+	return nil
+}
+
+//	closeGPIO unmaps the GPIO registers once the last user is done
+func closeGPIO() {
+	gpioLock.Lock()
+	defer gpioLock.Unlock()
+	gpioUsers--
+	if gpioUsers == 0 {
+		rpio.Close()
+	}
+}
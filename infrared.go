@@ -1,23 +1,15 @@
 package main
 
-/*
-#cgo CFLAGS: -I${SRCDIR}/c -g -Wall
-#cgo LDFLAGS: -L${SRCDIR}/c -linfrared -lm -lpigpio -pthread -lrt
-#include <stdlib.h>
-#include <infrared.h>
-*/
-import "C"
 import (
-	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"strconv"
+	"sync"
 	"time"
-	"unsafe"
 
 	"github.com/gorilla/mux"
 )
@@ -25,7 +17,7 @@ import (
 const (
 	TypeRGB = "rgb"
 	TypeTV  = "tv"
-	TypeAC = "ac"
+	TypeAC  = "ac"
 )
 
 //	Responsibilities:
@@ -34,19 +26,53 @@ const (
 type InfraredManager struct {
 	LogFile *os.File
 	Logger  *log.Logger
+
+	Repository
+	Receiver    IRReceiver
+	Transmitter IRTransmitter
+	DutyCycle   float64
+	//Tempo máximo aguardando um sinal em Receive, com ou sem o Listen
+	ReceiveTimeout time.Duration
+
+	learning     map[string]*learnSession
+	learners     int
+	learningLock sync.Mutex
+
+	listening       bool
+	subscribers     map[chan Decoded]struct{}
+	subscribersLock sync.Mutex
+
+	emitters     map[int]chan struct{}
+	emittersLock sync.Mutex
+
+	queues     map[int]chan transmission
+	queuesLock sync.Mutex
 }
 
 func NewInfraredManager() *InfraredManager {
 	return &InfraredManager{}
 }
 
-func (i *InfraredManager) Initialize(logPath string) (err error) {
+func (i *InfraredManager) Initialize(logPath string, repository Repository) (err error) {
 	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
 	i.LogFile = f
 	i.Logger = log.New(i.LogFile, "", log.Ldate|log.Ltime)
+	i.Repository = repository
+	i.Receiver = NewGPIOReceiver(envInt(ConfigIRReceivePin, DefaultIRReceivePin))
+	i.ReceiveTimeout = envDuration(ConfigIRReceiveTimeout, DefaultIRReceiveTimeout)
+	i.Transmitter = NewPlatformTransmitter()
+	if platformTransmitterWarning != "" {
+		log.Printf("InfraredManager: %s\n", platformTransmitterWarning)
+		i.Logger.Printf("InfraredManager#Initialize(): %s\n", platformTransmitterWarning)
+	}
+	i.DutyCycle = envFloat(ConfigIRDutyCycle, DefaultIRDutyCycle)
+	i.learning = make(map[string]*learnSession)
+	i.subscribers = make(map[chan Decoded]struct{})
+	i.emitters = make(map[int]chan struct{})
+	i.queues = make(map[int]chan transmission)
 	i.Logger.Printf("InfraredManager started.\n")
 	return nil
 }
@@ -61,6 +87,7 @@ type Infrared struct {
 
 	Name     string    `json:"name"`
 	Type     string    `json:"type"`
+	Model    string    `json:"model"`
 	Pin      int       `json:"pin"`
 	Commands []Command `json:"commands"`
 
@@ -73,106 +100,238 @@ type Command struct {
 	ID         int `json:"id" gorm:"primary_key"`
 	InfraredID int `json:"infrared_id"`
 
-	Code   string `json:"code"`
-	Button int    `json:"button"`
+	Name      string `json:"name"`
+	Protocol  string `json:"protocol"`
+	Code      string `json:"code"`
+	Timings   string `json:"timings"`
+	Frequency int    `json:"frequency"`
+	Button    int    `json:"button"`
 }
 
-func (i *InfraredManager) Send(pin, signal string) {
-	cPin := C.CString(pin)
-	defer C.free(unsafe.Pointer(cPin))
+//	SendTimings queues marks and spaces, in microseconds, modulated at frequency
+//	and waits until they are sent or ctx is done
+//	The frame is queued holding the emitter, so that it never lands in the
+//	middle of the frames of a macro or of SetRGB
+func (i *InfraredManager) SendTimings(ctx context.Context, pin, frequency int, timings []int) error {
+	send, err := i.timingsFrame(pin, frequency, timings)
+	if err != nil {
+		return err
+	}
+	release, err := i.LockEmitter(ctx, pin)
+	if err != nil {
+		return err
+	}
+	t, err := i.enqueue(ctx, pin, send)
+	release()
+	if err != nil {
+		return err
+	}
+	return i.wait(pin, t)
+}
 
-	cSignal := C.CString(signal)
-	defer C.free(unsafe.Pointer(cSignal))
+//	sendTimings is SendTimings for callers already holding the emitter
+func (i *InfraredManager) sendTimings(ctx context.Context, pin, frequency int, timings []int) error {
+	send, err := i.timingsFrame(pin, frequency, timings)
+	if err != nil {
+		return err
+	}
+	return i.transmit(ctx, pin, send)
+}
 
-	undefined := C.send(cPin, cSignal)
-	response := int(undefined)
+func (i *InfraredManager) timingsFrame(pin, frequency int, timings []int) (send func() error, err error) {
+	if len(timings) == 0 {
+		return nil, fmt.Errorf("sending ir timings: empty frame")
+	}
+	pulses, err := Waveform(pin, frequency, i.DutyCycle, timings)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		i.Logger.Printf("sending ir timings: %d pulses on pin %d at %d Hz\n", len(pulses), pin, frequency)
+		return i.Transmitter.Transmit(pin, pulses)
+	}, nil
+}
 
-	i.Logger.Printf("sending ir signal: received from c function: %d\n", response)
+//	LockEmitter waits until no one else holds the emitter on pin, or until ctx is done
+//	release must be called once the frames are sent
+func (i *InfraredManager) LockEmitter(ctx context.Context, pin int) (release func(), err error) {
+	i.emittersLock.Lock()
+	emitter, ok := i.emitters[pin]
+	if !ok {
+		emitter = make(chan struct{}, 1)
+		i.emitters[pin] = emitter
+	}
+	i.emittersLock.Unlock()
+	select {
+	case emitter <- struct{}{}:
+		return func() { <-emitter }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
-	/* done := false
-	for !done {
-		cli := fmt.Sprintf("sudo /home/pi/go/src/joaowiciuk/juggernaut/c/./irsend %s %s", pin, signal)
-		cmd := exec.Command("/bin/sh", "-c", cli)
-		if err := cmd.Start(); err != nil {
-			i.Logger.Printf("sending ir signal: %v\n", err)
-			continue
-		}
-		if err := cmd.Wait(); err != nil {
-			i.Logger.Printf("sending ir signal: %v\n", err)
-			continue
+//	Receive captures and decodes one frame, giving up after ReceiveTimeout
+//	with ErrCaptureTimeout or when ctx is done
+//	While the background listener runs, the next frame it decodes is returned instead
+func (i *InfraredManager) Receive(ctx context.Context) (decoded Decoded, err error) {
+	if i.ReceiveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.ReceiveTimeout)
+		defer cancel()
+	}
+	i.subscribersLock.Lock()
+	listening := i.listening
+	i.subscribersLock.Unlock()
+	if listening {
+		frames, cancel := i.Subscribe()
+		defer cancel()
+		for {
+			select {
+			case decoded = <-frames:
+				//Quadros de repetição pertencem ao botão ainda pressionado
+				if !decoded.Repeat {
+					return decoded, nil
+				}
+			case <-ctx.Done():
+				return decoded, captureError(ctx)
+			}
 		}
-		done = true
-	} */
-}
+	}
 
-func (i *InfraredManager) Receive() (received string) {
-	cmd := exec.Command("/bin/sh", "-c", "sudo /home/pi/go/src/joaowiciuk/juggernaut/c/./irreceive")
-	stdout, err := cmd.StdoutPipe()
+	timings, err := i.Receiver.Capture(ctx)
 	if err != nil {
-		i.Logger.Printf("receiving ir: %s\n", err)
-		return "0"
-	}
-	if err := cmd.Start(); err != nil {
-		i.Logger.Printf("receiving ir: %s\n", err)
-		return "0"
-	}
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(stdout)
-	if err := cmd.Wait(); err != nil {
-		i.Logger.Printf("receiving ir: %s\n", err)
-		return "0"
-	}
-	var previousPolarity string
-	var previousMicros int64
-	tolerance := int64(250)
-	for {
-		symbol, err := buf.ReadString(0x0A)
-		if err == io.EOF {
-			break
-		}
+		return decoded, err
+	}
+	decoded = Decode(timings)
+	i.Logger.Printf("received ir: %s\n", decoded)
+	return decoded, nil
+}
 
-		if symbol[0:len(symbol)-1] == "end" {
-			break
+//	Listen captures frames continuously until ctx is done and hands every
+//	decoded frame to the subscribers
+//	Between frames the receiver sleeps waiting for an edge, so an idle
+//	listener costs next to no CPU
+func (i *InfraredManager) Listen(ctx context.Context) {
+	i.subscribersLock.Lock()
+	i.listening = true
+	i.subscribersLock.Unlock()
+	defer func() {
+		i.subscribersLock.Lock()
+		i.listening = false
+		i.subscribersLock.Unlock()
+	}()
+	i.Logger.Printf("InfraredManager#Listen(): listening for frames.\n")
+	for ctx.Err() == nil {
+		timings, err := i.Receiver.Capture(ctx)
+		if err == ErrCaptureTimeout || ctx.Err() != nil {
+			continue
 		}
-
-		if symbol[0:len(symbol)-1] == "start" {
+		if err != nil {
+			i.Logger.Printf("listening ir: %v\n", err)
+			irReceiveErrors.Inc()
+			time.Sleep(time.Second)
 			continue
 		}
+		decoded := Decode(timings)
+		i.Logger.Printf("received ir: %s\n", decoded)
+		irReceived.Inc(decoded.Protocol)
+		i.publish(decoded)
+	}
+	i.Logger.Printf("InfraredManager#Listen(): stopped.\n")
+}
 
-		currentPolarity := symbol[0:1]
-		currentMicros, _ := strconv.ParseInt(symbol[2:len(symbol)-1], 10, 64)
+//	Subscribe returns a channel receiving every frame decoded by Listen
+//	Frames are dropped for subscribers that are not keeping up
+func (i *InfraredManager) Subscribe() (frames <-chan Decoded, cancel func()) {
+	c := make(chan Decoded, 8)
+	i.subscribersLock.Lock()
+	i.subscribers[c] = struct{}{}
+	i.subscribersLock.Unlock()
+	return c, func() {
+		i.subscribersLock.Lock()
+		delete(i.subscribers, c)
+		i.subscribersLock.Unlock()
+	}
+}
 
-		if currentPolarity == "0" && (currentMicros < 562+tolerance && currentMicros > 562-tolerance) &&
-			previousPolarity == "1" && (previousMicros < 562+tolerance && previousMicros > 562-tolerance) {
-			received = received + "0"
+func (i *InfraredManager) publish(decoded Decoded) {
+	i.subscribersLock.Lock()
+	defer i.subscribersLock.Unlock()
+	for c := range i.subscribers {
+		select {
+		case c <- decoded:
+		default:
 		}
-		if currentPolarity == "0" && (currentMicros < 1687+tolerance && currentMicros > 1687-tolerance) &&
-			previousPolarity == "1" && (previousMicros < 562+tolerance && previousMicros > 562-tolerance) {
-			received = received + "1"
-		}
-
-		i.Logger.Printf("%s %d\n", currentPolarity, currentMicros)
-
-		previousPolarity = currentPolarity
-		previousMicros = currentMicros
 	}
-	return received
 }
 
+//	SendHandler sends a bit string of any length with NEC timings, as the
+//	irSling sender of the first versions did
 func (i *InfraredManager) SendHandler(w http.ResponseWriter, r *http.Request) {
-	pin := mux.Vars(r)["pin"]
-	signal := mux.Vars(r)["signal"]
-	i.Send(pin, signal)
 	w.Header().Add("Access-Control-Allow-Origin", "*")
+	pin, err := strconv.Atoi(mux.Vars(r)["pin"])
+	if err != nil {
+		i.Logger.Printf("sending ir signal: invalid pin %q\n", mux.Vars(r)["pin"])
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	timings, err := SignalTimings(mux.Vars(r)["signal"])
+	if err != nil {
+		i.Logger.Printf("sending ir signal: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := i.SendTimings(r.Context(), pin, ProtocolFrequency[ProtocolNEC], timings); err != nil {
+		i.Logger.Printf("sending ir signal: %v\n", err)
+		w.WriteHeader(transmitStatus(err))
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
+//	ReceiveHandler answers the code of the next frame, the bit string for NEC,
+//	or 0 when nothing is received
 func (i *InfraredManager) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Origin", "*")
-	fmt.Fprintf(w, "%s", i.Receive())
+	decoded, err := i.Receive(r.Context())
+	if err != nil {
+		i.Logger.Printf("receiving ir: %v\n", err)
+		fmt.Fprintf(w, "0")
+		return
+	}
+	fmt.Fprintf(w, "%s", decoded.Code)
+}
+
+//	DecodeHandler answers the next frame as a Decoded, with the protocol,
+//	address and command
+func (i *InfraredManager) DecodeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	decoded, err := i.Receive(r.Context())
+	if err != nil {
+		i.Logger.Printf("receiving ir: %v\n", err)
+		w.WriteHeader(receiveStatus(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(decoded); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
 
 func (i *InfraredManager) IOHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Origin", "*")
-	fmt.Fprintf(w, "%s", i.Receive())
+	decoded, err := i.Receive(r.Context())
+	if err != nil {
+		i.Logger.Printf("receiving ir: %v\n", err)
+		fmt.Fprintf(w, "0")
+		return
+	}
+	fmt.Fprintf(w, "%s", decoded.Code)
+}
+
+func receiveStatus(err error) int {
+	if err == ErrCaptureTimeout {
+		return http.StatusRequestTimeout
+	}
+	return http.StatusInternalServerError
 }
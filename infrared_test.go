@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//	infraredRepository keeps devices and their learned commands in memory
+type infraredRepository struct {
+	Repository
+	devices   map[int]Infrared
+	commands  []Command
+	bindings  []Binding
+	acStates  map[int]ACState
+	rgbStates map[int]RGBState
+	lock      sync.Mutex
+}
+
+func newInfraredRepository(devices ...Infrared) *infraredRepository {
+	r := &infraredRepository{devices: make(map[int]Infrared), acStates: make(map[int]ACState), rgbStates: make(map[int]RGBState)}
+	for _, device := range devices {
+		r.devices[device.ID] = device
+	}
+	return r
+}
+
+func (r *infraredRepository) ReadInfraredByID(id int) (Infrared, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	device, ok := r.devices[id]
+	if !ok {
+		return device, ErrNotFound
+	}
+	return device, nil
+}
+
+func (r *infraredRepository) ReadCommand(infraredID, button int) (Command, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, command := range r.commands {
+		if command.InfraredID == infraredID && command.Button == button {
+			return command, nil
+		}
+	}
+	return Command{}, ErrNotFound
+}
+
+func (r *infraredRepository) WriteCommand(command Command) (Command, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for k, c := range r.commands {
+		if c.InfraredID == command.InfraredID && c.Button == command.Button {
+			command.ID = c.ID
+			r.commands[k] = command
+			return command, nil
+		}
+	}
+	command.ID = len(r.commands) + 1
+	r.commands = append(r.commands, command)
+	return command, nil
+}
+
+//	testInfraredManager receives frames from a TimingReceiver and records
+//	the frames sent
+func testInfraredManager(t *testing.T, frames ...[]int) (*InfraredManager, *RecordingTransmitter) {
+	t.Helper()
+	transmitter := NewRecordingTransmitter()
+	i := NewInfraredManager()
+	i.Logger = log.New(ioutil.Discard, "", 0)
+	i.Receiver = NewTimingReceiver(frames...)
+	i.Transmitter = transmitter
+	i.DutyCycle = DefaultIRDutyCycle
+	i.learning = make(map[string]*learnSession)
+	i.subscribers = make(map[chan Decoded]struct{})
+	i.emitters = make(map[int]chan struct{})
+	i.queues = make(map[int]chan transmission)
+	return i, transmitter
+}
+
+func TestReceiveHandlers(t *testing.T) {
+	code := NECCode(0x04, 0x08)
+	timings, err := Encode(ProtocolNEC, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, _ := testInfraredManager(t, timings, timings)
+
+	w := httptest.NewRecorder()
+	i.ReceiveHandler(w, httptest.NewRequest("GET", "/api/infrared/receive", nil))
+	if w.Body.String() != code {
+		t.Errorf("receive answered %q, want the bit string %q", w.Body.String(), code)
+	}
+
+	w = httptest.NewRecorder()
+	i.DecodeHandler(w, httptest.NewRequest("GET", "/api/infrared/decode", nil))
+	var decoded Decoded
+	if err := json.Unmarshal(w.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("decode answered %q: %v", w.Body.String(), err)
+	}
+	if decoded.Protocol != ProtocolNEC || decoded.Code != code {
+		t.Errorf("decode answered %+v", decoded)
+	}
+
+	//Sem sinal a resposta legada continua sendo 0
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	w = httptest.NewRecorder()
+	i.ReceiveHandler(w, httptest.NewRequest("GET", "/api/infrared/receive", nil).WithContext(ctx))
+	if w.Body.String() != "0" {
+		t.Errorf("receive without signal answered %q, want 0", w.Body.String())
+	}
+}
+
+//	TestEmitterLock checks that no sender lands a frame on an emitter held by
+//	someone else, while the holder itself sends through the lock-free path
+func TestEmitterLock(t *testing.T) {
+	i, transmitter := testInfraredManager(t)
+	i.Repository = newInfraredRepository()
+	tv := Infrared{ID: 1, Pin: 17}
+	rgb := Infrared{ID: 2, Type: TypeRGB, Model: RGBModel24, Pin: 17}
+	other := Infrared{ID: 3, Pin: 18}
+	//Um quadro curto, distinguível dos quadros NEC do controle RGB
+	button := Command{Protocol: ProtocolRaw, Timings: "900 450 560"}
+
+	release, err := i.LockEmitter(context.Background(), 17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error, 2)
+	go func() { sent <- i.SendCommand(context.Background(), tv, button) }()
+	go func() {
+		_, err := i.SetRGB(context.Background(), rgb, RGBRequest{Color: "#ff0000"})
+		sent <- err
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	if err := i.SendCommand(ctx, tv, button); err != context.DeadlineExceeded {
+		t.Errorf("send on a held emitter: %v, want context.DeadlineExceeded", err)
+	}
+	cancel()
+	if err := i.SendCommand(context.Background(), other, button); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.sendCommand(context.Background(), tv, button); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if pins := sentPins(transmitter); len(pins) != 2 || pins[0] != 18 || pins[1] != 17 {
+		t.Fatalf("sent on pins %v while 17 was held, want the other emitter and the holder", pins)
+	}
+
+	release()
+	for k := 0; k < 2; k++ {
+		if err := <-sent; err != nil {
+			t.Fatal(err)
+		}
+	}
+	//As duas teclas do RGB (ligar e cor) chegam juntas, antes ou depois do botão
+	var lengths []int
+	for _, frame := range transmitter.Frames()[2:] {
+		lengths = append(lengths, len(frame.Pulses))
+	}
+	if len(lengths) != 3 || lengths[1] != lengths[0] && lengths[1] != lengths[2] {
+		t.Errorf("pulses per frame %v: the rgb presses were interleaved", lengths)
+	}
+}
+
+func TestSendHandler(t *testing.T) {
+	i, transmitter := testInfraredManager(t)
+	tests := []struct {
+		pin, signal string
+		status      int
+	}{
+		{"17", "1010", http.StatusOK},
+		{"17", NECCode(0x04, 0x08), http.StatusOK},
+		{"x", "1010", http.StatusBadRequest},
+		{"17", "10a0", http.StatusBadRequest},
+		{"32", "1010", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{"pin": tt.pin, "signal": tt.signal})
+		i.SendHandler(w, r)
+		if w.Code != tt.status {
+			t.Errorf("pin %s signal %s: status %d, want %d", tt.pin, tt.signal, w.Code, tt.status)
+		}
+	}
+	frames := transmitter.Frames()
+	if len(frames) != 2 {
+		t.Fatalf("%d frames sent, want 2", len(frames))
+	}
+	timings, _ := SignalTimings("1010")
+	want, _ := Waveform(17, ProtocolFrequency[ProtocolNEC], DefaultIRDutyCycle, timings)
+	if frames[0].Pin != 17 || !reflect.DeepEqual(frames[0].Pulses, want) {
+		t.Errorf("sent %d pulses on pin %d, want the 4 bit frame on 17", len(frames[0].Pulses), frames[0].Pin)
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	ProtocolNEC     = "nec"
+	ProtocolSamsung = "samsung"
+	ProtocolSIRC    = "sirc"
+	ProtocolRC5     = "rc5"
+	ProtocolRC6     = "rc6"
+	ProtocolRaw     = "raw"
+)
+
+const (
+	//Espaço mínimo, em microssegundos, que separa dois quadros consecutivos
+	FrameGap = 10000
+	//Tolerância relativa para sinais de distância de pulso (NEC, Samsung, SIRC)
+	PulseTolerance = 0.4
+	//Tolerância relativa para sinais bifásicos (RC5, RC6)
+	ManchesterTolerance = 0.3
+)
+
+//	Decoded is the result of decoding one infrared frame
+//	Timings alternate mark and space durations in microseconds, starting with a mark
+type Decoded struct {
+	Protocol   string  `json:"protocol"`
+	Address    uint32  `json:"address"`
+	Command    uint32  `json:"command"`
+	Bits       int     `json:"bits"`
+	Code       string  `json:"code"`
+	Repeat     bool    `json:"repeat"`
+	Toggle     bool    `json:"toggle"`
+	Confidence float64 `json:"confidence"`
+	Timings    []int   `json:"timings,omitempty"`
+}
+
+func (d Decoded) String() string {
+	if d.Protocol == ProtocolRaw {
+		return fmt.Sprintf("Decoded{Protocol: %s, Timings: %d}", d.Protocol, len(d.Timings))
+	}
+	return fmt.Sprintf("Decoded{Protocol: %s, Address: 0x%X, Command: 0x%X, Bits: %d, Repeat: %t, Confidence: %.2f}",
+		d.Protocol, d.Address, d.Command, d.Bits, d.Repeat, d.Confidence)
+}
+
+//	Decode identifies the protocol of the first frame found in timings
+//	Falls back to ProtocolRaw when no known protocol matches
+func Decode(timings []int) Decoded {
+	frames := SplitFrames(timings)
+	if len(frames) == 0 {
+		return Decoded{Protocol: ProtocolRaw}
+	}
+	return DecodeFrame(frames[0])
+}
+
+//	DecodeAll decodes every frame found in timings, including repeat codes
+func DecodeAll(timings []int) []Decoded {
+	frames := SplitFrames(timings)
+	decoded := make([]Decoded, 0, len(frames))
+	for _, frame := range frames {
+		decoded = append(decoded, DecodeFrame(frame))
+	}
+	return decoded
+}
+
+//	DecodeFrame decodes a single frame, without leading or trailing spaces
+func DecodeFrame(frame []int) Decoded {
+	decoders := []func([]int) (Decoded, bool){
+		decodeNEC,
+		decodeSamsung,
+		decodeSIRC,
+		decodeRC6,
+		decodeRC5,
+	}
+	for _, decoder := range decoders {
+		if decoded, ok := decoder(frame); ok {
+			decoded.Timings = frame
+			return decoded
+		}
+	}
+	return Decoded{
+		Protocol: ProtocolRaw,
+		Timings:  frame,
+	}
+}
+
+//	SplitFrames removes leading and trailing spaces and splits timings on long gaps
+func SplitFrames(timings []int) (frames [][]int) {
+	frames = make([][]int, 0)
+	start := 0
+	for i := 1; i < len(timings); i += 2 {
+		if timings[i] >= FrameGap {
+			if i > start {
+				frames = append(frames, timings[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(timings) {
+		frame := timings[start:]
+		if len(frame)%2 == 0 {
+			frame = frame[:len(frame)-1]
+		}
+		if len(frame) > 0 {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+//	matcher accumulates the relative error of every matched duration
+type matcher struct {
+	tolerance float64
+	errSum    float64
+	n         int
+}
+
+func (m *matcher) match(actual, expected int) bool {
+	diff := math.Abs(float64(actual-expected)) / float64(expected)
+	if diff > m.tolerance {
+		return false
+	}
+	m.errSum += diff
+	m.n++
+	return true
+}
+
+func (m *matcher) confidence() float64 {
+	if m.n == 0 {
+		return 0
+	}
+	return math.Max(0, 1-m.errSum/float64(m.n))
+}
+
+//	pulseDistance describes protocols that encode bits in the space length
+type pulseDistance struct {
+	protocol    string
+	headerMark  int
+	headerSpace int
+	repeatSpace int
+	bitMark     int
+	zeroSpace   int
+	oneSpace    int
+	bits        int
+}
+
+var (
+	necTiming = pulseDistance{
+		protocol:    ProtocolNEC,
+		headerMark:  9000,
+		headerSpace: 4500,
+		repeatSpace: 2250,
+		bitMark:     562,
+		zeroSpace:   562,
+		oneSpace:    1687,
+		bits:        32,
+	}
+	samsungTiming = pulseDistance{
+		protocol:    ProtocolSamsung,
+		headerMark:  4500,
+		headerSpace: 4500,
+		bitMark:     562,
+		zeroSpace:   562,
+		oneSpace:    1687,
+		bits:        32,
+	}
+)
+
+func (p pulseDistance) decode(frame []int) (decoded Decoded, ok bool) {
+	m := matcher{tolerance: PulseTolerance}
+	if len(frame) < 3 || !m.match(frame[0], p.headerMark) {
+		return decoded, false
+	}
+	if p.repeatSpace > 0 && len(frame) == 3 && m.match(frame[1], p.repeatSpace) && m.match(frame[2], p.bitMark) {
+		return Decoded{
+			Protocol:   p.protocol,
+			Repeat:     true,
+			Confidence: m.confidence(),
+		}, true
+	}
+	if len(frame) != 2*p.bits+3 || !m.match(frame[1], p.headerSpace) {
+		return decoded, false
+	}
+	bits := make([]byte, 0, p.bits)
+	for i := 0; i < p.bits; i++ {
+		if !m.match(frame[2+2*i], p.bitMark) {
+			return decoded, false
+		}
+		switch space := frame[3+2*i]; {
+		case m.match(space, p.zeroSpace):
+			bits = append(bits, '0')
+		case m.match(space, p.oneSpace):
+			bits = append(bits, '1')
+		default:
+			return decoded, false
+		}
+	}
+	if !m.match(frame[len(frame)-1], p.bitMark) {
+		return decoded, false
+	}
+	return Decoded{
+		Protocol:   p.protocol,
+		Bits:       p.bits,
+		Code:       string(bits),
+		Confidence: m.confidence(),
+	}, true
+}
+
+func decodeNEC(frame []int) (Decoded, bool) {
+	decoded, ok := necTiming.decode(frame)
+	if !ok || decoded.Repeat {
+		return decoded, ok
+	}
+	b := lsbBytes(decoded.Code)
+	if b[1] == ^b[0] {
+		decoded.Address = uint32(b[0])
+	} else {
+		//NEC estendido: endereço de 16 bits
+		decoded.Address = uint32(b[0]) | uint32(b[1])<<8
+	}
+	decoded.Command = uint32(b[2])
+	if b[3] != ^b[2] {
+		decoded.Confidence /= 2
+	}
+	return decoded, true
+}
+
+func decodeSamsung(frame []int) (Decoded, bool) {
+	decoded, ok := samsungTiming.decode(frame)
+	if !ok {
+		return decoded, false
+	}
+	b := lsbBytes(decoded.Code)
+	decoded.Address = uint32(b[0])
+	decoded.Command = uint32(b[2])
+	if b[0] != b[1] || b[3] != ^b[2] {
+		decoded.Confidence /= 2
+	}
+	return decoded, true
+}
+
+//	decodeSIRC decodes Sony 12, 15 and 20 bit frames, which encode bits in the mark length
+func decodeSIRC(frame []int) (decoded Decoded, ok bool) {
+	m := matcher{tolerance: PulseTolerance}
+	if len(frame) < 2 || !m.match(frame[0], 2400) || !m.match(frame[1], 600) {
+		return decoded, false
+	}
+	n := (len(frame) - 1) / 2
+	if len(frame)%2 == 0 || (n != 12 && n != 15 && n != 20) {
+		return decoded, false
+	}
+	bits := make([]byte, 0, n)
+	for i := 0; i < n; i++ {
+		switch mark := frame[2+2*i]; {
+		case m.match(mark, 600):
+			bits = append(bits, '0')
+		case m.match(mark, 1200):
+			bits = append(bits, '1')
+		default:
+			return decoded, false
+		}
+		if i < n-1 && !m.match(frame[3+2*i], 600) {
+			return decoded, false
+		}
+	}
+	code := string(bits)
+	return Decoded{
+		Protocol:   ProtocolSIRC,
+		Address:    lsbValue(code[7:]),
+		Command:    lsbValue(code[:7]),
+		Bits:       n,
+		Code:       code,
+		Confidence: m.confidence(),
+	}, true
+}
+
+//	decodeRC5 decodes Philips RC5 (and RC5X) frames, Manchester coded with an 889µs half bit
+func decodeRC5(frame []int) (decoded Decoded, ok bool) {
+	m := matcher{tolerance: ManchesterTolerance}
+	//O primeiro meio bit é um espaço invisível
+	halves, ok := expandHalves(frame, 889, 2, &m)
+	if !ok {
+		return decoded, false
+	}
+	halves = append([]bool{false}, halves...)
+	if len(halves)%2 == 1 {
+		halves = append(halves, false)
+	}
+	if len(halves) != 28 {
+		return decoded, false
+	}
+	bits := make([]byte, 0, 14)
+	for i := 0; i < len(halves); i += 2 {
+		switch {
+		case !halves[i] && halves[i+1]:
+			bits = append(bits, '1')
+		case halves[i] && !halves[i+1]:
+			bits = append(bits, '0')
+		default:
+			return decoded, false
+		}
+	}
+	code := string(bits)
+	command := msbValue(code[8:])
+	if code[1] == '0' {
+		//RC5X: o segundo bit de início é o sétimo bit do comando, invertido
+		command |= 1 << 6
+	}
+	return Decoded{
+		Protocol:   ProtocolRC5,
+		Address:    msbValue(code[3:8]),
+		Command:    command,
+		Bits:       14,
+		Code:       code,
+		Toggle:     code[2] == '1',
+		Confidence: m.confidence(),
+	}, true
+}
+
+//	decodeRC6 decodes Philips RC6 frames; the fourth bit after the start bit is a double length trailer
+func decodeRC6(frame []int) (decoded Decoded, ok bool) {
+	m := matcher{tolerance: ManchesterTolerance}
+	if len(frame) < 4 || !m.match(frame[0], 2666) || !m.match(frame[1], 889) {
+		return decoded, false
+	}
+	units, ok := expandHalves(frame[2:], 444, 3, &m)
+	if !ok {
+		return decoded, false
+	}
+	if len(units)%2 == 1 {
+		units = append(units, false)
+	}
+	//bit de início (2), modo (6), trailer (4) e ao menos 16 bits de dados
+	if len(units) < 12+32 {
+		return decoded, false
+	}
+	bits := make([]byte, 0, (len(units)-4)/2)
+	for i := 0; i < len(units); {
+		width := 1
+		if i == 8 {
+			width = 2
+		}
+		if i+2*width > len(units) {
+			return decoded, false
+		}
+		first, second := units[i], units[i+width]
+		for k := 1; k < width; k++ {
+			if units[i+k] != first || units[i+width+k] != second {
+				return decoded, false
+			}
+		}
+		switch {
+		case first && !second:
+			bits = append(bits, '1')
+		case !first && second:
+			bits = append(bits, '0')
+		default:
+			return decoded, false
+		}
+		i += 2 * width
+	}
+	code := string(bits)
+	if code[0] != '1' {
+		return decoded, false
+	}
+	data := code[5:]
+	return Decoded{
+		Protocol:   ProtocolRC6,
+		Address:    msbValue(data[:len(data)-8]),
+		Command:    msbValue(data[len(data)-8:]),
+		Bits:       len(code),
+		Code:       code,
+		Toggle:     code[4] == '1',
+		Confidence: m.confidence(),
+	}, true
+}
+
+//	expandHalves converts timings into a sequence of levels, one per unit, true meaning mark
+func expandHalves(frame []int, unit, maxUnits int, m *matcher) (levels []bool, ok bool) {
+	levels = make([]bool, 0, 2*len(frame))
+	for i, duration := range frame {
+		n := int(math.Floor(float64(duration)/float64(unit) + 0.5))
+		if n < 1 || n > maxUnits || !m.match(duration, n*unit) {
+			return nil, false
+		}
+		for k := 0; k < n; k++ {
+			levels = append(levels, i%2 == 0)
+		}
+	}
+	return levels, true
+}
+
+//	lsbBytes packs a bit string, least significant bit first, into bytes
+func lsbBytes(code string) []byte {
+	b := make([]byte, (len(code)+7)/8)
+	for i := range code {
+		if code[i] == '1' {
+			b[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return b
+}
+
+func lsbValue(code string) (value uint32) {
+	for i := len(code) - 1; i >= 0; i-- {
+		value = value<<1 | uint32(code[i]-'0')
+	}
+	return value
+}
+
+func msbValue(code string) (value uint32) {
+	for i := range code {
+		value = value<<1 | uint32(code[i]-'0')
+	}
+	return value
+}
+
+//	ParseMode2 reads "pulse N" / "space N" lines as written by LIRC mode2 (see doc/remote.md)
+func ParseMode2(r io.Reader) (timings []int, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || (fields[0] != "pulse" && fields[0] != "space") {
+			continue
+		}
+		micros, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing mode2 line %q: %v", scanner.Text(), err)
+		}
+		timings = appendTiming(timings, fields[0] == "pulse", micros)
+	}
+	return timings, scanner.Err()
+}
+
+//	ParseIRReceive reads the "level micros" lines written by c/irreceive
+//	The receiver is active low, so a transition to level 1 ends a mark
+func ParseIRReceive(r io.Reader) (timings []int, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "start" {
+			continue
+		}
+		if line == "end" {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || (fields[0] != "0" && fields[0] != "1") {
+			continue
+		}
+		micros, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing irreceive line %q: %v", line, err)
+		}
+		timings = appendTiming(timings, fields[0] == "1", micros)
+	}
+	return timings, scanner.Err()
+}
+
+//	appendTiming appends a mark or space, merging it with the previous one of the same kind
+//	Leading spaces are dropped so that timings always start with a mark
+func appendTiming(timings []int, mark bool, micros int) []int {
+	if len(timings) == 0 && !mark {
+		return timings
+	}
+	if len(timings)%2 == 1 == mark {
+		timings[len(timings)-1] += micros
+		return timings
+	}
+	return append(timings, micros)
+}
+
+//	FormatTimings writes timings as space separated microseconds, as stored in Command.Timings
+func FormatTimings(timings []int) string {
+	fields := make([]string, len(timings))
+	for i, micros := range timings {
+		fields[i] = strconv.Itoa(micros)
+	}
+	return strings.Join(fields, " ")
+}
+
+//	ParseTimings reads timings written by FormatTimings
+func ParseTimings(s string) (timings []int, err error) {
+	fields := strings.Fields(s)
+	timings = make([]int, len(fields))
+	for i, field := range fields {
+		if timings[i], err = strconv.Atoi(field); err != nil {
+			return nil, fmt.Errorf("parsing timings: %v", err)
+		}
+	}
+	return timings, nil
+}
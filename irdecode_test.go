@@ -0,0 +1,261 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+//	fixture reads the timings of section name ("# Power On") of a capture in doc/
+func fixture(t *testing.T, file, name string) []int {
+	t.Helper()
+	source, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range strings.Split(string(source), "#")[1:] {
+		lines := strings.SplitN(section, "\n", 2)
+		if strings.TrimSpace(lines[0]) != name || len(lines) < 2 {
+			continue
+		}
+		if strings.Contains(lines[1], "pulse") {
+			timings, err := ParseMode2(strings.NewReader(lines[1]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return timings
+		}
+		timings, err := ParseIRReceive(strings.NewReader(lines[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return timings
+	}
+	t.Fatalf("%s: no section %q", file, name)
+	return nil
+}
+
+//	levelTimings converts levels of unit microseconds into timings, without
+//	leading and trailing spaces
+func levelTimings(levels []bool, unit int) (timings []int) {
+	for _, mark := range levels {
+		timings = appendTiming(timings, mark, unit)
+	}
+	if len(timings)%2 == 0 && len(timings) > 0 {
+		timings = timings[:len(timings)-1]
+	}
+	return timings
+}
+
+func pulseDistanceTimings(headerMark, headerSpace int, data []byte) []int {
+	timings := []int{headerMark, headerSpace}
+	for _, b := range data {
+		for i := 0; i < 8; i++ {
+			space := 562
+			if b>>uint(i)&1 == 1 {
+				space = 1687
+			}
+			timings = append(timings, 562, space)
+		}
+	}
+	return append(timings, 562)
+}
+
+func sircTimings(command, address uint32, bits int) []int {
+	timings := []int{2400, 600}
+	value := command | address<<7
+	for i := 0; i < bits; i++ {
+		mark := 600
+		if value>>uint(i)&1 == 1 {
+			mark = 1200
+		}
+		timings = append(timings, mark, 600)
+	}
+	return timings[:len(timings)-1]
+}
+
+//	manchesterLevels appends the levels of bits, most significant first
+//	RC5 sends 1 as space-mark, RC6 as mark-space
+func manchesterLevels(levels []bool, value uint32, bits, width int, oneIsMark bool) []bool {
+	for i := bits - 1; i >= 0; i-- {
+		first := value>>uint(i)&1 == 1
+		if !oneIsMark {
+			first = !first
+		}
+		for k := 0; k < width; k++ {
+			levels = append(levels, first)
+		}
+		for k := 0; k < width; k++ {
+			levels = append(levels, !first)
+		}
+	}
+	return levels
+}
+
+func rc5Timings(address, command uint32, toggle bool) []int {
+	field := uint32(1)
+	if command >= 64 {
+		field = 0
+	}
+	t := uint32(0)
+	if toggle {
+		t = 1
+	}
+	value := 1<<13 | field<<12 | t<<11 | (address&0x1f)<<6 | command&0x3f
+	return levelTimings(manchesterLevels(nil, value, 14, 1, false), 889)
+}
+
+func rc6Timings(address, command uint32, toggle bool) []int {
+	levels := manchesterLevels(nil, 1, 1, 1, true)
+	levels = manchesterLevels(levels, 0, 3, 1, true)
+	t := uint32(0)
+	if toggle {
+		t = 1
+	}
+	levels = manchesterLevels(levels, t, 1, 2, true)
+	levels = manchesterLevels(levels, address<<8|command, 16, 1, true)
+	return append([]int{2666, 889}, levelTimings(levels, 444)...)
+}
+
+//	skew stretches marks and shortens spaces, as TSOP receivers do
+func skew(timings []int, percent int) []int {
+	skewed := make([]int, len(timings))
+	for i, micros := range timings {
+		if i%2 == 0 {
+			skewed[i] = micros * (100 + percent) / 100
+		} else {
+			skewed[i] = micros * (100 - percent) / 100
+		}
+	}
+	return skewed
+}
+
+func TestDecodeFixtures(t *testing.T) {
+	tests := []struct {
+		file, name string
+		want       []Decoded
+	}{
+		{"doc/remote.md", "Power On", []Decoded{
+			{Protocol: ProtocolNEC, Address: 0xEF00, Command: 0x03, Bits: 32, Code: "00000000111101111100000000111111"},
+			{Protocol: ProtocolNEC, Repeat: true},
+		}},
+		{"doc/remote.md", "Power Off", []Decoded{
+			{Protocol: ProtocolNEC, Address: 0xEF00, Command: 0x02, Bits: 32, Code: "00000000111101110100000010111111"},
+		}},
+		{"doc/remote2.md", "Power On", []Decoded{
+			{Protocol: ProtocolNEC, Address: 0xEF00, Command: 0x03, Bits: 32, Code: "00000000111101111100000000111111"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file+"/"+tt.name, func(t *testing.T) {
+			decoded := DecodeAll(fixture(t, tt.file, tt.name))
+			if len(decoded) != len(tt.want) {
+				t.Fatalf("decoded %d frames %v, want %d", len(decoded), decoded, len(tt.want))
+			}
+			for i, want := range tt.want {
+				checkDecoded(t, decoded[i], want)
+			}
+		})
+	}
+}
+
+func TestDecodeProtocols(t *testing.T) {
+	tests := []struct {
+		name    string
+		timings []int
+		want    Decoded
+	}{
+		{"nec", pulseDistanceTimings(9000, 4500, []byte{0x04, 0xFB, 0x08, 0xF7}),
+			Decoded{Protocol: ProtocolNEC, Address: 0x04, Command: 0x08, Bits: 32}},
+		{"nec extended", pulseDistanceTimings(9000, 4500, []byte{0x00, 0xEF, 0x03, 0xFC}),
+			Decoded{Protocol: ProtocolNEC, Address: 0xEF00, Command: 0x03, Bits: 32}},
+		{"nec repeat", []int{9000, 2250, 562},
+			Decoded{Protocol: ProtocolNEC, Repeat: true}},
+		{"nec skewed", skew(pulseDistanceTimings(9000, 4500, []byte{0x04, 0xFB, 0x08, 0xF7}), 15),
+			Decoded{Protocol: ProtocolNEC, Address: 0x04, Command: 0x08, Bits: 32}},
+		{"samsung", pulseDistanceTimings(4500, 4500, []byte{0x07, 0x07, 0x02, 0xFD}),
+			Decoded{Protocol: ProtocolSamsung, Address: 0x07, Command: 0x02, Bits: 32}},
+		{"sirc 12", sircTimings(21, 1, 12),
+			Decoded{Protocol: ProtocolSIRC, Address: 1, Command: 21, Bits: 12}},
+		{"sirc 15", sircTimings(0x2F, 0x1A, 15),
+			Decoded{Protocol: ProtocolSIRC, Address: 0x1A, Command: 0x2F, Bits: 15}},
+		{"sirc 20", sircTimings(0x15, 0x1F3A, 20),
+			Decoded{Protocol: ProtocolSIRC, Address: 0x1F3A, Command: 0x15, Bits: 20}},
+		{"rc5", rc5Timings(0, 12, false),
+			Decoded{Protocol: ProtocolRC5, Address: 0, Command: 12, Bits: 14}},
+		{"rc5 toggle", rc5Timings(5, 35, true),
+			Decoded{Protocol: ProtocolRC5, Address: 5, Command: 35, Bits: 14, Toggle: true}},
+		{"rc5x", rc5Timings(3, 70, false),
+			Decoded{Protocol: ProtocolRC5, Address: 3, Command: 70, Bits: 14}},
+		{"rc6", rc6Timings(0x04, 0x0C, false),
+			Decoded{Protocol: ProtocolRC6, Address: 0x04, Command: 0x0C, Bits: 21}},
+		{"rc6 toggle skewed", skew(rc6Timings(0x80, 0x31, true), 10),
+			Decoded{Protocol: ProtocolRC6, Address: 0x80, Command: 0x31, Bits: 21, Toggle: true}},
+		{"raw", []int{300, 300, 300, 300, 300},
+			Decoded{Protocol: ProtocolRaw}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkDecoded(t, Decode(tt.timings), tt.want)
+		})
+	}
+}
+
+//	TestEncodeDecode checks that every encoded code decodes to itself
+func TestEncodeDecode(t *testing.T) {
+	tests := []struct{ protocol, code string }{
+		{ProtocolNEC, NECCode(0x04, 0x08)},
+		{ProtocolSamsung, "11100000111000000100000010111111"},
+		{ProtocolSIRC, "101010010000"},
+		{ProtocolRC5, "11000000001100"},
+		{ProtocolRC6, "100000000010000000001100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			timings, err := Encode(tt.protocol, tt.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := Decode(timings)
+			if decoded.Protocol != tt.protocol || decoded.Code != tt.code {
+				t.Errorf("decoded %s %q, want %s %q", decoded.Protocol, decoded.Code, tt.protocol, tt.code)
+			}
+		})
+	}
+}
+
+//	TestSignalTimings checks the send endpoint encoding, which takes bit
+//	strings of any length
+func TestSignalTimings(t *testing.T) {
+	code := NECCode(0x04, 0x08)
+	timings, err := SignalTimings(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := Encode(ProtocolNEC, code)
+	checkTimings(t, timings, want, 0)
+	timings, err = SignalTimings("101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTimings(t, timings, []int{9000, 4500, 562, 1687, 562, 562, 562, 1687, 562}, 0)
+	for _, signal := range []string{"", "10a1", strings.Repeat("1", MaxSignalBits+1)} {
+		if _, err := SignalTimings(signal); err == nil {
+			t.Errorf("accepted %d bits %.8q", len(signal), signal)
+		}
+	}
+}
+
+func checkDecoded(t *testing.T, got, want Decoded) {
+	t.Helper()
+	if got.Protocol != want.Protocol || got.Address != want.Address || got.Command != want.Command ||
+		got.Bits != want.Bits || got.Repeat != want.Repeat || got.Toggle != want.Toggle {
+		t.Errorf("decoded %v toggle %t, want %v toggle %t", got, got.Toggle, want, want.Toggle)
+	}
+	if want.Code != "" && got.Code != want.Code {
+		t.Errorf("code %q, want %q", got.Code, want.Code)
+	}
+	if got.Protocol != ProtocolRaw && got.Confidence < 0.5 {
+		t.Errorf("confidence %.2f", got.Confidence)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+)
+
+//	Frequência da portadora, em Hz, de cada protocolo
+var ProtocolFrequency = map[string]int{
+	ProtocolNEC:     38000,
+	ProtocolSamsung: 38000,
+	ProtocolSIRC:    40000,
+	ProtocolRC5:     36000,
+	ProtocolRC6:     36000,
+	ProtocolRaw:     38000,
+}
+
+//	Encode synthesises the timings of one frame from a protocol and the bit
+//	string found in Decoded.Code; it is the inverse of DecodeFrame
+func Encode(protocol, code string) (timings []int, err error) {
+	for _, c := range code {
+		if c != '0' && c != '1' {
+			return nil, fmt.Errorf("encoding %s: non-binary digit in %q", protocol, code)
+		}
+	}
+	switch protocol {
+	case ProtocolNEC:
+		return necTiming.encode(code)
+	case ProtocolSamsung:
+		return samsungTiming.encode(code)
+	case ProtocolSIRC:
+		return encodeSIRC(code)
+	case ProtocolRC5:
+		return encodeRC5(code)
+	case ProtocolRC6:
+		return encodeRC6(code)
+	}
+	return nil, fmt.Errorf("encoding: unknown protocol %q", protocol)
+}
+
+//	Tamanho máximo dos sinais aceitos pelo irSling
+const MaxSignalBits = 512
+
+//	SignalTimings encodes a bit string of any length with the header, bit and
+//	trailing mark of NEC; 32 bits give the same frame as Encode
+func SignalTimings(signal string) (timings []int, err error) {
+	if len(signal) == 0 || len(signal) > MaxSignalBits {
+		return nil, fmt.Errorf("encoding signal: %d bits, want 1 to %d", len(signal), MaxSignalBits)
+	}
+	for _, c := range signal {
+		if c != '0' && c != '1' {
+			return nil, fmt.Errorf("encoding signal: non-binary digit in %q", signal)
+		}
+	}
+	timings = make([]int, 0, 2*len(signal)+3)
+	timings = append(timings, necTiming.headerMark, necTiming.headerSpace)
+	timings = necTiming.appendBits(timings, signal)
+	return append(timings, necTiming.bitMark), nil
+}
+
+//	CommandTimings returns the timings of a learned command, raw or decoded
+func CommandTimings(command Command) (timings []int, err error) {
+	if command.Protocol == ProtocolRaw {
+		return ParseTimings(command.Timings)
+	}
+	return Encode(command.Protocol, command.Code)
+}
+
+func (p pulseDistance) encode(code string) (timings []int, err error) {
+	if len(code) != p.bits {
+		return nil, fmt.Errorf("encoding %s: expected %d bits, got %d", p.protocol, p.bits, len(code))
+	}
+	timings = make([]int, 0, 2*p.bits+3)
+	timings = append(timings, p.headerMark, p.headerSpace)
+	timings = p.appendBits(timings, code)
+	return append(timings, p.bitMark), nil
+}
+
+//	appendBits appends the pulse distance encoding of bits to timings
+func (p pulseDistance) appendBits(timings []int, bits string) []int {
+	for _, c := range bits {
+		if c == '1' {
+			timings = append(timings, p.bitMark, p.oneSpace)
+		} else {
+			timings = append(timings, p.bitMark, p.zeroSpace)
+		}
+	}
+	return timings
+}
+
+func encodeSIRC(code string) (timings []int, err error) {
+	if n := len(code); n != 12 && n != 15 && n != 20 {
+		return nil, fmt.Errorf("encoding %s: expected 12, 15 or 20 bits, got %d", ProtocolSIRC, n)
+	}
+	timings = []int{2400, 600}
+	for k, c := range code {
+		if c == '1' {
+			timings = append(timings, 1200)
+		} else {
+			timings = append(timings, 600)
+		}
+		if k < len(code)-1 {
+			timings = append(timings, 600)
+		}
+	}
+	return timings, nil
+}
+
+func encodeRC5(code string) (timings []int, err error) {
+	if len(code) != 14 {
+		return nil, fmt.Errorf("encoding %s: expected 14 bits, got %d", ProtocolRC5, len(code))
+	}
+	levels := make([]bool, 0, 28)
+	for _, c := range code {
+		//RC5: 1 é espaço seguido de marca
+		levels = append(levels, c == '0', c == '1')
+	}
+	return levelsToTimings(levels, 889), nil
+}
+
+func encodeRC6(code string) (timings []int, err error) {
+	if len(code) < 21 || code[0] != '1' {
+		return nil, fmt.Errorf("encoding %s: expected a start bit and at least 21 bits", ProtocolRC6)
+	}
+	levels := make([]bool, 0, 2*len(code)+2)
+	for k, c := range code {
+		width := 1
+		if k == 4 {
+			width = 2
+		}
+		//RC6: 1 é marca seguida de espaço
+		for n := 0; n < width; n++ {
+			levels = append(levels, c == '1')
+		}
+		for n := 0; n < width; n++ {
+			levels = append(levels, c == '0')
+		}
+	}
+	return append([]int{2666, 889}, levelsToTimings(levels, 444)...), nil
+}
+
+//	levelsToTimings merges unit levels into mark and space durations,
+//	dropping leading and trailing spaces
+func levelsToTimings(levels []bool, unit int) (timings []int) {
+	for len(levels) > 0 && !levels[0] {
+		levels = levels[1:]
+	}
+	for len(levels) > 0 && !levels[len(levels)-1] {
+		levels = levels[:len(levels)-1]
+	}
+	for k, level := range levels {
+		if k > 0 && level == levels[k-1] {
+			timings[len(timings)-1] += unit
+			continue
+		}
+		timings = append(timings, unit)
+	}
+	return timings
+}
+
+//	NECCode writes the bit string of an NEC frame; addresses above 0xFF use
+//	the extended 16 bit form instead of the inverted address byte
+func NECCode(address, command uint32) string {
+	b := []byte{byte(address), ^byte(address), byte(command), ^byte(command)}
+	if address > 0xFF {
+		b[1] = byte(address >> 8)
+	}
+	return bytesLSB(b)
+}
+
+//	bytesLSB writes bytes as bits, least significant bit first
+func bytesLSB(b []byte) string {
+	bits := make([]byte, 0, 8*len(b))
+	for _, v := range b {
+		for k := uint(0); k < 8; k++ {
+			bits = append(bits, '0'+v>>k&1)
+		}
+	}
+	return string(bits)
+}
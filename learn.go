@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	//Tempo máximo entre a primeira captura e a verificação
+	LearnTimeout = 2 * time.Minute
+
+	LearnStepVerify = "verify"
+)
+
+//Prazo das sessões, encurtado nos testes
+var learnTimeout = LearnTimeout
+
+var (
+	ErrLearnNoSignal = errors.New("no usable infrared signal captured")
+	ErrLearnMismatch = errors.New("verification press does not match the first one")
+)
+
+//	learnSession holds the first capture of a button while waiting for the verification press
+//	It is discarded after LearnTimeout or when the verification request is abandoned
+type learnSession struct {
+	First   Decoded
+	Started time.Time
+	expiry  *time.Timer
+}
+
+type LearnStep struct {
+	Step    string  `json:"step"`
+	Decoded Decoded `json:"decoded"`
+}
+
+func learnKey(deviceID, button int) string {
+	return fmt.Sprintf("%d/%d", deviceID, button)
+}
+
+//	Learn captures one press of the given button
+//	The first call stores the capture and returns done == false, the second
+//	call verifies it against the first and persists the learned Command
+func (i *InfraredManager) Learn(ctx context.Context, device Infrared, button int) (command Command, decoded Decoded, done bool, err error) {
+	key := learnKey(device.ID, button)
+	i.learningLock.Lock()
+	pending := i.learning[key]
+	i.learners++
+	i.learningLock.Unlock()
+	defer func() {
+		i.learningLock.Lock()
+		i.learners--
+		i.learningLock.Unlock()
+	}()
+
+	decoded, err = i.Receive(ctx)
+	if err != nil {
+		if pending != nil && ctx.Err() != nil {
+			//O cliente desistiu da verificação
+			i.Logger.Printf("learning button %d of device %d: abandoned\n", button, device.ID)
+			i.forgetLearning(key, pending)
+		}
+		return command, decoded, false, err
+	}
+	if decoded.Repeat || len(decoded.Timings) == 0 {
+		return command, decoded, false, ErrLearnNoSignal
+	}
+
+	i.learningLock.Lock()
+	defer i.learningLock.Unlock()
+	session, ok := i.learning[key]
+	if !ok {
+		session = &learnSession{
+			First:   decoded,
+			Started: time.Now(),
+		}
+		session.expiry = time.AfterFunc(learnTimeout, func() {
+			i.forgetLearning(key, session)
+		})
+		i.learning[key] = session
+		i.Logger.Printf("learning button %d of device %d: first press %s\n", button, device.ID, decoded)
+		return command, decoded, false, nil
+	}
+	session.expiry.Stop()
+	delete(i.learning, key)
+	if !sameSignal(session.First, decoded) {
+		i.Logger.Printf("learning button %d of device %d: mismatch %s\n", button, device.ID, decoded)
+		return command, decoded, false, ErrLearnMismatch
+	}
+
+	command = Command{
+		InfraredID: device.ID,
+		Protocol:   decoded.Protocol,
+		Code:       decoded.Code,
+		Button:     button,
+	}
+	if decoded.Protocol == ProtocolRaw {
+		command.Timings = FormatTimings(decoded.Timings)
+	}
+	if command, err = i.Repository.WriteCommand(command); err != nil {
+		return command, decoded, false, err
+	}
+	i.Logger.Printf("learning button %d of device %d: learned %s\n", button, device.ID, decoded)
+	return command, decoded, true, nil
+}
+
+//	forgetLearning discards session, unless it was already replaced by a new one
+func (i *InfraredManager) forgetLearning(key string, session *learnSession) {
+	i.learningLock.Lock()
+	defer i.learningLock.Unlock()
+	if i.learning[key] == session {
+		session.expiry.Stop()
+		delete(i.learning, key)
+	}
+}
+
+//	Learning reports whether a button is being captured or waits for its
+//	verification press, so that remote bindings are not triggered meanwhile
+func (i *InfraredManager) Learning() bool {
+	i.learningLock.Lock()
+	defer i.learningLock.Unlock()
+	return i.learners > 0 || len(i.learning) > 0
+}
+
+//	SendCommand replays a learned command on the device emitter
+func (i *InfraredManager) SendCommand(ctx context.Context, device Infrared, command Command) error {
+	timings, err := CommandTimings(command)
+	if err != nil {
+		return err
+	}
+	return i.SendTimings(ctx, device.Pin, commandFrequency(command), timings)
+}
+
+//	sendCommand is SendCommand for callers already holding the emitter
+func (i *InfraredManager) sendCommand(ctx context.Context, device Infrared, command Command) error {
+	timings, err := CommandTimings(command)
+	if err != nil {
+		return err
+	}
+	return i.sendTimings(ctx, device.Pin, commandFrequency(command), timings)
+}
+
+//	sameSignal compares two captures of the same button
+//	Raw captures are compared duration by duration with a relative tolerance
+func sameSignal(a, b Decoded) bool {
+	if a.Protocol != b.Protocol {
+		return false
+	}
+	if a.Protocol != ProtocolRaw {
+		return a.Code == b.Code
+	}
+	if len(a.Timings) != len(b.Timings) {
+		return false
+	}
+	for k := range a.Timings {
+		diff := math.Abs(float64(a.Timings[k] - b.Timings[k]))
+		if diff > PulseTolerance*float64(a.Timings[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *InfraredManager) InfraredHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	infrared, err := i.Repository.ReadInfrared()
+	if err != nil {
+		writeError(w, i.Logger, "reading infrared", err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(infrared); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (i *InfraredManager) CreateInfraredHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	var infrared Infrared
+	if err := json.NewDecoder(r.Body).Decode(&infrared); err != nil {
+		i.Logger.Printf("decoding infrared: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	infrared.ID = 0
+	infrared.Commands = nil
+	infrared, err := i.Repository.CreateInfrared(infrared)
+	if err != nil {
+		writeError(w, i.Logger, "creating infrared", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(infrared)
+}
+
+//	buttonVars reads the device and button of the route
+func buttonVars(r *http.Request) (deviceID, button int, err error) {
+	if deviceID, err = strconv.Atoi(mux.Vars(r)["device"]); err != nil {
+		return 0, 0, fmt.Errorf("invalid device: %v", err)
+	}
+	if button, err = strconv.Atoi(mux.Vars(r)["button"]); err != nil {
+		return 0, 0, fmt.Errorf("invalid button: %v", err)
+	}
+	return deviceID, button, nil
+}
+
+func (i *InfraredManager) LearnHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	deviceID, button, err := buttonVars(r)
+	if err != nil {
+		i.Logger.Printf("learning: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	device, err := i.Repository.ReadInfraredByID(deviceID)
+	if err != nil {
+		writeError(w, i.Logger, "learning", err)
+		return
+	}
+	command, decoded, done, err := i.Learn(r.Context(), device, button)
+	switch {
+	case err == ErrLearnNoSignal || err == ErrLearnMismatch:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(LearnStep{Step: err.Error(), Decoded: decoded})
+	case err != nil:
+		i.Logger.Printf("learning: %v\n", err)
+		w.WriteHeader(receiveStatus(err))
+	case !done:
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(LearnStep{Step: LearnStepVerify, Decoded: decoded})
+	default:
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(command)
+	}
+}
+
+//	ButtonHandler replays a learned button
+func (i *InfraredManager) ButtonHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	deviceID, button, err := buttonVars(r)
+	if err != nil {
+		i.Logger.Printf("replaying button: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	device, err := i.Repository.ReadInfraredByID(deviceID)
+	if err != nil {
+		writeError(w, i.Logger, "replaying button", err)
+		return
+	}
+	command, err := i.Repository.ReadCommand(deviceID, button)
+	if err != nil {
+		writeError(w, i.Logger, "replaying button", err)
+		return
+	}
+	if err := i.SendCommand(r.Context(), device, command); err != nil {
+		i.Logger.Printf("replaying button %d of device %d: %v\n", button, deviceID, err)
+		w.WriteHeader(transmitStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func learnFrame(t *testing.T, command uint32) []int {
+	t.Helper()
+	timings, err := Encode(ProtocolNEC, NECCode(0x04, command))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return timings
+}
+
+func testLearn(t *testing.T, frames ...[]int) (*InfraredManager, *infraredRepository, Infrared) {
+	t.Helper()
+	device := Infrared{ID: 1, Name: "tv", Pin: 17}
+	i, _ := testInfraredManager(t, frames...)
+	repository := newInfraredRepository(device)
+	i.Repository = repository
+	return i, repository, device
+}
+
+func TestLearn(t *testing.T) {
+	i, repository, device := testLearn(t, learnFrame(t, 0x08), learnFrame(t, 0x08))
+	_, first, done, err := i.Learn(context.Background(), device, 3)
+	if err != nil || done {
+		t.Fatalf("first press: done %v, %v", done, err)
+	}
+	if !i.Learning() {
+		t.Error("not learning while waiting for the verification press")
+	}
+	command, _, done, err := i.Learn(context.Background(), device, 3)
+	if err != nil || !done {
+		t.Fatalf("verification press: done %v, %v", done, err)
+	}
+	if command.Protocol != ProtocolNEC || command.Code != first.Code || command.Button != 3 || command.InfraredID != device.ID {
+		t.Errorf("learned %+v from %+v", command, first)
+	}
+	if stored, err := repository.ReadCommand(device.ID, 3); err != nil || stored.Code != first.Code {
+		t.Errorf("stored %+v, %v", stored, err)
+	}
+	if i.Learning() {
+		t.Error("still learning after the command was stored")
+	}
+}
+
+func TestLearnMismatch(t *testing.T) {
+	i, repository, device := testLearn(t, learnFrame(t, 0x08), learnFrame(t, 0x09), learnFrame(t, 0x09))
+	i.Learn(context.Background(), device, 3)
+	if _, _, done, err := i.Learn(context.Background(), device, 3); err != ErrLearnMismatch || done {
+		t.Fatalf("different verification press: done %v, %v, want ErrLearnMismatch", done, err)
+	}
+	if len(repository.commands) != 0 || i.Learning() {
+		t.Error("mismatch stored a command or kept the session")
+	}
+	//Depois do erro o próximo toque começa uma nova sessão
+	if _, _, done, err := i.Learn(context.Background(), device, 3); err != nil || done {
+		t.Errorf("press after a mismatch: done %v, %v, want a new first press", done, err)
+	}
+}
+
+func TestLearnExpiry(t *testing.T) {
+	defer func(timeout time.Duration) { learnTimeout = timeout }(learnTimeout)
+	learnTimeout = 20 * time.Millisecond
+	i, repository, device := testLearn(t, learnFrame(t, 0x08), learnFrame(t, 0x08))
+	i.Learn(context.Background(), device, 3)
+	waitFor(t, "the session to expire", func() bool { return !i.Learning() })
+	if _, _, done, err := i.Learn(context.Background(), device, 3); err != nil || done {
+		t.Errorf("press after expiry: done %v, %v, want a new first press", done, err)
+	}
+	if len(repository.commands) != 0 {
+		t.Error("stored a command verified after the session expired")
+	}
+}
+
+func TestLearnAbandoned(t *testing.T) {
+	i, _, device := testLearn(t, learnFrame(t, 0x08))
+	i.Learn(context.Background(), device, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err := i.Learn(ctx, device, 3); err != context.Canceled {
+		t.Errorf("abandoned verification: %v, want context.Canceled", err)
+	}
+	if i.Learning() {
+		t.Error("abandoned session kept")
+	}
+}
+
+func TestButtonRoutes(t *testing.T) {
+	i, repository, device := testLearn(t)
+	repository.WriteCommand(Command{InfraredID: device.ID, Button: 3, Protocol: ProtocolNEC, Code: NECCode(0x04, 0x08)})
+	tests := []struct {
+		handler        http.HandlerFunc
+		device, button string
+		status         int
+	}{
+		{i.LearnHandler, "x", "3", http.StatusBadRequest},
+		{i.LearnHandler, "1", "99999999999999999999", http.StatusBadRequest},
+		{i.ButtonHandler, "1", "x", http.StatusBadRequest},
+		{i.ButtonHandler, "2", "3", http.StatusNotFound},
+		{i.ButtonHandler, "1", "4", http.StatusNotFound},
+		{i.ButtonHandler, "1", "3", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := mux.SetURLVars(httptest.NewRequest("POST", "/", nil), map[string]string{"device": tt.device, "button": tt.button})
+		w := httptest.NewRecorder()
+		tt.handler(w, r)
+		if w.Code != tt.status {
+			t.Errorf("device %s button %s: %d, want %d", tt.device, tt.button, w.Code, tt.status)
+		}
+	}
+}
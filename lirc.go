@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	LircFlagSpaceEnc = "SPACE_ENC"
+	LircFlagRawCodes = "RAW_CODES"
+)
+
+//	LircRemote is one "begin remote" block of a lircd.conf file
+type LircRemote struct {
+	Name         string
+	Flags        []string
+	Frequency    int
+	Bits         int
+	Header       [2]int
+	One          [2]int
+	Zero         [2]int
+	Ptrail       int
+	PreDataBits  int
+	PreData      uint64
+	PostDataBits int
+	PostData     uint64
+	Gap          int
+	Codes        []LircCode
+}
+
+//	LircCode is a named code, either a value for encoded remotes or timings for raw ones
+type LircCode struct {
+	Name    string
+	Code    uint64
+	Timings []int
+}
+
+func (l *LircRemote) HasFlag(flag string) bool {
+	for _, f := range l.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+//	ParseLirc reads every remote of a lircd.conf file
+func ParseLirc(r io.Reader) (remotes []LircRemote, err error) {
+	const (
+		outside = iota
+		inRemote
+		inCodes
+		inRawCodes
+	)
+	state := outside
+	var remote *LircRemote
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if k := strings.Index(text, "#"); k >= 0 {
+			text = text[:k]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		key := strings.ToLower(fields[0])
+		switch {
+		case key == "begin" && len(fields) > 1 && fields[1] == "remote":
+			remotes = append(remotes, LircRemote{})
+			remote = &remotes[len(remotes)-1]
+			state = inRemote
+		case remote == nil:
+			//Fora de um bloco remote só há comentários e linhas em branco
+			return nil, fmt.Errorf("parsing lirc line %d: %q outside remote", line, strings.TrimSpace(text))
+		case key == "begin" && len(fields) > 1:
+			switch fields[1] {
+			case "codes":
+				state = inCodes
+			case "raw_codes":
+				state = inRawCodes
+			}
+		case key == "end" && len(fields) > 1:
+			if fields[1] == "remote" {
+				remote, state = nil, outside
+			} else {
+				state = inRemote
+			}
+		case state == inCodes:
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("parsing lirc line %d: missing code value", line)
+			}
+			value, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(fields[1]), "0x"), 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing lirc line %d: invalid code %q", line, text)
+			}
+			remote.Codes = append(remote.Codes, LircCode{Name: fields[0], Code: value})
+		case state == inRawCodes && key == "name" && len(fields) > 1:
+			remote.Codes = append(remote.Codes, LircCode{Name: fields[1]})
+		case state == inRawCodes:
+			if len(remote.Codes) == 0 {
+				return nil, fmt.Errorf("parsing lirc line %d: timings before name", line)
+			}
+			code := &remote.Codes[len(remote.Codes)-1]
+			for _, field := range fields {
+				micros, err := strconv.Atoi(field)
+				if err != nil {
+					return nil, fmt.Errorf("parsing lirc line %d: %v", line, err)
+				}
+				code.Timings = append(code.Timings, micros)
+			}
+		case state == inRemote:
+			remote.set(key, fields[1:])
+		}
+	}
+	return remotes, scanner.Err()
+}
+
+//	set stores a remote attribute; attributes not needed to synthesise frames are ignored
+func (l *LircRemote) set(key string, values []string) {
+	ints := make([]int, 0, len(values))
+	for _, value := range values {
+		n, err := strconv.ParseInt(strings.TrimPrefix(strings.ToLower(value), "0x"), lircBase(value), 64)
+		if err != nil {
+			break
+		}
+		ints = append(ints, int(n))
+	}
+	pair := func(target *[2]int) {
+		if len(ints) == 2 {
+			target[0], target[1] = ints[0], ints[1]
+		}
+	}
+	switch key {
+	case "name":
+		if len(values) > 0 {
+			l.Name = values[0]
+		}
+	case "flags":
+		l.Flags = strings.Split(strings.Join(values, ""), "|")
+	case "frequency":
+		if len(ints) == 1 {
+			l.Frequency = ints[0]
+		}
+	case "bits":
+		if len(ints) == 1 {
+			l.Bits = ints[0]
+		}
+	case "gap":
+		if len(ints) > 0 {
+			l.Gap = ints[0]
+		}
+	case "header":
+		pair(&l.Header)
+	case "one":
+		pair(&l.One)
+	case "zero":
+		pair(&l.Zero)
+	case "ptrail":
+		if len(ints) == 1 {
+			l.Ptrail = ints[0]
+		}
+	case "pre_data_bits":
+		if len(ints) == 1 {
+			l.PreDataBits = ints[0]
+		}
+	case "pre_data":
+		if len(ints) == 1 {
+			l.PreData = uint64(ints[0])
+		}
+	case "post_data_bits":
+		if len(ints) == 1 {
+			l.PostDataBits = ints[0]
+		}
+	case "post_data":
+		if len(ints) == 1 {
+			l.PostData = uint64(ints[0])
+		}
+	}
+}
+
+func lircBase(value string) int {
+	if strings.HasPrefix(strings.ToLower(value), "0x") {
+		return 16
+	}
+	return 10
+}
+
+//	Timings synthesises the frame of code; only SPACE_ENC and RAW_CODES remotes are supported
+func (l *LircRemote) Timings(code LircCode) (timings []int, err error) {
+	if l.HasFlag(LircFlagRawCodes) || code.Timings != nil {
+		return code.Timings, nil
+	}
+	if !l.HasFlag(LircFlagSpaceEnc) {
+		return nil, fmt.Errorf("lirc remote %s: unsupported flags %s", l.Name, strings.Join(l.Flags, "|"))
+	}
+	bits := lircBits(l.PreData, l.PreDataBits) + lircBits(code.Code, l.Bits) + lircBits(l.PostData, l.PostDataBits)
+	if l.Header[0] > 0 {
+		timings = append(timings, l.Header[0], l.Header[1])
+	}
+	for _, c := range bits {
+		if c == '1' {
+			timings = append(timings, l.One[0], l.One[1])
+		} else {
+			timings = append(timings, l.Zero[0], l.Zero[1])
+		}
+	}
+	if l.Ptrail > 0 {
+		timings = append(timings, l.Ptrail)
+	}
+	return timings, nil
+}
+
+//	lircBits writes value as n bits, most significant first, as LIRC sends them
+func lircBits(value uint64, n int) string {
+	bits := make([]byte, n)
+	for k := 0; k < n; k++ {
+		bits[k] = '0' + byte(value>>uint(n-1-k)&1)
+	}
+	return string(bits)
+}
+
+//	FormatLirc writes remote as a lircd.conf block
+func FormatLirc(w io.Writer, remote LircRemote) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "begin remote\n")
+	fmt.Fprintf(b, "  name  %s\n", lircName(remote.Name))
+	if len(remote.Flags) > 0 {
+		fmt.Fprintf(b, "  flags %s\n", strings.Join(remote.Flags, "|"))
+	}
+	fmt.Fprintf(b, "  eps            30\n")
+	fmt.Fprintf(b, "  aeps          100\n")
+	if remote.Frequency > 0 {
+		fmt.Fprintf(b, "  frequency    %d\n", remote.Frequency)
+	}
+	if remote.HasFlag(LircFlagRawCodes) {
+		fmt.Fprintf(b, "  gap          %d\n", remote.Gap)
+		fmt.Fprintf(b, "  begin raw_codes\n")
+		for _, code := range remote.Codes {
+			fmt.Fprintf(b, "    name %s\n", lircName(code.Name))
+			for k := 0; k < len(code.Timings); k += 6 {
+				end := k + 6
+				if end > len(code.Timings) {
+					end = len(code.Timings)
+				}
+				fmt.Fprintf(b, "      %s\n", FormatTimings(code.Timings[k:end]))
+			}
+		}
+		fmt.Fprintf(b, "  end raw_codes\n")
+	} else {
+		fmt.Fprintf(b, "  bits         %d\n", remote.Bits)
+		if remote.Header[0] > 0 {
+			fmt.Fprintf(b, "  header       %d %d\n", remote.Header[0], remote.Header[1])
+		}
+		fmt.Fprintf(b, "  one          %d %d\n", remote.One[0], remote.One[1])
+		fmt.Fprintf(b, "  zero         %d %d\n", remote.Zero[0], remote.Zero[1])
+		if remote.Ptrail > 0 {
+			fmt.Fprintf(b, "  ptrail       %d\n", remote.Ptrail)
+		}
+		fmt.Fprintf(b, "  gap          %d\n", remote.Gap)
+		fmt.Fprintf(b, "  begin codes\n")
+		width := (remote.Bits + 3) / 4
+		for _, code := range remote.Codes {
+			fmt.Fprintf(b, "    %-24s 0x%0*X\n", lircName(code.Name), width, code.Code)
+		}
+		fmt.Fprintf(b, "  end codes\n")
+	}
+	fmt.Fprintf(b, "end remote\n")
+	return b.Flush()
+}
+
+//	lircName replaces the whitespace LIRC does not accept in names
+func lircName(name string) string {
+	name = strings.Join(strings.Fields(name), "_")
+	if name == "" {
+		return "unnamed"
+	}
+	return name
+}
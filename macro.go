@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//	Responsibilities:
+//	*	To run stored sequences of infrared commands
+//	MacroManager
+type MacroManager struct {
+	LogFile *os.File
+	Logger  *log.Logger
+
+	Repository
+	InfraredManager *InfraredManager
+
+	runs     map[int]context.CancelFunc
+	nextRun  int
+	runsLock sync.Mutex
+}
+
+//	Macro is an ordered list of infrared commands, possibly on several emitters
+type Macro struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	Name  string      `json:"name"`
+	Steps []MacroStep `json:"steps"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at" sql:"index"`
+}
+
+//	MacroStep sends a learned button Repeat times, then waits Delay milliseconds
+type MacroStep struct {
+	ID      int `json:"id" gorm:"primary_key"`
+	MacroID int `json:"macro_id"`
+
+	Position   int `json:"position"`
+	InfraredID int `json:"infrared_id"`
+	Button     int `json:"button"`
+	Repeat     int `json:"repeat"`
+	Delay      int `json:"delay"`
+}
+
+type MacroRun struct {
+	Run     int `json:"run"`
+	MacroID int `json:"macro_id"`
+}
+
+func NewMacroManager() *MacroManager {
+	return &MacroManager{}
+}
+
+func (m *MacroManager) Initialize(logPath string, repository Repository, infraredManager *InfraredManager) error {
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	m.LogFile = f
+	m.Logger = log.New(m.LogFile, "", log.Ldate|log.Ltime)
+	m.Repository = repository
+	m.InfraredManager = infraredManager
+	m.runs = make(map[int]context.CancelFunc)
+	m.Logger.Printf("MacroManager started.\n")
+	return nil
+}
+
+func (m *MacroManager) Close() {
+	m.runsLock.Lock()
+	for _, cancel := range m.runs {
+		cancel()
+	}
+	m.runsLock.Unlock()
+	m.Logger.Printf("MacroManager closed.\n")
+	m.LogFile.Close()
+}
+
+//	Start runs the macro in the background and returns the run number used to cancel it
+func (m *MacroManager) Start(macroID int) (run MacroRun, err error) {
+	macro, err := m.Repository.ReadMacroByID(macroID)
+	if err != nil {
+		return run, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.runsLock.Lock()
+	m.nextRun++
+	run = MacroRun{Run: m.nextRun, MacroID: macro.ID}
+	m.runs[run.Run] = cancel
+	m.runsLock.Unlock()
+
+	go func() {
+		defer func() {
+			m.runsLock.Lock()
+			delete(m.runs, run.Run)
+			m.runsLock.Unlock()
+			cancel()
+		}()
+		if err := m.Run(ctx, macro); err != nil {
+			m.Logger.Printf("running macro %d (run %d): %v\n", macro.ID, run.Run, err)
+		}
+	}()
+	return run, nil
+}
+
+//	Cancel stops a run started with Start
+func (m *MacroManager) Cancel(run int) bool {
+	m.runsLock.Lock()
+	defer m.runsLock.Unlock()
+	cancel, ok := m.runs[run]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+//	Run sends every step in order, holding the emitters the macro uses so that
+//	frames of two macros never interleave on the same LED
+func (m *MacroManager) Run(ctx context.Context, macro Macro) error {
+	devices := make(map[int]Infrared)
+	pins := make([]int, 0)
+	for _, step := range macro.Steps {
+		if _, ok := devices[step.InfraredID]; ok {
+			continue
+		}
+		device, err := m.Repository.ReadInfraredByID(step.InfraredID)
+		if err != nil {
+			return fmt.Errorf("reading infrared device %d: %v", step.InfraredID, err)
+		}
+		devices[device.ID] = device
+		pins = append(pins, device.Pin)
+	}
+	//Sempre na mesma ordem, para que duas macros não esperem uma pela outra
+	sort.Ints(pins)
+	for k, pin := range pins {
+		if k > 0 && pins[k-1] == pin {
+			continue
+		}
+		release, err := m.InfraredManager.LockEmitter(ctx, pin)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	m.Logger.Printf("running macro %d (%s)\n", macro.ID, macro.Name)
+	for _, step := range macro.Steps {
+		device := devices[step.InfraredID]
+		command, err := m.Repository.ReadCommand(step.InfraredID, step.Button)
+		if err != nil {
+			return fmt.Errorf("reading button %d of device %d: %v", step.Button, step.InfraredID, err)
+		}
+		repeat := step.Repeat
+		if repeat < 1 {
+			repeat = 1
+		}
+		for k := 0; k < repeat; k++ {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := m.InfraredManager.sendCommand(ctx, device, command); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-time.After(time.Duration(step.Delay) * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (m *MacroManager) MacroHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	macros, err := m.Repository.ReadMacro()
+	if err != nil {
+		writeError(w, m.Logger, "reading macros", err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(macros); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (m *MacroManager) CreateMacroHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	var macro Macro
+	if err := json.NewDecoder(r.Body).Decode(&macro); err != nil {
+		m.Logger.Printf("decoding macro: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	macro.ID = 0
+	for k := range macro.Steps {
+		macro.Steps[k].ID = 0
+		macro.Steps[k].Position = k
+	}
+	macro, err := m.Repository.CreateMacro(macro)
+	if err != nil {
+		writeError(w, m.Logger, "creating macro", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(macro)
+}
+
+func (m *MacroManager) DeleteMacroHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if err := m.Repository.DeleteMacro(Macro{ID: id}); err != nil {
+		writeError(w, m.Logger, "deleting macro", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (m *MacroManager) RunHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	run, err := m.Start(id)
+	if err != nil {
+		writeError(w, m.Logger, "running macro", err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run)
+}
+
+func (m *MacroManager) CancelHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	run, _ := strconv.Atoi(mux.Vars(r)["run"])
+	if !m.Cancel(run) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var logFile *os.File
 
+//	Version is set at build time with -ldflags "-X main.Version=<version>"
+var Version = "dev"
+
 func init() {
 	logFile, err := os.OpenFile("log/main", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
@@ -21,12 +28,13 @@ func main() {
 	log.Printf("main() started.\n")
 	defer logFile.Close()
 
-	//InfraredManager
-	infraredManager := NewInfraredManager()
-	if err := infraredManager.Initialize("log/infrared"); err != nil {
-		log.Fatalf("main(): Initializing infraredManager: %v\n", err)
+	//Comandos de manutenção, como "migrations", não iniciam o servidor
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
 	}
-	defer infraredManager.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	//SecurityManager
 	securityManager := NewSecurityManager()
@@ -42,6 +50,13 @@ func main() {
 	}
 	defer databaseManager.Close()
 
+	//InfraredManager
+	infraredManager := NewInfraredManager()
+	if err := infraredManager.Initialize("log/infrared", databaseManager); err != nil {
+		log.Fatalf("main(): Initializing infraredManager: %v\n", err)
+	}
+	defer infraredManager.Close()
+
 	//deviceManager
 	deviceManager := NewDeviceManager()
 	if err := deviceManager.Initialize("log/device", databaseManager); err != nil {
@@ -49,13 +64,52 @@ func main() {
 	}
 	defer deviceManager.Close()
 
+	//EventManager
+	eventManager := NewEventManager()
+	if err := eventManager.Initialize("log/events", databaseManager, deviceManager, infraredManager); err != nil {
+		log.Fatalf("main(): Initializing eventManager: %v\n", err)
+	}
+	defer eventManager.Close()
+	go eventManager.Run(ctx)
+
 	//RelayManager
 	relayManager := NewRelayManager()
-	if err := relayManager.Initialize("log/relay", databaseManager, deviceManager); err != nil {
+	if err := relayManager.Initialize("log/relay", databaseManager, deviceManager, eventManager); err != nil {
 		log.Fatalf("main(): Initializing relayManager: %v\n", err)
 	}
 	defer relayManager.Close()
 
+	//MacroManager
+	macroManager := NewMacroManager()
+	if err := macroManager.Initialize("log/macro", databaseManager, infraredManager); err != nil {
+		log.Fatalf("main(): Initializing macroManager: %v\n", err)
+	}
+	defer macroManager.Close()
+
+	//ScheduleManager
+	scheduleManager := NewScheduleManager()
+	if err := scheduleManager.Initialize("log/schedule", databaseManager, macroManager, eventManager); err != nil {
+		log.Fatalf("main(): Initializing scheduleManager: %v\n", err)
+	}
+	defer scheduleManager.Close()
+	go scheduleManager.Run(ctx)
+
+	//RemoteManager
+	remoteManager := NewRemoteManager()
+	if err := remoteManager.Initialize("log/remote", databaseManager, relayManager, infraredManager, macroManager); err != nil {
+		log.Fatalf("main(): Initializing remoteManager: %v\n", err)
+	}
+	defer remoteManager.Close()
+	go infraredManager.Listen(ctx)
+	go remoteManager.Run(ctx)
+
+	//BackupManager
+	backupManager := NewBackupManager()
+	if err := backupManager.Initialize("log/backup", databaseManager); err != nil {
+		log.Fatalf("main(): Initializing backupManager: %v\n", err)
+	}
+	defer backupManager.Close()
+
 	//wifiManager
 	wifiManager := NewWifiManager()
 	if err := wifiManager.Initialize("log/wifi", databaseManager); err != nil {
@@ -66,22 +120,91 @@ func main() {
 	wifiManager.AddHandler(relayManager.RelayHandler, "/api/relays", "GET")
 	wifiManager.AddHandler(infraredManager.SendHandler, "/api/infrared/send/{pin}/{signal}", "GET")
 	wifiManager.AddHandler(infraredManager.ReceiveHandler, "/api/infrared/receive", "GET")
+	wifiManager.AddHandler(infraredManager.DecodeHandler, "/api/infrared/decode", "GET")
+	wifiManager.AddHandler(infraredManager.InfraredHandler, "/api/infrared", "GET")
+	wifiManager.AddHandler(infraredManager.CreateInfraredHandler, "/api/infrared", "POST")
+	wifiManager.AddHandler(infraredManager.LearnHandler, "/api/infrared/{device:[0-9]+}/learn/{button:[0-9]+}", "POST")
+	wifiManager.AddHandler(infraredManager.ButtonHandler, "/api/infrared/{device:[0-9]+}/buttons/{button:[0-9]+}", "POST")
+	wifiManager.AddHandler(infraredManager.ImportLircHandler, "/api/infrared/import/lirc", "POST")
+	wifiManager.AddHandler(infraredManager.ImportProntoHandler, "/api/infrared/import/pronto", "POST")
+	wifiManager.AddHandler(infraredManager.ExportHandler, "/api/infrared/{device:[0-9]+}/export/{format}", "GET")
+	wifiManager.AddHandler(infraredManager.ACHandler, "/api/infrared/ac/{id:[0-9]+}", "GET")
+	wifiManager.AddHandler(infraredManager.SetACHandler, "/api/infrared/ac/{id:[0-9]+}", "PUT")
+	wifiManager.AddHandler(infraredManager.RGBHandler, "/api/infrared/rgb/{id:[0-9]+}", "GET")
+	wifiManager.AddHandler(infraredManager.SetRGBHandler, "/api/infrared/rgb/{id:[0-9]+}", "PUT")
+	wifiManager.AddHandler(remoteManager.BindingHandler, "/api/bindings", "GET")
+	wifiManager.AddHandler(remoteManager.CreateBindingHandler, "/api/bindings", "POST")
+	wifiManager.AddHandler(remoteManager.DeleteBindingHandler, "/api/bindings/{id:[0-9]+}", "DELETE")
+	wifiManager.AddHandler(macroManager.MacroHandler, "/api/macros", "GET")
+	wifiManager.AddHandler(macroManager.CreateMacroHandler, "/api/macros", "POST")
+	wifiManager.AddHandler(macroManager.DeleteMacroHandler, "/api/macros/{id:[0-9]+}", "DELETE")
+	wifiManager.AddHandler(macroManager.RunHandler, "/api/macros/{id:[0-9]+}/run", "POST")
+	wifiManager.AddHandler(macroManager.CancelHandler, "/api/macros/runs/{run:[0-9]+}", "DELETE")
+	wifiManager.AddHandler(scheduleManager.ScheduleHandler, "/api/schedules", "GET")
+	wifiManager.AddHandler(scheduleManager.CreateScheduleHandler, "/api/schedules", "POST")
+	wifiManager.AddHandler(backupManager.BackupHandler, "/api/backup", "GET")
+	wifiManager.AddHandler(backupManager.RestoreHandler, "/api/backup/restore", "POST")
+	wifiManager.AddHandler(scheduleManager.DeleteScheduleHandler, "/api/schedules/{id:[0-9]+}", "DELETE")
+	wifiManager.AddHandler(eventManager.StreamHandler, "/api/events", "GET")
+	wifiManager.AddHandler(eventManager.WebsocketHandler, "/api/events/ws", "GET")
+
+	//MQTTManager
+	mqttManager := NewMQTTManager()
+	if err := mqttManager.Initialize("log/mqtt", databaseManager, deviceManager, relayManager, infraredManager); err != nil {
+		log.Fatalf("main(): Initializing mqttManager: %v\n", err)
+	}
+	defer mqttManager.Close()
+	go mqttManager.Run(ctx)
+
+	//CloudCommandManager
+	cloudCommandManager := NewCloudCommandManager()
+	if err := cloudCommandManager.Initialize("log/command", databaseManager, relayManager, infraredManager, macroManager); err != nil {
+		log.Fatalf("main(): Initializing cloudCommandManager: %v\n", err)
+	}
+	defer cloudCommandManager.Close()
 
 	//Inicialização telemetria
 	telemetryManager := NewTelemetryManager()
-	if err := telemetryManager.Initialize("log/telemetry", databaseManager, deviceManager); err != nil {
+	if err := telemetryManager.Initialize("log/telemetry", databaseManager, deviceManager, relayManager, cloudCommandManager, eventManager); err != nil {
 		log.Fatalf("main(): Initializing telemetryManager: %v\n", err)
 	}
 	defer telemetryManager.Close()
-	go telemetryManager.Communicate()
+	go telemetryManager.Sample(ctx)
+	go telemetryManager.Run(ctx)
+	wifiManager.AddHandler(telemetryManager.StatusHandler, "/api/telemetry/status", "GET")
+
+	//MetricsManager
+	metricsManager := NewMetricsManager()
+	if err := metricsManager.Initialize("log/metrics", databaseManager, deviceManager, relayManager, telemetryManager); err != nil {
+		log.Fatalf("main(): Initializing metricsManager: %v\n", err)
+	}
+	defer metricsManager.Close()
+	wifiManager.AddHandler(metricsManager.MetricsHandler, "/metrics", "GET")
 
 	//bluetoothManager
 	bluetoothManager := NewBluetoothManager()
-	if err := bluetoothManager.Initialize("log/bluetooth", databaseManager, deviceManager, securityManager); err != nil {
+	if err := bluetoothManager.Initialize("log/bluetooth", databaseManager, deviceManager, securityManager, macroManager); err != nil {
 		log.Fatalf("main(): Initializing bluetoothManager: %v\n", err)
 	}
 	defer bluetoothManager.Close()
 
-	http.ListenAndServe(":8181", wifiManager.Router)
+	//SIGINT e SIGTERM encerram o servidor e as rotinas; os defers fecham os managers
+	server := &http.Server{Addr: ":8181", Handler: wifiManager.Router}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		s := <-signals
+		log.Printf("main(): received %v, shutting down.\n", s)
+		cancel()
+		shutdown, done := context.WithTimeout(context.Background(), 10*time.Second)
+		defer done()
+		if err := server.Shutdown(shutdown); err != nil {
+			log.Printf("main(): shutting down server: %v\n", err)
+		}
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Printf("main(): serving: %v\n", err)
+	}
+	cancel()
 	log.Printf("main() finished.\n")
 }
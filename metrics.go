@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	MetricCounter   = "counter"
+	MetricGauge     = "gauge"
+	MetricHistogram = "histogram"
+)
+
+//	Seconds, from 5 ms up to IR sends queued behind a macro
+var DefaultHTTPBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+//	Metrics updated where the events happen, written by MetricsHandler
+var (
+	relaySwitches      = NewCounter("shc_relay_switches_total", "Relay operations by relay and command.", "relay", "command")
+	relayState         = NewGauge("shc_relay_state", "Measured lamp relay state, 1 when on.", "relay", "name")
+	cpuTemperature     = NewGauge("shc_cpu_temperature_celsius", "CPU temperature.")
+	analogVariance     = NewGauge("shc_analog_variance", "Variance of the current sensor ADC readings.")
+	irSent             = NewCounter("shc_ir_sent_total", "Infrared frames sent by emitter pin.", "pin")
+	irSendFailures     = NewCounter("shc_ir_send_failures_total", "Infrared frames not sent by emitter pin, including full queues.", "pin")
+	irReceived         = NewCounter("shc_ir_received_total", "Infrared frames received by protocol.", "protocol")
+	irReceiveErrors    = NewCounter("shc_ir_receive_errors_total", "Infrared receiver errors.")
+	httpDuration       = NewHistogram("shc_http_request_duration_seconds", "HTTP request latency by route, method and status code.", DefaultHTTPBuckets, "route", "method", "code")
+	bleConnections     = NewGauge("shc_ble_connections", "Connected BLE centrals.")
+	bleConnectionTotal = NewCounter("shc_ble_connections_total", "BLE connections accepted.")
+	telemetryState     = NewGauge("shc_telemetry_state", "Telemetry connection state, 1 for the current one.", "state")
+	telemetryQueued    = NewGauge("shc_telemetry_queued_records", "Telemetry records waiting to be sent.")
+	telemetryAttempts  = NewGauge("shc_telemetry_connection_attempts", "Failed telemetry connection attempts since the last connection.")
+	databaseErrors     = NewCounter("shc_database_errors_total", "Database errors by kind.", "kind")
+)
+
+var metricsRegistry struct {
+	metrics []*Metric
+	sync.Mutex
+}
+
+//	Metric is a family of series of one type, one series per label values
+type Metric struct {
+	Name    string
+	Help    string
+	Type    string
+	Labels  []string
+	Buckets []float64
+
+	series map[string]*metricSeries
+	lock   sync.Mutex
+}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+func newMetric(name, help, kind string, buckets []float64, labels []string) *Metric {
+	m := &Metric{
+		Name:    name,
+		Help:    help,
+		Type:    kind,
+		Labels:  labels,
+		Buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+	metricsRegistry.Lock()
+	metricsRegistry.metrics = append(metricsRegistry.metrics, m)
+	metricsRegistry.Unlock()
+	return m
+}
+
+func NewCounter(name, help string, labels ...string) *Metric {
+	return newMetric(name, help, MetricCounter, nil, labels)
+}
+
+func NewGauge(name, help string, labels ...string) *Metric {
+	return newMetric(name, help, MetricGauge, nil, labels)
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Metric {
+	return newMetric(name, help, MetricHistogram, buckets, labels)
+}
+
+//	get returns the series of values, which must match the labels in number
+func (m *Metric) get(values []string) *metricSeries {
+	if len(values) != len(m.Labels) {
+		panic(fmt.Sprintf("metric %s: %d label values for %d labels", m.Name, len(values), len(m.Labels)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labels: append([]string(nil), values...)}
+		if m.Type == MetricHistogram {
+			s.counts = make([]uint64, len(m.Buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *Metric) Inc(values ...string) {
+	m.Add(1, values...)
+}
+
+func (m *Metric) Add(delta float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(values).value += delta
+}
+
+func (m *Metric) Set(value float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(values).value = value
+}
+
+//	Observe adds value to a histogram
+func (m *Metric) Observe(value float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s := m.get(values)
+	for k, bound := range m.Buckets {
+		if value <= bound {
+			s.counts[k]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+//	Reset drops every series, for gauges of things that may disappear
+func (m *Metric) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.series = make(map[string]*metricSeries)
+}
+
+//	Write writes m in the Prometheus text format, series sorted by labels
+func (m *Metric) Write(w io.Writer) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(m.Help), m.Name, m.Type)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.Type != MetricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.Name, m.labels(s.labels, ""), formatMetric(s.value))
+			continue
+		}
+		for k, bound := range m.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.Name, m.labels(s.labels, formatMetric(bound)), s.counts[k])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.Name, m.labels(s.labels, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.Name, m.labels(s.labels, ""), formatMetric(s.value))
+		_, err := fmt.Fprintf(w, "%s_count%s %d\n", m.Name, m.labels(s.labels, ""), s.count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//	labels formats {name="value",...}, with le last for histogram buckets
+func (m *Metric) labels(values []string, le string) string {
+	var pairs []string
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for k, name := range m.Labels {
+		pairs = append(pairs, name+`="`+escape.Replace(values[k])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetric(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+//	Responsibilities:
+//	*	To expose the system metrics to Prometheus
+//	MetricsManager
+type MetricsManager struct {
+	LogFile *os.File
+	Logger  *log.Logger
+
+	Repository
+	DeviceManager    *DeviceManager
+	RelayManager     *RelayManager
+	TelemetryManager *TelemetryManager
+}
+
+func NewMetricsManager() *MetricsManager {
+	return &MetricsManager{}
+}
+
+func (mm *MetricsManager) Initialize(logPath string, repository Repository, deviceManager *DeviceManager, relayManager *RelayManager, telemetryManager *TelemetryManager) error {
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	mm.LogFile = f
+	mm.Logger = log.New(mm.LogFile, "", log.Ldate|log.Ltime)
+	mm.Repository = repository
+	mm.DeviceManager = deviceManager
+	mm.RelayManager = relayManager
+	mm.TelemetryManager = telemetryManager
+	mm.Logger.Printf("MetricsManager started.\n")
+	return nil
+}
+
+func (mm *MetricsManager) Close() {
+	mm.Logger.Printf("MetricsManager closed.\n")
+	mm.LogFile.Close()
+}
+
+//	collect updates the gauges read on every scrape
+func (mm *MetricsManager) collect() {
+	//Leituras que falham somem da página em vez de repetir o valor antigo
+	cpuTemperature.Reset()
+	if temperature, err := mm.DeviceManager.ReadTemperature(); err != nil {
+		mm.Logger.Printf("%v\n", err)
+	} else {
+		cpuTemperature.Set(temperature)
+	}
+	analogVariance.Reset()
+	relayState.Reset()
+	//Uma só leitura do sensor de corrente serve a todos os relés
+	if variance, err := mm.DeviceManager.ReadAnalogVariance(); err != nil {
+		mm.Logger.Printf("%v\n", err)
+	} else {
+		analogVariance.Set(variance)
+		mm.collectRelays(variance)
+	}
+	status := mm.TelemetryManager.Status()
+	for _, state := range []string{TelemetryDisconnected, TelemetryConnecting, TelemetryConnected} {
+		current := 0.0
+		if state == status.State {
+			current = 1
+		}
+		telemetryState.Set(current, state)
+	}
+	telemetryQueued.Set(float64(status.Queued))
+	telemetryAttempts.Set(float64(status.Attempts))
+}
+
+//	collectRelays sets the state of the lamp relays; the state of the others
+//	is not measured, so they have no series
+func (mm *MetricsManager) collectRelays(variance float64) {
+	relays, err := mm.Repository.ReadRelay()
+	if err != nil {
+		mm.Logger.Printf("reading relays: %v\n", err)
+		return
+	}
+	for _, relay := range relays {
+		if relay.Type != TypeLamp {
+			continue
+		}
+		on := 0.0
+		if lampState(relay, variance) == RelayOn {
+			on = 1
+		}
+		relayState.Set(on, strconv.Itoa(relay.ID), relay.Name)
+	}
+}
+
+func (mm *MetricsManager) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	mm.collect()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metricsRegistry.Lock()
+	metrics := append([]*Metric(nil), metricsRegistry.metrics...)
+	metricsRegistry.Unlock()
+	sort.Slice(metrics, func(a, b int) bool {
+		return metrics[a].Name < metrics[b].Name
+	})
+	buffered := bufio.NewWriter(w)
+	for _, m := range metrics {
+		if err := m.Write(buffered); err != nil {
+			mm.Logger.Printf("writing metrics: %v\n", err)
+			return
+		}
+	}
+	buffered.Flush()
+}
+
+//	metricsMiddleware observes the latency of every request by route template,
+//	so that /api/macros/1 and /api/macros/2 share a series
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		httpDuration.Observe(time.Since(start).Seconds(), route, r.Method, strconv.Itoa(recorder.status))
+	})
+}
+
+//	statusRecorder keeps the status written by a handler, passing through
+//	flushes and hijacks for streaming and websocket handlers
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
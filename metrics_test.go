@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func metricOutput(t *testing.T, m *Metric) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := m.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestMetricsCollect(t *testing.T) {
+	defer func(temperature, analogVariance string) {
+		temperatureCommand, analogVarianceCommand = temperature, analogVariance
+	}(temperatureCommand, analogVarianceCommand)
+	tm := testTelemetryManager(t)
+	tm.Repository.(*telemetryRepository).relays = []Relay{
+		{ID: 1, Name: "sala", Type: TypeLamp},
+		{ID: 2, Name: "portao", Type: "gate"},
+	}
+	mm := &MetricsManager{
+		Logger:           tm.Logger,
+		Repository:       tm.Repository,
+		DeviceManager:    &DeviceManager{Logger: tm.Logger},
+		TelemetryManager: tm,
+	}
+
+	temperatureCommand, analogVarianceCommand = "echo \"temp=48.3'C\"", "echo 0.010"
+	mm.collect()
+	if out := metricOutput(t, cpuTemperature); !strings.Contains(out, "shc_cpu_temperature_celsius 48.3") {
+		t.Errorf("temperature:\n%s", out)
+	}
+	out := metricOutput(t, relayState)
+	if !strings.Contains(out, `relay="1"`) || !strings.HasSuffix(strings.TrimSpace(out), " 1") {
+		t.Errorf("lamp state missing or off:\n%s", out)
+	}
+	if strings.Contains(out, `relay="2"`) {
+		t.Errorf("state of a relay that is not a lamp:\n%s", out)
+	}
+
+	temperatureCommand, analogVarianceCommand = "exit 1", "exit 1"
+	mm.collect()
+	for _, m := range []*Metric{cpuTemperature, analogVariance, relayState} {
+		if out := metricOutput(t, m); strings.Contains(out, "\nshc_") {
+			t.Errorf("failed reading still exported:\n%s", out)
+		}
+	}
+}
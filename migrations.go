@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	//Aplicação das migrações ao iniciar: auto, dry-run ou off
+	//Com dry-run as migrações são testadas e o servidor não inicia
+	ConfigDatabaseMigrate = "DATABASE_MIGRATE"
+
+	MigrateAuto   = "auto"
+	MigrateDryRun = "dry-run"
+	MigrateOff    = "off"
+)
+
+//	Migration is a forward-only schema change identified by its version
+//	Versions are never reused or reordered once released; a change to an
+//	existing table is a new migration, not an edit of an old one
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+//	SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+var Migrations = []Migration{
+	//Tabelas criadas pelo AutoMigrate antes das migrações versionadas
+	{1, "baseline", func(tx *gorm.DB) error {
+		return execDDL(tx,
+			`CREATE TABLE IF NOT EXISTS relays (
+				id serial PRIMARY KEY,
+				name text,
+				type text,
+				state_address integer,
+				relay_pin integer UNIQUE,
+				created_at timestamp with time zone,
+				updated_at timestamp with time zone,
+				deleted_at timestamp with time zone
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_relays_deleted_at ON relays (deleted_at)`,
+			`CREATE TABLE IF NOT EXISTS infos (
+				id serial PRIMARY KEY,
+				device_id integer,
+				uuid text,
+				identifier text,
+				environment text
+			)`,
+			`CREATE TABLE IF NOT EXISTS customers (
+				id serial PRIMARY KEY,
+				device_id integer,
+				name text,
+				account text,
+				hash text
+			)`,
+		)
+	}},
+	{2, "infrared", func(tx *gorm.DB) error {
+		return execDDL(tx,
+			`CREATE TABLE IF NOT EXISTS infrareds (
+				id serial PRIMARY KEY,
+				name text,
+				type text,
+				model text,
+				pin integer,
+				created_at timestamp with time zone,
+				updated_at timestamp with time zone,
+				deleted_at timestamp with time zone
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_infrareds_deleted_at ON infrareds (deleted_at)`,
+			`CREATE TABLE IF NOT EXISTS commands (
+				id serial PRIMARY KEY,
+				infrared_id integer,
+				name text,
+				protocol text,
+				code text,
+				timings text,
+				frequency integer,
+				button integer
+			)`,
+		)
+	}},
+	{3, "ac_and_rgb_states", func(tx *gorm.DB) error {
+		return execDDL(tx,
+			`CREATE TABLE IF NOT EXISTS ac_states (
+				id serial PRIMARY KEY,
+				infrared_id integer UNIQUE,
+				mode text,
+				temperature integer,
+				fan text,
+				swing boolean,
+				power boolean,
+				updated_at timestamp with time zone
+			)`,
+			`CREATE TABLE IF NOT EXISTS rgb_states (
+				id serial PRIMARY KEY,
+				infrared_id integer UNIQUE,
+				power boolean,
+				color text,
+				level integer,
+				effect text,
+				updated_at timestamp with time zone
+			)`,
+		)
+	}},
+	{4, "bindings", func(tx *gorm.DB) error {
+		return execDDL(tx,
+			`CREATE TABLE IF NOT EXISTS bindings (
+				id serial PRIMARY KEY,
+				name text,
+				protocol text,
+				address bigint,
+				command bigint,
+				created_at timestamp with time zone,
+				updated_at timestamp with time zone,
+				deleted_at timestamp with time zone
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_bindings_deleted_at ON bindings (deleted_at)`,
+			`CREATE TABLE IF NOT EXISTS binding_actions (
+				id serial PRIMARY KEY,
+				binding_id integer,
+				position integer,
+				type text,
+				relay_id integer,
+				relay_command text,
+				infrared_id integer,
+				button integer,
+				macro_id integer
+			)`,
+		)
+	}},
+	{5, "macros", func(tx *gorm.DB) error {
+		return execDDL(tx,
+			`CREATE TABLE IF NOT EXISTS macros (
+				id serial PRIMARY KEY,
+				name text,
+				created_at timestamp with time zone,
+				updated_at timestamp with time zone,
+				deleted_at timestamp with time zone
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_macros_deleted_at ON macros (deleted_at)`,
+			`CREATE TABLE IF NOT EXISTS macro_steps (
+				id serial PRIMARY KEY,
+				macro_id integer,
+				position integer,
+				infrared_id integer,
+				button integer,
+				repeat integer,
+				delay integer
+			)`,
+		)
+	}},
+	{6, "schedules", func(tx *gorm.DB) error {
+		return execDDL(tx,
+			`CREATE TABLE IF NOT EXISTS schedules (
+				id serial PRIMARY KEY,
+				pin integer,
+				type text,
+				frequency text,
+				macro_id integer,
+				at timestamp with time zone
+			)`,
+		)
+	}},
+	{7, "device_secret", func(tx *gorm.DB) error {
+		return execDDL(tx,
+			`ALTER TABLE infos ADD COLUMN secret text NOT NULL DEFAULT ''`,
+			`ALTER TABLE infos ADD COLUMN enrolled boolean NOT NULL DEFAULT false`,
+		)
+	}},
+}
+
+const schemaMigrationsDDL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version integer PRIMARY KEY,
+	name text,
+	applied_at timestamp with time zone
+)`
+
+//	sqliteTypes rewrites the postgres types of the migrations for sqlite3
+var sqliteTypes = strings.NewReplacer(
+	"serial PRIMARY KEY", "integer PRIMARY KEY AUTOINCREMENT",
+	"timestamp with time zone", "datetime",
+	"boolean", "bool",
+)
+
+//	execDDL runs statements, written for postgres, on the database of tx
+//	Migrations are plain DDL rather than gorm models, so that they keep
+//	creating the schema of their version after the models change; IF NOT
+//	EXISTS lets the baseline apply to databases created by AutoMigrate
+func execDDL(tx *gorm.DB, statements ...string) error {
+	for _, statement := range statements {
+		if tx.Dialect().GetName() == DatabaseDriverSQLite {
+			statement = sqliteTypes.Replace(statement)
+		}
+		if err := tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//	PendingMigrations returns the migrations not applied yet, in order
+//	It only reads, so it can report on a database that is not migrated yet
+func (dm *DatabaseManager) PendingMigrations() (pending []Migration, err error) {
+	var applied []SchemaMigration
+	if !dm.Kernel.HasTable(&SchemaMigration{}) {
+		return Migrations, nil
+	}
+	if err := dm.Kernel.Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	versions := make(map[int]bool)
+	for _, migration := range applied {
+		versions[migration.Version] = true
+	}
+	for _, migration := range Migrations {
+		if !versions[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+//	Migrate applies every pending migration, each in its own transaction
+//	With dryRun they all run in a single transaction that is rolled back
+func (dm *DatabaseManager) Migrate(dryRun bool) (applied []Migration, err error) {
+	pending, err := dm.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	tx := dm.Kernel.Begin()
+	if err := execDDL(tx, schemaMigrationsDDL); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, migration := range pending {
+		if err := migration.Up(tx); err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("migration %d (%s): %v", migration.Version, migration.Name, err)
+		}
+		record := SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}
+		if err := tx.Create(&record).Error; err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("migration %d (%s): %v", migration.Version, migration.Name, err)
+		}
+		applied = append(applied, migration)
+		if dryRun {
+			dm.Logger.Printf("migration %d (%s): dry run\n", migration.Version, migration.Name)
+			continue
+		}
+		if err := tx.Commit().Error; err != nil {
+			return applied[:len(applied)-1], fmt.Errorf("migration %d (%s): %v", migration.Version, migration.Name, err)
+		}
+		dm.Logger.Printf("migration %d (%s): applied\n", migration.Version, migration.Name)
+		tx = dm.Kernel.Begin()
+	}
+	tx.Rollback()
+	return applied, nil
+}
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//Sem MQTT_BROKER, como tcp://192.168.0.10:1883, a ponte fica desligada
+	ConfigMQTTBroker          = "MQTT_BROKER"
+	ConfigMQTTUsername        = "MQTT_USERNAME"
+	ConfigMQTTPassword        = "MQTT_PASSWORD"
+	ConfigMQTTClientID        = "MQTT_CLIENT_ID"
+	ConfigMQTTCAFile          = "MQTT_CA_FILE"
+	ConfigMQTTTopicPrefix     = "MQTT_TOPIC_PREFIX"
+	DefaultMQTTTopicPrefix    = "juggernaut"
+	ConfigMQTTDiscoveryPrefix = "MQTT_DISCOVERY_PREFIX"
+	//Prefixo padrão do Home Assistant
+	DefaultMQTTDiscoveryPrefix = "homeassistant"
+	//Zero desliga o keep alive e os pings; negativo volta ao padrão
+	ConfigMQTTKeepAlive  = "MQTT_KEEP_ALIVE"
+	DefaultMQTTKeepAlive = 60 * time.Second
+	//A cada intervalo os estados são publicados e a descoberta é atualizada
+	ConfigMQTTStateInterval  = "MQTT_STATE_INTERVAL"
+	DefaultMQTTStateInterval = 60 * time.Second
+	//Comandos esperando a vez; além disso são descartados para não prender
+	//a leitura da conexão
+	MQTTCommandQueue = 64
+
+	MQTTOnline  = "online"
+	MQTTOffline = "offline"
+	//Payload dos botões do Home Assistant
+	MQTTPress = "PRESS"
+)
+
+//	Responsibilities:
+//	*	To expose relays, sensors and infrared devices to Home Assistant over MQTT
+//	*	To operate them from the command topics
+//	MQTTManager
+type MQTTManager struct {
+	LogFile *os.File
+	Logger  *log.Logger
+
+	Repository
+	DeviceManager   *DeviceManager
+	RelayManager    *RelayManager
+	InfraredManager *InfraredManager
+
+	Options         MQTTOptions
+	TopicPrefix     string
+	DiscoveryPrefix string
+	StateInterval   time.Duration
+}
+
+//	haDevice groups every entity of this controller in Home Assistant
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SWVersion    string   `json:"sw_version"`
+}
+
+//	mqttBridge holds the topics of one connection, derived from Info
+type mqttBridge struct {
+	client *MQTTClient
+	info   Info
+	base   string
+	node   string
+	device haDevice
+
+	discovery *mqttDiscovery
+}
+
+//	mqttDiscovery holds the discovery configurations retained by the broker,
+//	so that only changed entities are republished and deleted ones cleared
+type mqttDiscovery struct {
+	lock      sync.Mutex
+	published map[string][]byte
+}
+
+func NewMQTTManager() *MQTTManager {
+	return &MQTTManager{}
+}
+
+func (m *MQTTManager) Initialize(logPath string, repository Repository, deviceManager *DeviceManager, relayManager *RelayManager, infraredManager *InfraredManager) error {
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	m.LogFile = f
+	m.Logger = log.New(m.LogFile, "", log.Ldate|log.Ltime)
+	m.Repository = repository
+	m.DeviceManager = deviceManager
+	m.RelayManager = relayManager
+	m.InfraredManager = infraredManager
+	m.Options = MQTTOptions{
+		Broker:    envString(ConfigMQTTBroker, ""),
+		ClientID:  envString(ConfigMQTTClientID, ""),
+		Username:  envString(ConfigMQTTUsername, ""),
+		Password:  envString(ConfigMQTTPassword, ""),
+		KeepAlive: envDuration(ConfigMQTTKeepAlive, DefaultMQTTKeepAlive),
+	}
+	if m.Options.KeepAlive < 0 {
+		m.Options.KeepAlive = DefaultMQTTKeepAlive
+	}
+	if file := envString(ConfigMQTTCAFile, ""); file != "" {
+		pool, err := loadRootCAs(file)
+		if err != nil {
+			return err
+		}
+		m.Options.TLS = &tls.Config{RootCAs: pool}
+	}
+	m.TopicPrefix = envString(ConfigMQTTTopicPrefix, DefaultMQTTTopicPrefix)
+	m.DiscoveryPrefix = envString(ConfigMQTTDiscoveryPrefix, DefaultMQTTDiscoveryPrefix)
+	m.StateInterval = envInterval(ConfigMQTTStateInterval, DefaultMQTTStateInterval)
+	m.Logger.Printf("MQTTManager started.\n")
+	return nil
+}
+
+func (m *MQTTManager) Close() {
+	m.Logger.Printf("MQTTManager closed.\n")
+	m.LogFile.Close()
+}
+
+//	Run keeps the bridge connected until ctx is done, reconnecting with the
+//	same backoff as the telemetry
+func (m *MQTTManager) Run(ctx context.Context) {
+	if m.Options.Broker == "" {
+		m.Logger.Printf("%s not set, MQTT bridge disabled.\n", ConfigMQTTBroker)
+		return
+	}
+	backoff := TelemetryBackoffMin
+	for {
+		started := time.Now()
+		err := m.session(ctx)
+		if ctx.Err() != nil {
+			m.Logger.Printf("MQTTManager#Run(): stopped.\n")
+			return
+		}
+		stable := m.Options.KeepAlive * 2
+		if stable <= 0 {
+			stable = DefaultMQTTKeepAlive * 2
+		}
+		if time.Since(started) > stable {
+			backoff = TelemetryBackoffMin
+		}
+		delay := jitter(backoff)
+		m.Logger.Printf("mqtt connection: %v; reconnecting in %s\n", err, delay)
+		select {
+		case <-ctx.Done():
+			m.Logger.Printf("MQTTManager#Run(): stopped.\n")
+			return
+		case <-time.After(delay):
+		}
+		if backoff *= 2; backoff > TelemetryBackoffMax {
+			backoff = TelemetryBackoffMax
+		}
+	}
+}
+
+func (m *MQTTManager) session(ctx context.Context) error {
+	info, err := m.Repository.ReadInfo()
+	if err != nil {
+		return err
+	}
+	b := m.bridge(info)
+	options := m.Options
+	if options.ClientID == "" {
+		options.ClientID = b.node
+	}
+	//O broker marca o dispositivo como indisponível se a conexão cair
+	options.Will = &MQTTMessage{Topic: b.base + "/availability", Payload: []byte(MQTTOffline), Retain: true}
+	dialCtx, cancel := context.WithTimeout(ctx, TelemetryWriteWait)
+	b.client, err = DialMQTT(dialCtx, options)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer b.client.Close()
+	m.Logger.Printf("MQTTManager#Run(): connected to %s as %s.\n", options.Broker, options.ClientID)
+
+	homeAssistantStatus := m.DiscoveryPrefix + "/status"
+	//As configurações retidas de uma conexão anterior chegam na assinatura,
+	//inclusive as de entidades removidas enquanto a ponte estava desligada
+	err = b.client.Subscribe(
+		b.base+"/relay/+/set",
+		b.base+"/infrared/+/+/press",
+		b.base+"/ac/+/+/set",
+		homeAssistantStatus,
+		m.DiscoveryPrefix+"/+/"+b.node+"/+/config",
+	)
+	if err != nil {
+		return err
+	}
+	if err := m.announce(b); err != nil {
+		return err
+	}
+
+	//A sessão só termina depois de quem publica e de quem roda comandos
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	//Fechado ao fim da sessão para liberar as goroutines da conexão
+	stop := make(chan struct{})
+	defer close(stop)
+	messages := make(chan MQTTMessage)
+	done := make(chan error, 1)
+	go func() {
+		for {
+			message, err := b.client.Read()
+			if err != nil {
+				done <- err
+				return
+			}
+			select {
+			case messages <- message:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	//Uma só goroutine publica; pedidos feitos enquanto ela trabalha se juntam
+	refresh := make(chan struct{}, 1)
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-refresh:
+				if err := m.publishDiscovery(b); err != nil {
+					m.Logger.Printf("publishing discovery: %v\n", err)
+				}
+				m.publishStates(b)
+			}
+		}
+	}()
+	request := func() {
+		select {
+		case refresh <- struct{}{}:
+		default:
+		}
+	}
+	//Os comandos rodam um de cada vez, na ordem em que chegam: dois ajustes
+	//do mesmo ar-condicionado não podem ler o mesmo estado anterior
+	commands := make(chan MQTTMessage, MQTTCommandQueue)
+	go func() {
+		defer workers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case message := <-commands:
+				m.handle(b, message)
+			}
+		}
+	}()
+	//Sem keep alive o broker não espera pings
+	var pings <-chan time.Time
+	if m.Options.KeepAlive > 0 {
+		ping := time.NewTicker(m.Options.KeepAlive / 2)
+		defer ping.Stop()
+		pings = ping.C
+	}
+	states := time.NewTicker(m.StateInterval)
+	defer states.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			b.client.Publish(MQTTMessage{Topic: b.base + "/availability", Payload: []byte(MQTTOffline), Retain: true})
+			b.client.Disconnect()
+			return nil
+		case err := <-done:
+			return err
+		case <-pings:
+			if err := b.client.Ping(); err != nil {
+				return err
+			}
+		case <-states.C:
+			request()
+		case message := <-messages:
+			switch {
+			case message.Topic == homeAssistantStatus:
+				//Home Assistant reiniciado perde os estados não retidos
+				if string(message.Payload) == MQTTOnline {
+					request()
+				}
+			case strings.HasPrefix(message.Topic, m.DiscoveryPrefix+"/"):
+				if b.discovery.retained(message) {
+					request()
+				}
+			default:
+				select {
+				case commands <- message:
+				default:
+					m.Logger.Printf("dropping %s: %d commands waiting\n", message.Topic, MQTTCommandQueue)
+				}
+			}
+		}
+	}
+}
+
+func (m *MQTTManager) bridge(info Info) mqttBridge {
+	node := "juggernaut_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, info.UUID)
+	name := info.Identifier
+	if name == "" {
+		name = node
+	}
+	return mqttBridge{
+		info: info,
+		base: m.TopicPrefix + "/" + info.UUID,
+		node: node,
+		discovery: &mqttDiscovery{
+			published: make(map[string][]byte),
+		},
+		device: haDevice{
+			Identifiers:  []string{node},
+			Name:         name,
+			Manufacturer: "Solutech",
+			Model:        "SHC",
+			SWVersion:    Version,
+		},
+	}
+}
+
+//	announce publishes the discovery configuration of every entity, the
+//	availability and the current states
+func (m *MQTTManager) announce(b mqttBridge) error {
+	if err := m.publishDiscovery(b); err != nil {
+		m.Logger.Printf("publishing discovery: %v\n", err)
+		return err
+	}
+	if err := b.client.Publish(MQTTMessage{Topic: b.base + "/availability", Payload: []byte(MQTTOnline), Retain: true}); err != nil {
+		return err
+	}
+	m.publishStates(b)
+	return nil
+}
+
+//	publishDiscovery publishes the configurations that changed since they
+//	were last published and clears those of deleted entities with an empty
+//	retained payload
+func (m *MQTTManager) publishDiscovery(b mqttBridge) error {
+	configs, err := m.discovery(b)
+	if err != nil {
+		return err
+	}
+	b.discovery.lock.Lock()
+	defer b.discovery.lock.Unlock()
+	for topic, config := range configs {
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(b.discovery.published[topic], payload) {
+			continue
+		}
+		if err := b.client.Publish(MQTTMessage{Topic: topic, Payload: payload, Retain: true}); err != nil {
+			return err
+		}
+		b.discovery.published[topic] = payload
+	}
+	for topic := range b.discovery.published {
+		if _, ok := configs[topic]; ok {
+			continue
+		}
+		if err := b.client.Publish(MQTTMessage{Topic: topic, Retain: true}); err != nil {
+			return err
+		}
+		delete(b.discovery.published, topic)
+	}
+	return nil
+}
+
+//	retained records a configuration found on the broker; it is true when the
+//	configuration was not published by this connection and must be checked
+func (d *mqttDiscovery) retained(message MQTTMessage) bool {
+	if len(message.Payload) == 0 {
+		return false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.published[message.Topic]; ok {
+		return false
+	}
+	d.published[message.Topic] = message.Payload
+	return true
+}
+
+//	discovery returns the configurations by topic: relays as lights or
+//	switches, temperature and current as sensors, learned buttons as buttons
+//	and air conditioners as climate entities
+func (m *MQTTManager) discovery(b mqttBridge) (map[string]map[string]interface{}, error) {
+	configs := make(map[string]map[string]interface{})
+	entity := func(component, object, name string, config map[string]interface{}) {
+		config["name"] = name
+		config["unique_id"] = b.node + "_" + object
+		config["availability_topic"] = b.base + "/availability"
+		config["device"] = b.device
+		configs[m.DiscoveryPrefix+"/"+component+"/"+b.node+"/"+object+"/config"] = config
+	}
+
+	relays, err := m.Repository.ReadRelay()
+	if err != nil {
+		return nil, err
+	}
+	for _, relay := range relays {
+		component := "switch"
+		if relay.Type == TypeLamp {
+			component = "light"
+		}
+		topic := fmt.Sprintf("%s/relay/%d", b.base, relay.ID)
+		config := map[string]interface{}{
+			"command_topic": topic + "/set",
+			"payload_on":    CommandOn,
+			"payload_off":   CommandOff,
+		}
+		//Só as lâmpadas têm o estado medido; os outros relés são otimistas
+		if relay.Type == TypeLamp {
+			config["state_topic"] = topic + "/state"
+			config["state_on"] = RelayOn
+			config["state_off"] = RelayOff
+		} else {
+			config["optimistic"] = true
+		}
+		entity(component, fmt.Sprintf("relay_%d", relay.ID), relay.Name, config)
+	}
+
+	entity("sensor", "temperature", "Temperature", map[string]interface{}{
+		"state_topic":         b.base + "/sensor/temperature",
+		"device_class":        "temperature",
+		"unit_of_measurement": "°C",
+		"state_class":         "measurement",
+	})
+	entity("sensor", "current", "Current variance", map[string]interface{}{
+		"state_topic": b.base + "/sensor/current",
+		"state_class": "measurement",
+	})
+
+	devices, err := m.Repository.ReadInfrared()
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if device.Type == TypeAC {
+			model, ok := ACModels[device.Model]
+			if !ok {
+				continue
+			}
+			capabilities := model.Capabilities()
+			topic := fmt.Sprintf("%s/ac/%d", b.base, device.ID)
+			modes := []string{"off"}
+			for _, mode := range capabilities.Modes {
+				modes = append(modes, haACMode(mode))
+			}
+			config := map[string]interface{}{
+				"modes":                     modes,
+				"mode_command_topic":        topic + "/mode/set",
+				"mode_state_topic":          topic + "/mode",
+				"temperature_command_topic": topic + "/temperature/set",
+				"temperature_state_topic":   topic + "/temperature",
+				"min_temp":                  capabilities.MinTemperature,
+				"max_temp":                  capabilities.MaxTemperature,
+				"temp_step":                 1,
+				"fan_modes":                 capabilities.Fans,
+				"fan_mode_command_topic":    topic + "/fan/set",
+				"fan_mode_state_topic":      topic + "/fan",
+			}
+			if capabilities.Swing {
+				config["swing_modes"] = []string{"on", "off"}
+				config["swing_mode_command_topic"] = topic + "/swing/set"
+				config["swing_mode_state_topic"] = topic + "/swing"
+			}
+			entity("climate", fmt.Sprintf("ac_%d", device.ID), device.Name, config)
+			continue
+		}
+		for _, command := range device.Commands {
+			name := command.Name
+			if name == "" {
+				name = "Button " + strconv.Itoa(command.Button)
+			}
+			entity("button", fmt.Sprintf("infrared_%d_%d", device.ID, command.Button), device.Name+" "+name, map[string]interface{}{
+				"command_topic": fmt.Sprintf("%s/infrared/%d/%d/press", b.base, device.ID, command.Button),
+				"payload_press": MQTTPress,
+			})
+		}
+	}
+	return configs, nil
+}
+
+//	publishStates publishes the sensors, the measured relay states and the
+//	air conditioner states
+func (m *MQTTManager) publishStates(b mqttBridge) {
+	publish := func(topic, payload string) {
+		if err := b.client.Publish(MQTTMessage{Topic: topic, Payload: []byte(payload)}); err != nil {
+			m.Logger.Printf("publishing %s: %v\n", topic, err)
+		}
+	}
+	if temperature, err := m.DeviceManager.ReadTemperature(); err != nil {
+		m.Logger.Printf("%v\n", err)
+	} else {
+		publish(b.base+"/sensor/temperature", strconv.FormatFloat(temperature, 'f', 1, 64))
+	}
+	//Uma só leitura do sensor de corrente serve a todos os relés; sem ela os
+	//estados publicados antes continuam valendo
+	if variance, err := m.DeviceManager.ReadAnalogVariance(); err != nil {
+		m.Logger.Printf("%v\n", err)
+	} else {
+		publish(b.base+"/sensor/current", strconv.FormatFloat(variance, 'f', 3, 64))
+		relays, err := m.Repository.ReadRelay()
+		if err != nil {
+			m.Logger.Printf("reading relays: %v\n", err)
+		}
+		for _, relay := range relays {
+			if relay.Type == TypeLamp {
+				publish(fmt.Sprintf("%s/relay/%d/state", b.base, relay.ID), lampState(relay, variance))
+			}
+		}
+	}
+	devices, err := m.Repository.ReadInfrared()
+	if err != nil {
+		m.Logger.Printf("reading infrared: %v\n", err)
+	}
+	for _, device := range devices {
+		if device.Type != TypeAC {
+			continue
+		}
+		state, err := m.Repository.ReadACState(device.ID)
+		if err == ErrNotFound {
+			state, err = DefaultACState(device.ID), nil
+		}
+		if err != nil {
+			m.Logger.Printf("reading ac state %d: %v\n", device.ID, err)
+			continue
+		}
+		m.publishAC(b, device, state)
+	}
+}
+
+func (m *MQTTManager) publishAC(b mqttBridge, device Infrared, state ACState) {
+	topic := fmt.Sprintf("%s/ac/%d", b.base, device.ID)
+	mode := "off"
+	if state.Power {
+		mode = haACMode(state.Mode)
+	}
+	swing := "off"
+	if state.Swing {
+		swing = "on"
+	}
+	for suffix, payload := range map[string]string{
+		"/mode":        mode,
+		"/temperature": strconv.Itoa(state.Temperature),
+		"/fan":         state.Fan,
+		"/swing":       swing,
+	} {
+		if err := b.client.Publish(MQTTMessage{Topic: topic + suffix, Payload: []byte(payload)}); err != nil {
+			m.Logger.Printf("publishing %s: %v\n", topic+suffix, err)
+		}
+	}
+}
+
+//	handle runs a message of a command topic:
+//	<base>/relay/<id>/set, <base>/infrared/<id>/<button>/press and
+//	<base>/ac/<id>/<mode|temperature|fan|swing>/set
+func (m *MQTTManager) handle(b mqttBridge, message MQTTMessage) {
+	parts := strings.Split(strings.TrimPrefix(message.Topic, b.base+"/"), "/")
+	payload := string(message.Payload)
+	var err error
+	switch {
+	case len(parts) == 3 && parts[0] == "relay" && parts[2] == "set":
+		err = m.operateRelay(b, parts[1], payload)
+	case len(parts) == 4 && parts[0] == "infrared" && parts[3] == "press":
+		err = m.pressButton(parts[1], parts[2])
+	case len(parts) == 4 && parts[0] == "ac" && parts[3] == "set":
+		err = m.setAC(b, parts[1], parts[2], payload)
+	default:
+		err = fmt.Errorf("unknown topic")
+	}
+	if err != nil {
+		m.Logger.Printf("handling %s (%q): %v\n", message.Topic, payload, err)
+	}
+}
+
+func (m *MQTTManager) operateRelay(b mqttBridge, id, command string) error {
+	if command != CommandOn && command != CommandOff && command != CommandToggle {
+		return fmt.Errorf("relay command %q", command)
+	}
+	relayID, err := strconv.Atoi(id)
+	if err != nil {
+		return err
+	}
+	relay, err := m.Repository.ReadRelayByID(relayID)
+	if err != nil {
+		return err
+	}
+	m.RelayManager.Operate(relay, command)
+	if relay.Type != TypeLamp {
+		return nil
+	}
+	variance, err := m.DeviceManager.ReadAnalogVariance()
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(MQTTMessage{Topic: fmt.Sprintf("%s/relay/%d/state", b.base, relay.ID), Payload: []byte(lampState(relay, variance))})
+}
+
+func (m *MQTTManager) pressButton(id, button string) error {
+	deviceID, err := strconv.Atoi(id)
+	if err != nil {
+		return err
+	}
+	buttonID, err := strconv.Atoi(button)
+	if err != nil {
+		return err
+	}
+	device, err := m.Repository.ReadInfraredByID(deviceID)
+	if err != nil {
+		return err
+	}
+	command, err := m.Repository.ReadCommand(deviceID, buttonID)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), TransmitWait)
+	defer cancel()
+	return m.InfraredManager.SendCommand(ctx, device, command)
+}
+
+func (m *MQTTManager) setAC(b mqttBridge, id, field, payload string) error {
+	deviceID, err := strconv.Atoi(id)
+	if err != nil {
+		return err
+	}
+	device, err := m.Repository.ReadInfraredByID(deviceID)
+	if err == nil && device.Type != TypeAC {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	state, err := m.Repository.ReadACState(device.ID)
+	if err == ErrNotFound {
+		state, err = DefaultACState(device.ID), nil
+	}
+	if err != nil {
+		return err
+	}
+	switch field {
+	case "mode":
+		if payload == "off" {
+			state.Power = false
+		} else {
+			state.Mode = acMode(payload)
+			state.Power = true
+		}
+	case "temperature":
+		temperature, err := strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return err
+		}
+		state.Temperature = int(math.Round(temperature))
+	case "fan":
+		state.Fan = payload
+	case "swing":
+		state.Swing = payload == "on"
+	default:
+		return fmt.Errorf("unknown ac field %q", field)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), TransmitWait)
+	defer cancel()
+	state, err = m.InfraredManager.SetAC(ctx, device, state)
+	if err != nil {
+		return err
+	}
+	m.publishAC(b, device, state)
+	return nil
+}
+
+//	Home Assistant names the fan mode fan_only
+func haACMode(mode string) string {
+	if mode == ACModeFan {
+		return "fan_only"
+	}
+	return mode
+}
+
+func acMode(mode string) string {
+	if mode == "fan_only" {
+		return ACModeFan
+	}
+	return mode
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func (r *telemetryRepository) ReadInfrared() ([]Infrared, error) {
+	return nil, nil
+}
+
+//	testBroker is an MQTT broker just big enough for the bridge: QoS 0,
+//	retained messages and the + wildcard
+type testBroker struct {
+	listener net.Listener
+	lock     sync.Mutex
+	retained map[string][]byte
+	clients  map[*MQTTClient][]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{
+		listener: listener,
+		retained: make(map[string][]byte),
+		clients:  make(map[*MQTTClient][]string),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(&MQTTClient{conn: conn, reader: bufio.NewReader(conn)})
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *testBroker) Close() {
+	b.listener.Close()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for c := range b.clients {
+		c.Close()
+	}
+}
+
+func (b *testBroker) serve(c *MQTTClient) {
+	b.lock.Lock()
+	b.clients[c] = nil
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		delete(b.clients, c)
+		b.lock.Unlock()
+		c.Close()
+	}()
+	for {
+		header, body, err := c.readPacket()
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case mqttConnect:
+			c.write(mqttConnack<<4, []byte{0, 0})
+		case mqttSubscribe:
+			var granted []byte
+			for rest := body[2:]; len(rest) > 0; rest = rest[1:] {
+				var filter string
+				if filter, rest, err = readMQTTString(rest); err != nil {
+					return
+				}
+				granted = append(granted, 0)
+				b.lock.Lock()
+				b.clients[c] = append(b.clients[c], filter)
+				for topic, payload := range b.retained {
+					if mqttMatch(filter, topic) {
+						c.Publish(MQTTMessage{Topic: topic, Payload: payload, Retain: true})
+					}
+				}
+				b.lock.Unlock()
+			}
+			c.write(mqttSuback<<4, append(body[:2:2], granted...))
+		case mqttPublish:
+			topic, payload, err := readMQTTString(body)
+			if err != nil {
+				return
+			}
+			b.Publish(MQTTMessage{Topic: topic, Payload: payload, Retain: header&0x01 != 0})
+		case mqttPingreq:
+			c.write(mqttPingresp<<4, nil)
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+//	Publish stores retained messages, an empty payload removing them, and
+//	forwards message to the subscribers
+func (b *testBroker) Publish(message MQTTMessage) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if message.Retain {
+		if len(message.Payload) == 0 {
+			delete(b.retained, message.Topic)
+		} else {
+			b.retained[message.Topic] = message.Payload
+		}
+	}
+	for c, filters := range b.clients {
+		for _, filter := range filters {
+			if mqttMatch(filter, message.Topic) {
+				c.Publish(MQTTMessage{Topic: message.Topic, Payload: message.Payload})
+				break
+			}
+		}
+	}
+}
+
+func (b *testBroker) Retained(topic string) (string, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	payload, ok := b.retained[topic]
+	return string(payload), ok
+}
+
+//	waitFor polls condition until it holds or a few seconds pass
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func mqttMatch(filter, topic string) bool {
+	filters, topics := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if len(filters) != len(topics) {
+		return false
+	}
+	for i := range filters {
+		if filters[i] != "+" && filters[i] != topics[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testMQTTManager(t *testing.T, broker *testBroker) (*MQTTManager, *telemetryRepository) {
+	t.Helper()
+	repository := &telemetryRepository{info: Info{UUID: "device", Identifier: "Casa"}}
+	logger := log.New(ioutil.Discard, "", 0)
+	return &MQTTManager{
+		Logger:          logger,
+		Repository:      repository,
+		DeviceManager:   &DeviceManager{Logger: logger},
+		Options:         MQTTOptions{Broker: broker.URL(), KeepAlive: 10 * time.Second},
+		TopicPrefix:     DefaultMQTTTopicPrefix,
+		DiscoveryPrefix: DefaultMQTTDiscoveryPrefix,
+		StateInterval:   20 * time.Millisecond,
+	}, repository
+}
+
+//	TestMQTTDiscovery connects the bridge to a broker that retains the
+//	configuration of a relay deleted while it was offline, then adds and
+//	removes relays while connected
+func TestMQTTDiscovery(t *testing.T) {
+	defer func(temperature, analogVariance string) {
+		temperatureCommand, analogVarianceCommand = temperature, analogVariance
+	}(temperatureCommand, analogVarianceCommand)
+	temperatureCommand, analogVarianceCommand = "echo \"temp=48.3'C\"", "echo 0.010"
+	goroutines := runtime.NumGoroutine()
+
+	broker := newTestBroker(t)
+	defer broker.Close()
+	config := func(component, object string) string {
+		return DefaultMQTTDiscoveryPrefix + "/" + component + "/juggernaut_device/" + object + "/config"
+	}
+	broker.Publish(MQTTMessage{Topic: config("switch", "relay_9"), Payload: []byte("{}"), Retain: true})
+	m, repository := testMQTTManager(t, broker)
+	repository.setRelays([]Relay{{ID: 1, Name: "sala", Type: TypeLamp}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- m.session(ctx) }()
+
+	waitFor(t, "availability", func() bool {
+		availability, _ := broker.Retained(DefaultMQTTTopicPrefix + "/device/availability")
+		return availability == MQTTOnline
+	})
+	if _, ok := broker.Retained(config("light", "relay_1")); !ok {
+		t.Error("relay 1 not announced")
+	}
+	waitFor(t, "the deleted relay to be cleared", func() bool {
+		_, ok := broker.Retained(config("switch", "relay_9"))
+		return !ok
+	})
+
+	//Os estados não são retidos; um cliente assinante os recebe periodicamente
+	listener, err := DialMQTT(ctx, MQTTOptions{Broker: broker.URL(), ClientID: "listener"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err := listener.Subscribe(DefaultMQTTTopicPrefix+"/device/relay/+/state", DefaultMQTTTopicPrefix+"/device/sensor/+"); err != nil {
+		t.Fatal(err)
+	}
+	received := make(map[string]string)
+	for len(received) < 3 {
+		listener.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		message, err := listener.Read()
+		if err != nil {
+			t.Fatalf("reading states: %v (received %v)", err, received)
+		}
+		received[strings.TrimPrefix(message.Topic, DefaultMQTTTopicPrefix+"/device/")] = string(message.Payload)
+	}
+	if received["relay/1/state"] != RelayOn || received["sensor/temperature"] != "48.3" || received["sensor/current"] != "0.010" {
+		t.Errorf("states %v", received)
+	}
+
+	before, _ := broker.Retained(config("light", "relay_1"))
+	repository.setRelays([]Relay{
+		{ID: 1, Name: "sala de estar", Type: TypeLamp},
+		{ID: 2, Name: "portão", Type: "gate"},
+	})
+	waitFor(t, "the new relay", func() bool {
+		_, ok := broker.Retained(config("switch", "relay_2"))
+		return ok
+	})
+	waitFor(t, "the renamed relay", func() bool {
+		after, _ := broker.Retained(config("light", "relay_1"))
+		return after != before && strings.Contains(after, "sala de estar")
+	})
+	repository.setRelays([]Relay{{ID: 2, Name: "portão", Type: "gate"}})
+	waitFor(t, "the removed relay to be cleared", func() bool {
+		_, ok := broker.Retained(config("light", "relay_1"))
+		return !ok
+	})
+
+	//Comandos chegando durante o fechamento não podem prender o leitor
+	flooding := make(chan struct{})
+	flooded := make(chan struct{})
+	go func() {
+		defer close(flooded)
+		for {
+			select {
+			case <-flooding:
+				return
+			default:
+				listener.Publish(MQTTMessage{Topic: DefaultMQTTTopicPrefix + "/device/relay/x/set", Payload: []byte(CommandOn)})
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	err = <-stopped
+	close(flooding)
+	<-flooded
+	if err != nil {
+		t.Errorf("session: %v", err)
+	}
+	waitFor(t, "availability offline", func() bool {
+		availability, _ := broker.Retained(DefaultMQTTTopicPrefix + "/device/availability")
+		return availability == MQTTOffline
+	})
+	listener.Close()
+	broker.Close()
+	waitFor(t, "the session goroutines to end", func() bool {
+		return runtime.NumGoroutine() <= goroutines
+	})
+}
+
+//	mqttACRepository adds the device info and the device list to the
+//	infrared fakes
+type mqttACRepository struct {
+	*infraredRepository
+	info Info
+}
+
+func (r *mqttACRepository) ReadInfo() (Info, error) {
+	return r.info, nil
+}
+
+func (r *mqttACRepository) ReadRelay() ([]Relay, error) {
+	return nil, nil
+}
+
+func (r *mqttACRepository) ReadInfrared() (devices []Infrared, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, device := range r.devices {
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+//	TestMQTTACCommands sends several settings of an air conditioner at once;
+//	each one must start from the state left by the previous
+func TestMQTTACCommands(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.Close()
+	i, _ := testInfraredManager(t)
+	repository := &mqttACRepository{
+		infraredRepository: newInfraredRepository(Infrared{ID: 1, Name: "quarto", Type: TypeAC, Model: ACModelCoolix, Pin: 17}),
+		info:               Info{UUID: "device", Identifier: "Casa"},
+	}
+	i.Repository = repository
+	m, _ := testMQTTManager(t, broker)
+	m.Repository = repository
+	m.InfraredManager = i
+	m.StateInterval = time.Minute
+	//Sem keep alive a sessão não faz pings
+	m.Options.KeepAlive = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- m.session(ctx) }()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	waitFor(t, "availability", func() bool {
+		availability, _ := broker.Retained(DefaultMQTTTopicPrefix + "/device/availability")
+		return availability == MQTTOnline
+	})
+
+	listener, err := DialMQTT(ctx, MQTTOptions{Broker: broker.URL(), ClientID: "listener"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	set := func(field, payload string) {
+		listener.Publish(MQTTMessage{Topic: DefaultMQTTTopicPrefix + "/device/ac/1/" + field + "/set", Payload: []byte(payload)})
+	}
+	set("mode", ACModeCool)
+	set("temperature", "20")
+	set("fan", ACFanHigh)
+	set("swing", "on")
+	set("temperature", "22")
+	want := ACState{InfraredID: 1, Power: true, Mode: ACModeCool, Temperature: 22, Fan: ACFanHigh, Swing: true}
+	waitFor(t, "the last setting", func() bool {
+		state, _ := repository.ReadACState(1)
+		state.ID = 0
+		return state == want
+	})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+//	MQTT 3.1.1 packet types, in the high nibble of the fixed header
+const (
+	mqttConnect       = 1
+	mqttConnack       = 2
+	mqttPublish       = 3
+	mqttPuback        = 4
+	mqttSubscribe     = 8
+	mqttSuback        = 9
+	mqttPingreq       = 12
+	mqttPingresp      = 13
+	mqttDisconnect    = 14
+	mqttMaxPacket     = 1024 * 1024
+	mqttProtocolLevel = 4
+)
+
+var (
+	ErrMQTTPacketTooLarge = errors.New("mqtt: packet too large")
+	ErrMQTTMalformed      = errors.New("mqtt: malformed packet")
+)
+
+//	Return codes of CONNACK
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+type MQTTMessage struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+//	MQTTOptions configure a connection
+//	Broker is a URL like tcp://host:1883 or ssl://host:8883 (also mqtt and mqtts)
+type MQTTOptions struct {
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	TLS       *tls.Config
+	//Publicada pelo broker se a conexão cair sem DISCONNECT
+	Will *MQTTMessage
+}
+
+//	MQTTClient is a minimal MQTT 3.1.1 client: QoS 0 publishing, QoS 0
+//	subscriptions and QoS 1 messages acknowledged on arrival
+//	Read must be called from a single goroutine; the other methods are safe
+//	for concurrent use
+type MQTTClient struct {
+	KeepAlive time.Duration
+
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+	idLock    sync.Mutex
+	nextID    uint16
+}
+
+//	DialMQTT connects to the broker and waits for its CONNACK
+func DialMQTT(ctx context.Context, options MQTTOptions) (*MQTTClient, error) {
+	u, err := url.Parse(options.Broker)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dialer.DialContext(ctx, "tcp", hostPort(u, "1883"))
+	case "ssl", "tls", "mqtts":
+		conn, err = dialer.DialContext(ctx, "tcp", hostPort(u, "8883"))
+		if err == nil {
+			config := options.TLS
+			if config == nil {
+				config = &tls.Config{}
+			}
+			if config.ServerName == "" {
+				config = config.Clone()
+				config.ServerName = u.Hostname()
+			}
+			tlsConn := tls.Client(conn, config)
+			if deadline, ok := ctx.Deadline(); ok {
+				tlsConn.SetDeadline(deadline)
+			}
+			if err = tlsConn.Handshake(); err != nil {
+				conn.Close()
+			}
+			conn = tlsConn
+		}
+	default:
+		return nil, fmt.Errorf("mqtt broker %q: unsupported scheme %q", options.Broker, u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &MQTTClient{
+		KeepAlive: options.KeepAlive,
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := c.connect(options); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func (c *MQTTClient) connect(options MQTTOptions) error {
+	var flags byte = 0x02 //Sessão limpa
+	var payload []byte
+	payload = appendMQTTString(payload, options.ClientID)
+	if options.Will != nil {
+		flags |= 0x04
+		if options.Will.Retain {
+			flags |= 0x20
+		}
+		payload = appendMQTTString(payload, options.Will.Topic)
+		payload = appendMQTTBytes(payload, options.Will.Payload)
+	}
+	if options.Username != "" {
+		flags |= 0x80
+		payload = appendMQTTString(payload, options.Username)
+		if options.Password != "" {
+			flags |= 0x40
+			payload = appendMQTTString(payload, options.Password)
+		}
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, mqttProtocolLevel, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(options.KeepAlive/time.Second))
+	body = append(body, payload...)
+	if err := c.write(mqttConnect<<4, body); err != nil {
+		return err
+	}
+	header, ack, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if header>>4 != mqttConnack || len(ack) != 2 {
+		return ErrMQTTMalformed
+	}
+	if ack[1] != 0 {
+		if reason, ok := mqttConnackErrors[ack[1]]; ok {
+			return fmt.Errorf("mqtt: connection refused: %s", reason)
+		}
+		return fmt.Errorf("mqtt: connection refused: code %d", ack[1])
+	}
+	return nil
+}
+
+//	Publish sends message with QoS 0
+func (c *MQTTClient) Publish(message MQTTMessage) error {
+	var header byte = mqttPublish << 4
+	if message.Retain {
+		header |= 0x01
+	}
+	body := appendMQTTString(nil, message.Topic)
+	body = append(body, message.Payload...)
+	return c.write(header, body)
+}
+
+//	Subscribe asks for the messages of filters with QoS 0; the SUBACK is
+//	consumed by Read
+func (c *MQTTClient) Subscribe(filters ...string) error {
+	body := binary.BigEndian.AppendUint16(nil, c.packetID())
+	for _, filter := range filters {
+		body = appendMQTTString(body, filter)
+		body = append(body, 0)
+	}
+	return c.write(mqttSubscribe<<4|0x02, body)
+}
+
+func (c *MQTTClient) Ping() error {
+	return c.write(mqttPingreq<<4, nil)
+}
+
+//	Disconnect tells the broker not to publish the will and closes the connection
+func (c *MQTTClient) Disconnect() error {
+	c.write(mqttDisconnect<<4, nil)
+	return c.Close()
+}
+
+func (c *MQTTClient) Close() error {
+	return c.conn.Close()
+}
+
+//	Read returns the next message published to a subscription
+//	Without any packet from the broker for one and a half keep alive
+//	periods the connection is considered lost
+func (c *MQTTClient) Read() (message MQTTMessage, err error) {
+	for {
+		if c.KeepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.KeepAlive * 3 / 2))
+		}
+		header, body, err := c.readPacket()
+		if err != nil {
+			return message, err
+		}
+		switch header >> 4 {
+		case mqttPublish:
+			return c.publish(header, body)
+		case mqttSuback, mqttPingresp, mqttPuback:
+		default:
+			return message, fmt.Errorf("mqtt: unexpected packet type %d", header>>4)
+		}
+	}
+}
+
+func (c *MQTTClient) publish(header byte, body []byte) (message MQTTMessage, err error) {
+	topic, rest, err := readMQTTString(body)
+	if err != nil {
+		return message, err
+	}
+	message.Topic = topic
+	message.Retain = header&0x01 != 0
+	if qos := header >> 1 & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return message, ErrMQTTMalformed
+		}
+		id := rest[:2]
+		rest = rest[2:]
+		//QoS 2 não é pedida nas assinaturas; QoS 1 é confirmada na chegada
+		if qos == 1 {
+			if err := c.write(mqttPuback<<4, id); err != nil {
+				return message, err
+			}
+		}
+	}
+	message.Payload = rest
+	return message, nil
+}
+
+func (c *MQTTClient) packetID() uint16 {
+	c.idLock.Lock()
+	defer c.idLock.Unlock()
+	if c.nextID++; c.nextID == 0 {
+		c.nextID = 1
+	}
+	return c.nextID
+}
+
+func (c *MQTTClient) write(header byte, body []byte) error {
+	packet := []byte{header}
+	//Comprimento restante: 7 bits por byte, o bit alto indica continuação
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.KeepAlive > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.KeepAlive))
+	}
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func (c *MQTTClient) readPacket() (header byte, body []byte, err error) {
+	if header, err = c.reader.ReadByte(); err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for k := 0; ; k++ {
+		if k == 4 {
+			return 0, nil, ErrMQTTMalformed
+		}
+		digit, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > mqttMaxPacket {
+		return 0, nil, ErrMQTTPacketTooLarge
+	}
+	body = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	return appendMQTTBytes(b, []byte(s))
+}
+
+func appendMQTTBytes(b []byte, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func readMQTTString(b []byte) (s string, rest []byte, err error) {
+	if len(b) < 2 {
+		return "", nil, ErrMQTTMalformed
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, ErrMQTTMalformed
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
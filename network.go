@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	NetworkAssociating = "associating"
+	NetworkAssociated  = "associated"
+	NetworkConnected   = "connected"
+	NetworkFailed      = "failed"
+
+	NetworkBackendWPACLI = "wpa_cli"
+	NetworkBackendNone   = "none"
+	ConfigNetworkBackend = "NETWORK_BACKEND"
+	DefaultWifiInterface = "wlan0"
+	ConfigWifiInterface  = "WIFI_INTERFACE"
+	//Tempo para associar e obter um endereço antes de desistir da rede
+	DefaultNetworkJoinTimeout = 45 * time.Second
+	ConfigNetworkJoinTimeout  = "NETWORK_JOIN_TIMEOUT"
+)
+
+var (
+	ErrNetworkWrongPassword = errors.New("wrong password")
+	ErrNetworkNotFound      = errors.New("network not found")
+	ErrNetworkRefused       = errors.New("network refused the connection")
+	ErrNetworkNoAddress     = errors.New("associated but got no IP address")
+	ErrNetworkTimeout       = errors.New("timed out joining network")
+	ErrNetworkNoBackend     = errors.New("no network backend configured")
+)
+
+type WifiCredentials struct {
+	SSID       string `json:"ssid"`
+	Passphrase string `json:"passphrase"`
+}
+
+//	NetworkProgress is reported while joining a network
+type NetworkProgress struct {
+	State string `json:"state"`
+	IP    string `json:"ip,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+//	NetworkBackend applies Wi-Fi credentials to the system
+//	Join reports progress as it goes and returns once the device has an
+//	address or has given up, leaving the previous configuration on failure
+type NetworkBackend interface {
+	Join(ctx context.Context, credentials WifiCredentials, progress func(NetworkProgress)) error
+}
+
+//	NewNetworkBackend returns the backend named by NETWORK_BACKEND
+func NewNetworkBackend() NetworkBackend {
+	switch envString(ConfigNetworkBackend, NetworkBackendWPACLI) {
+	case NetworkBackendNone:
+		return NullNetworkBackend{}
+	default:
+		return &WPACLIBackend{
+			Interface: envString(ConfigWifiInterface, DefaultWifiInterface),
+			Timeout:   envDuration(ConfigNetworkJoinTimeout, DefaultNetworkJoinTimeout),
+		}
+	}
+}
+
+//	Validate checks the lengths required by WPA: an SSID of up to 32 bytes and
+//	a passphrase of 8 to 63 characters, or 64 hex digits, or none for open networks
+func (c WifiCredentials) Validate() error {
+	if len(c.SSID) == 0 || len(c.SSID) > 32 {
+		return fmt.Errorf("ssid must have 1 to 32 bytes")
+	}
+	if c.Passphrase == "" {
+		return nil
+	}
+	if len(c.Passphrase) == 64 {
+		if _, err := hex.DecodeString(c.Passphrase); err == nil {
+			return nil
+		}
+	}
+	if len(c.Passphrase) < 8 || len(c.Passphrase) > 63 {
+		return fmt.Errorf("passphrase must have 8 to 63 characters")
+	}
+	for _, r := range c.Passphrase {
+		if r < 0x20 || r > 0x7e {
+			return fmt.Errorf("passphrase must be printable ASCII")
+		}
+	}
+	return nil
+}
+
+//	PSK derives the 256 bit WPA key, so that the passphrase is never written
+//	to the wpa_supplicant configuration
+func (c WifiCredentials) PSK() (string, error) {
+	if len(c.Passphrase) == 64 {
+		if _, err := hex.DecodeString(c.Passphrase); err == nil {
+			return strings.ToLower(c.Passphrase), nil
+		}
+	}
+	key, err := pbkdf2.Key(sha1.New, c.Passphrase, []byte(c.SSID), 4096, 32)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+//	NullNetworkBackend refuses every network, for development machines
+type NullNetworkBackend struct{}
+
+func (NullNetworkBackend) Join(ctx context.Context, credentials WifiCredentials, progress func(NetworkProgress)) error {
+	return ErrNetworkNoBackend
+}
+
+//	WPACLIBackend adds the network to wpa_supplicant through wpa_cli and
+//	saves the configuration only after the device gets an address
+type WPACLIBackend struct {
+	Interface string
+	Timeout   time.Duration
+}
+
+func (w *WPACLIBackend) Join(ctx context.Context, credentials WifiCredentials, progress func(NetworkProgress)) (err error) {
+	if err := credentials.Validate(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.Timeout)
+	defer cancel()
+	id, err := w.cli(ctx, "add_network")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			//Descarta a rede e relê o arquivo, que ainda tem a configuração anterior
+			cleanup, done := context.WithTimeout(context.Background(), 5*time.Second)
+			defer done()
+			w.cli(cleanup, "remove_network", id)
+			w.cli(cleanup, "reconfigure")
+		}
+	}()
+	//SSID em hexadecimal dispensa escapar aspas e caracteres especiais
+	if _, err := w.cli(ctx, "set_network", id, "ssid", hex.EncodeToString([]byte(credentials.SSID))); err != nil {
+		return err
+	}
+	if _, err := w.cli(ctx, "set_network", id, "scan_ssid", "1"); err != nil {
+		return err
+	}
+	if credentials.Passphrase == "" {
+		_, err = w.cli(ctx, "set_network", id, "key_mgmt", "NONE")
+	} else {
+		var psk string
+		if psk, err = credentials.PSK(); err == nil {
+			_, err = w.cli(ctx, "set_network", id, "psk", psk)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := w.cli(ctx, "select_network", id); err != nil {
+		return err
+	}
+	progress(NetworkProgress{State: NetworkAssociating})
+
+	handshake, associated, seen := false, false, false
+	poll := time.NewTicker(500 * time.Millisecond)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			switch {
+			case associated:
+				return ErrNetworkNoAddress
+			case !seen:
+				return ErrNetworkNotFound
+			}
+			return ErrNetworkTimeout
+		case <-poll.C:
+		}
+		status, err := w.status(ctx)
+		if err != nil {
+			continue
+		}
+		switch status["wpa_state"] {
+		case "ASSOCIATING", "ASSOCIATED", "AUTHENTICATING":
+			seen = true
+		case "4WAY_HANDSHAKE", "GROUP_HANDSHAKE":
+			seen, handshake = true, true
+		case "COMPLETED":
+			if status["id"] != id {
+				continue
+			}
+			if !associated {
+				associated = true
+				progress(NetworkProgress{State: NetworkAssociated})
+			}
+			if ip := status["ip_address"]; ip != "" {
+				progress(NetworkProgress{State: NetworkConnected, IP: ip})
+				//As outras redes voltam a ficar disponíveis como alternativa
+				w.cli(ctx, "enable_network", "all")
+				_, err := w.cli(ctx, "save_config")
+				return err
+			}
+		}
+		//wpa_supplicant desabilita temporariamente a rede após falhas de autenticação
+		if disabled, err := w.disabled(ctx, id); err == nil && disabled {
+			if handshake {
+				return ErrNetworkWrongPassword
+			}
+			return ErrNetworkRefused
+		}
+	}
+}
+
+//	cli runs wpa_cli on the interface; wpa_cli answers FAIL instead of
+//	exiting with an error
+func (w *WPACLIBackend) cli(ctx context.Context, args ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, "wpa_cli", append([]string{"-i", w.Interface}, args...)...).Output()
+	if err != nil {
+		return "", fmt.Errorf("wpa_cli %s: %v", args[0], err)
+	}
+	result := strings.TrimSpace(string(output))
+	if strings.HasPrefix(result, "FAIL") {
+		return "", fmt.Errorf("wpa_cli %s: %s", args[0], result)
+	}
+	return result, nil
+}
+
+func (w *WPACLIBackend) status(ctx context.Context) (map[string]string, error) {
+	output, err := w.cli(ctx, "status")
+	if err != nil {
+		return nil, err
+	}
+	status := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		if k := strings.Index(scanner.Text(), "="); k > 0 {
+			status[scanner.Text()[:k]] = scanner.Text()[k+1:]
+		}
+	}
+	return status, nil
+}
+
+//	disabled reads the flags of network id from list_networks, whose lines are
+//	network id / ssid / bssid / flags separated by tabs
+func (w *WPACLIBackend) disabled(ctx context.Context, id string) (bool, error) {
+	output, err := w.cli(ctx, "list_networks")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) == 4 && fields[0] == id {
+			return strings.Contains(fields[3], "TEMP-DISABLED"), nil
+		}
+	}
+	return false, nil
+}
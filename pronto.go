@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	//Unidade de frequência do Pronto: períodos do oscilador de 4,145146 MHz
+	prontoClock = 0.241246
+	//Espaço final usado quando os tempos não trazem o intervalo entre quadros
+	prontoTrailingGap = 40000
+)
+
+//	ParsePronto reads a learned ("0000") Pronto hex code into timings
+//	The once sequence is used, or the repeat sequence when there is none
+func ParsePronto(pronto string) (frequency int, timings []int, err error) {
+	fields := strings.Fields(pronto)
+	if len(fields) < 4 {
+		return 0, nil, fmt.Errorf("parsing pronto: too short")
+	}
+	words := make([]int, len(fields))
+	for k, field := range fields {
+		word, err := strconv.ParseUint(field, 16, 16)
+		if err != nil {
+			return 0, nil, fmt.Errorf("parsing pronto: %v", err)
+		}
+		words[k] = int(word)
+	}
+	if words[0] != 0 {
+		return 0, nil, fmt.Errorf("parsing pronto: only learned codes (0000) are supported, got %04X", words[0])
+	}
+	if words[1] == 0 {
+		return 0, nil, fmt.Errorf("parsing pronto: zero frequency")
+	}
+	once, repeat := words[2], words[3]
+	if len(words) != 4+2*(once+repeat) {
+		return 0, nil, fmt.Errorf("parsing pronto: expected %d burst pairs, got %d words", once+repeat, len(words)-4)
+	}
+	frequency = int(math.Floor(1000000/(float64(words[1])*prontoClock) + 0.5))
+	period := 1000000 / float64(frequency)
+	bursts := words[4 : 4+2*once]
+	if once == 0 {
+		bursts = words[4:]
+	}
+	if len(bursts) == 0 {
+		return 0, nil, fmt.Errorf("parsing pronto: no burst pairs")
+	}
+	timings = make([]int, 0, len(bursts))
+	for _, cycles := range bursts {
+		timings = append(timings, int(math.Floor(float64(cycles)*period+0.5)))
+	}
+	//O último espaço é o intervalo até o próximo quadro
+	return frequency, timings[:len(timings)-1], nil
+}
+
+//	FormatPronto writes timings as a learned Pronto hex code with a once sequence only
+func FormatPronto(frequency int, timings []int) string {
+	if len(timings)%2 == 1 {
+		timings = append(timings[:len(timings):len(timings)], prontoTrailingGap)
+	}
+	words := make([]string, 0, 4+len(timings))
+	divisor := int(math.Floor(1000000/(float64(frequency)*prontoClock) + 0.5))
+	words = append(words, "0000", fmt.Sprintf("%04X", divisor), fmt.Sprintf("%04X", len(timings)/2), "0000")
+	for _, micros := range timings {
+		cycles := int(math.Floor(float64(micros)*float64(frequency)/1000000 + 0.5))
+		if cycles > 0xFFFF {
+			cycles = 0xFFFF
+		}
+		words = append(words, fmt.Sprintf("%04X", cycles))
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+const (
+	//Chave pública do dispositivo, lida em partes com read blob
+	ProvisionKeyUUID = "7e3b2a91-4c5d-4f08-8a6e-2d9c1b7f3e54"
+	//Credenciais cifradas escritas pelo aplicativo
+	ProvisionCredentialsUUID = "9a4f6c2d-1e8b-4b73-9f05-6d2e8c7a1b39"
+	//Progresso da conexão, notificado em JSON
+	ProvisionStatusUUID = "3c8e1f5a-7b2d-4e96-a1c4-8f0b5d6e2a73"
+
+	ProvisionInfo = "shc wifi provisioning v1"
+	//Chave pública P-256 não comprimida
+	provisionPublicKeySize = 65
+	provisionNonceSize     = 12
+)
+
+var (
+	ErrProvisionNoKey   = errors.New("provisioning key not read")
+	ErrProvisionMessage = errors.New("malformed provisioning message")
+)
+
+//	provisionSession is the provisioning state of a connected central
+//	The device key is used for a single message, so a recorded message can
+//	not be replayed to a later session
+type provisionSession struct {
+	key      *ecdh.PrivateKey
+	progress chan NetworkProgress
+}
+
+type provisioning struct {
+	sessions map[string]*provisionSession
+	lock     sync.Mutex
+}
+
+func (p *provisioning) session(central string) *provisionSession {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.sessions == nil {
+		p.sessions = make(map[string]*provisionSession)
+	}
+	s, ok := p.sessions[central]
+	if !ok {
+		s = &provisionSession{progress: make(chan NetworkProgress, 8)}
+		p.sessions[central] = s
+	}
+	return s
+}
+
+func (p *provisioning) forget(central string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.sessions, central)
+}
+
+//	ProvisioningCharacteristics adds Wi-Fi provisioning to s:
+//	1.	The app reads the device public key from ProvisionKeyUUID; reading
+//		offset 0 starts a new session with a new key
+//	2.	It writes to ProvisionCredentialsUUID, in frames, its own public key,
+//		a nonce and the AES-256-GCM encryption of {"ssid", "passphrase"}, with
+//		the device public key as additional data
+//	3.	Progress is notified on ProvisionStatusUUID, in frames
+//	The AES key is HKDF-SHA256 of the P-256 ECDH secret, salted with both
+//	public keys. The exchange is not authenticated: it protects the
+//	passphrase from eavesdroppers, not from an active attacker in range
+//	during setup
+func (bm *BluetoothManager) ProvisioningCharacteristics(s *gatt.Service) {
+	key := s.AddCharacteristic(gatt.MustParseUUID(ProvisionKeyUUID))
+	key.HandleReadFunc(func(rsp gatt.ResponseWriter, r *gatt.ReadRequest) {
+		session := bm.provisioning.session(r.Central.ID())
+		bm.provisioning.lock.Lock()
+		defer bm.provisioning.lock.Unlock()
+		if r.Offset == 0 || session.key == nil {
+			private, err := ecdh.P256().GenerateKey(rand.Reader)
+			if err != nil {
+				bm.Logger.Printf("generating provisioning key: %v\n", err)
+				rsp.SetStatus(gatt.StatusUnexpectedError)
+				return
+			}
+			session.key = private
+		}
+		public := session.key.PublicKey().Bytes()
+		if r.Offset > len(public) {
+			rsp.SetStatus(gatt.StatusUnexpectedError)
+			return
+		}
+		end := len(public)
+		if end > r.Offset+r.Cap {
+			end = r.Offset + r.Cap
+		}
+		rsp.Write(public[r.Offset:end])
+	})
+
+	credentials := s.AddCharacteristic(gatt.MustParseUUID(ProvisionCredentialsUUID))
+	bm.HandleFramedWrite(credentials, func(r gatt.Request, message []byte) (status byte) {
+		central := r.Central.ID()
+		private, err := bm.provisioning.take(central)
+		if err != nil {
+			bm.Logger.Printf("provisioning from %s: %v\n", central, err)
+			return gatt.StatusUnexpectedError
+		}
+		session := bm.provisioning.session(central)
+		report := func(progress NetworkProgress) {
+			bm.Logger.Printf("provisioning from %s: %s %s%s\n", central, progress.State, progress.IP, progress.Error)
+			select {
+			case session.progress <- progress:
+			default:
+			}
+		}
+		wifi, err := OpenCredentials(private, message)
+		if err != nil {
+			bm.Logger.Printf("provisioning from %s: %v\n", central, err)
+			report(NetworkProgress{State: NetworkFailed, Error: err.Error()})
+			return gatt.StatusSuccess
+		}
+		if err := wifi.Validate(); err != nil {
+			report(NetworkProgress{State: NetworkFailed, Error: err.Error()})
+			return gatt.StatusSuccess
+		}
+		go func() {
+			bm.Logger.Printf("provisioning from %s: joining %q\n", central, wifi.SSID)
+			if err := bm.Network.Join(context.Background(), wifi, report); err != nil {
+				report(NetworkProgress{State: NetworkFailed, Error: err.Error()})
+			}
+		}()
+		return gatt.StatusSuccess
+	})
+
+	status := s.AddCharacteristic(gatt.MustParseUUID(ProvisionStatusUUID))
+	status.HandleNotifyFunc(func(r gatt.Request, notifier gatt.Notifier) {
+		session := bm.provisioning.session(r.Central.ID())
+		for !notifier.Done() {
+			select {
+			case progress := <-session.progress:
+				if err := bm.Notify(notifier, progress); err != nil {
+					bm.Logger.Printf("notifying provisioning progress: %v\n", err)
+				}
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+	})
+}
+
+//	take returns the key of the session of central, which is then discarded
+func (p *provisioning) take(central string) (*ecdh.PrivateKey, error) {
+	session := p.session(central)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	private := session.key
+	if private == nil {
+		return nil, ErrProvisionNoKey
+	}
+	session.key = nil
+	return private, nil
+}
+
+//	OpenCredentials decrypts a provisioning message sealed for private
+func OpenCredentials(private *ecdh.PrivateKey, message []byte) (credentials WifiCredentials, err error) {
+	if len(message) < provisionPublicKeySize+provisionNonceSize {
+		return credentials, ErrProvisionMessage
+	}
+	peer, err := ecdh.P256().NewPublicKey(message[:provisionPublicKeySize])
+	if err != nil {
+		return credentials, err
+	}
+	nonce := message[provisionPublicKeySize : provisionPublicKeySize+provisionNonceSize]
+	ciphertext := message[provisionPublicKeySize+provisionNonceSize:]
+	aead, err := provisionCipher(private, peer, private.PublicKey().Bytes(), peer.Bytes())
+	if err != nil {
+		return credentials, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, private.PublicKey().Bytes())
+	if err != nil {
+		return credentials, fmt.Errorf("decrypting credentials: %v", err)
+	}
+	err = json.Unmarshal(plaintext, &credentials)
+	return credentials, err
+}
+
+//	SealCredentials is what the app does, for tests and tools: it encrypts
+//	credentials for the device public key, to be sent with Frames
+func SealCredentials(device *ecdh.PublicKey, credentials WifiCredentials) ([]byte, error) {
+	private, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := provisionCipher(private, device, device.Bytes(), private.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(credentials)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, provisionNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	message := append(private.PublicKey().Bytes(), nonce...)
+	return aead.Seal(message, nonce, plaintext, device.Bytes()), nil
+}
+
+//	provisionCipher derives the session cipher; the salt is the device public
+//	key followed by the app one, whichever side computes it
+func provisionCipher(private *ecdh.PrivateKey, peer *ecdh.PublicKey, device, app []byte) (cipher.AEAD, error) {
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Key(sha256.New, secret, append(append([]byte(nil), device...), app...), ProvisionInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
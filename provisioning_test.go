@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+)
+
+func provisionKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	private, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+func TestCredentialsRoundTrip(t *testing.T) {
+	private := provisionKey(t)
+	tests := []WifiCredentials{
+		{SSID: "casa", Passphrase: "s3cr3t passphrase"},
+		{SSID: "rede aberta"},
+		{SSID: "Café ☕", Passphrase: `aspas " e \ barra`},
+	}
+	for _, credentials := range tests {
+		message, err := SealCredentials(private.PublicKey(), credentials)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//O aplicativo escreve a mensagem em frames de um ATT MTU padrão
+		chunks, err := Frames(message, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reader FrameReader
+		var payload []byte
+		for _, chunk := range chunks {
+			if payload, err = reader.Push(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		opened, err := OpenCredentials(private, payload)
+		if err != nil {
+			t.Fatalf("%+v: %v", credentials, err)
+		}
+		if opened != credentials {
+			t.Errorf("opened %+v, want %+v", opened, credentials)
+		}
+	}
+}
+
+func TestCredentialsSealedForAnotherKey(t *testing.T) {
+	message, err := SealCredentials(provisionKey(t).PublicKey(), WifiCredentials{SSID: "casa", Passphrase: "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCredentials(provisionKey(t), message); err == nil {
+		t.Error("opened credentials sealed for another device key")
+	}
+}
+
+func TestCredentialsTampered(t *testing.T) {
+	private := provisionKey(t)
+	message, err := SealCredentials(private.PublicKey(), WifiCredentials{SSID: "casa", Passphrase: "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper := func(i int) []byte {
+		tampered := append([]byte(nil), message...)
+		tampered[i] ^= 0x01
+		return tampered
+	}
+	other := append(provisionKey(t).PublicKey().Bytes(), message[provisionPublicKeySize:]...)
+	tests := []struct {
+		name    string
+		message []byte
+	}{
+		{"app key", tamper(provisionPublicKeySize - 1)},
+		{"other app key", other},
+		{"nonce", tamper(provisionPublicKeySize)},
+		{"ciphertext", tamper(provisionPublicKeySize + provisionNonceSize)},
+		{"tag", tamper(len(message) - 1)},
+		{"truncated", message[:len(message)-1]},
+	}
+	for _, tt := range tests {
+		if _, err := OpenCredentials(private, tt.message); err == nil {
+			t.Errorf("%s: opened a tampered message", tt.name)
+		}
+	}
+	if _, err := OpenCredentials(private, message[:provisionPublicKeySize+provisionNonceSize-1]); err != ErrProvisionMessage {
+		t.Errorf("short message: %v, want ErrProvisionMessage", err)
+	}
+}
+
+//	TestProvisioningKeyUsedOnce checks that a recorded message can not be
+//	replayed: the session key is discarded by the first message
+func TestProvisioningKeyUsedOnce(t *testing.T) {
+	var p provisioning
+	if _, err := p.take("central"); err != ErrProvisionNoKey {
+		t.Errorf("take before reading the key: %v, want ErrProvisionNoKey", err)
+	}
+	private := provisionKey(t)
+	p.session("central").key = private
+	message, err := SealCredentials(private.PublicKey(), WifiCredentials{SSID: "casa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := p.take("central")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCredentials(key, message); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.take("central"); err != ErrProvisionNoKey {
+		t.Errorf("second take: %v, want ErrProvisionNoKey", err)
+	}
+	if _, err := p.take("other"); err != ErrProvisionNoKey {
+		t.Errorf("take by another central: %v, want ErrProvisionNoKey", err)
+	}
+}
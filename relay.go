@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -29,23 +30,25 @@ type RelayManager struct {
 	LogFile *os.File
 	Logger  *log.Logger
 
-	*DatabaseManager
+	Repository
 	*DeviceManager
+	EventManager *EventManager
 }
 
 func NewRelayManager() (e *RelayManager) {
 	return &RelayManager{}
 }
 
-func (e *RelayManager) Initialize(logPath string, databaseManager *DatabaseManager, deviceManager *DeviceManager) error {
+func (e *RelayManager) Initialize(logPath string, repository Repository, deviceManager *DeviceManager, eventManager *EventManager) error {
 	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
 	e.LogFile = f
 	e.Logger = log.New(e.LogFile, "", log.Ldate|log.Ltime)
-	e.DatabaseManager = databaseManager
+	e.Repository = repository
 	e.DeviceManager = deviceManager
+	e.EventManager = eventManager
 	e.Logger.Printf("RelayManager started.\n")
 	return nil
 }
@@ -70,11 +73,17 @@ type Relay struct {
 }
 
 func (e *RelayManager) Operate(relay Relay, command string) {
-	if err := rpio.Open(); err != nil {
+	if err := openGPIO(); err != nil {
 		e.Logger.Printf("opening rpio: %v\n", err)
 		return
 	}
-	defer rpio.Close()
+	defer closeGPIO()
+	if command != CommandOn && command != CommandOff {
+		relaySwitches.Inc(strconv.Itoa(relay.ID), CommandToggle)
+	} else {
+		relaySwitches.Inc(strconv.Itoa(relay.ID), command)
+	}
+	e.EventManager.Publish(EventRelay, RelayEvent{RelayID: relay.ID, Name: relay.Name, Command: command})
 	pin := relay.RelayPin
 	rpioPin := rpio.Pin(pin)
 	rpioPin.Output()
@@ -100,16 +109,21 @@ func (e *RelayManager) SetStateOf(relay *Relay) {
 	case TypeLamp:
 		analogVariance := e.DeviceManager.AnalogVariance()
 		e.Logger.Printf("Analog variance: %.3f\n", analogVariance)
-		if relay.ID == 1 && analogVariance > 0.006 {
-			relay.State = RelayOn
-		} else {
-			relay.State = RelayOff
-		}
+		relay.State = lampState(*relay, analogVariance)
 	default:
 		relay.State = RelayOff
 	}
 }
 
+//	lampState derives the state of a lamp relay from the current sensor, so
+//	that a single reading serves every relay
+func lampState(relay Relay, analogVariance float64) string {
+	if relay.ID == 1 && analogVariance > 0.006 {
+		return RelayOn
+	}
+	return RelayOff
+}
+
 func (e *RelayManager) OperationHandler(w http.ResponseWriter, r *http.Request) {
 	var relay Relay
 	if err := json.NewDecoder(r.Body).Decode(&relay); err != nil {
@@ -124,11 +138,15 @@ func (e *RelayManager) OperationHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (e *RelayManager) RelayHandler(w http.ResponseWriter, r *http.Request) {
-	relay := e.DatabaseManager.ReadRelay()
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	relay, err := e.Repository.ReadRelay()
+	if err != nil {
+		writeError(w, e.Logger, "reading relays", err)
+		return
+	}
 	for i := range relay {
 		e.SetStateOf(&relay[i])
 	}
-	w.Header().Add("Access-Control-Allow-Origin", "*")
 	if err := json.NewEncoder(w).Encode(relay); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
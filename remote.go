@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	ActionRelay    = "relay"
+	ActionInfrared = "infrared"
+	ActionMacro    = "macro"
+
+	//Intervalo em que o mesmo código recebido novamente é ignorado
+	DefaultBindingDebounce = 400 * time.Millisecond
+	ConfigBindingDebounce  = "IR_BINDING_DEBOUNCE"
+)
+
+//	Responsibilities:
+//	*	To turn buttons of any remote into relay and infrared operations
+//	RemoteManager
+type RemoteManager struct {
+	LogFile *os.File
+	Logger  *log.Logger
+
+	Repository
+	RelayManager    *RelayManager
+	InfraredManager *InfraredManager
+	MacroManager    *MacroManager
+
+	Debounce time.Duration
+
+	bindings     []Binding
+	bindingsLock sync.Mutex
+	last         Decoded
+	lastAt       time.Time
+}
+
+//	Binding maps a decoded remote button to a list of actions run in order
+//	A binding with several actions works as a scene
+type Binding struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	Name     string          `json:"name"`
+	Protocol string          `json:"protocol"`
+	Address  uint32          `json:"address"`
+	Command  uint32          `json:"command"`
+	Actions  []BindingAction `json:"actions"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at" sql:"index"`
+}
+
+type BindingAction struct {
+	ID        int `json:"id" gorm:"primary_key"`
+	BindingID int `json:"binding_id"`
+
+	Position     int    `json:"position"`
+	Type         string `json:"type"`
+	RelayID      int    `json:"relay_id"`
+	RelayCommand string `json:"relay_command"`
+	InfraredID   int    `json:"infrared_id"`
+	Button       int    `json:"button"`
+	MacroID      int    `json:"macro_id"`
+}
+
+func NewRemoteManager() *RemoteManager {
+	return &RemoteManager{}
+}
+
+func (rm *RemoteManager) Initialize(logPath string, repository Repository,
+	relayManager *RelayManager, infraredManager *InfraredManager, macroManager *MacroManager) error {
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	rm.LogFile = f
+	rm.Logger = log.New(rm.LogFile, "", log.Ldate|log.Ltime)
+	rm.Repository = repository
+	rm.RelayManager = relayManager
+	rm.InfraredManager = infraredManager
+	rm.MacroManager = macroManager
+	rm.Debounce = envDuration(ConfigBindingDebounce, DefaultBindingDebounce)
+	if err := rm.reload(); err != nil {
+		return err
+	}
+	rm.Logger.Printf("RemoteManager started.\n")
+	return nil
+}
+
+func (rm *RemoteManager) Close() {
+	rm.Logger.Printf("RemoteManager closed.\n")
+	rm.LogFile.Close()
+}
+
+//	Run dispatches the bindings of every frame received until ctx is done
+func (rm *RemoteManager) Run(ctx context.Context) {
+	frames, cancel := rm.InfraredManager.Subscribe()
+	defer cancel()
+	for {
+		select {
+		case decoded := <-frames:
+			rm.Dispatch(decoded)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//	Dispatch runs the actions bound to decoded
+//	NEC repeat frames, the same frame received again within Debounce and
+//	frames received while a button is being learned are ignored
+func (rm *RemoteManager) Dispatch(decoded Decoded) {
+	if decoded.Repeat || decoded.Protocol == ProtocolRaw {
+		return
+	}
+	if rm.InfraredManager.Learning() {
+		rm.Logger.Printf("ignoring %s while learning\n", decoded)
+		return
+	}
+	rm.bindingsLock.Lock()
+	if decoded.Protocol == rm.last.Protocol && decoded.Code == rm.last.Code && time.Since(rm.lastAt) < rm.Debounce {
+		rm.lastAt = time.Now()
+		rm.bindingsLock.Unlock()
+		return
+	}
+	rm.last = decoded
+	rm.lastAt = time.Now()
+	matched := make([]Binding, 0)
+	for _, binding := range rm.bindings {
+		if binding.Protocol == decoded.Protocol && binding.Address == decoded.Address && binding.Command == decoded.Command {
+			matched = append(matched, binding)
+		}
+	}
+	rm.bindingsLock.Unlock()
+
+	for _, binding := range matched {
+		rm.Logger.Printf("dispatching binding %d (%s) for %s\n", binding.ID, binding.Name, decoded)
+		for _, action := range binding.Actions {
+			rm.run(action)
+		}
+	}
+}
+
+func (rm *RemoteManager) run(action BindingAction) {
+	switch action.Type {
+	case ActionRelay:
+		relay, err := rm.Repository.ReadRelayByID(action.RelayID)
+		if err != nil {
+			rm.Logger.Printf("running action %d: relay %d: %v\n", action.ID, action.RelayID, err)
+			return
+		}
+		rm.RelayManager.Operate(relay, action.RelayCommand)
+	case ActionInfrared:
+		device, err := rm.Repository.ReadInfraredByID(action.InfraredID)
+		if err != nil {
+			rm.Logger.Printf("running action %d: device %d: %v\n", action.ID, action.InfraredID, err)
+			return
+		}
+		command, err := rm.Repository.ReadCommand(action.InfraredID, action.Button)
+		if err != nil {
+			rm.Logger.Printf("running action %d: button %d of device %d: %v\n", action.ID, action.Button, action.InfraredID, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), TransmitWait)
+		err = rm.InfraredManager.SendCommand(ctx, device, command)
+		cancel()
+		if err != nil {
+			rm.Logger.Printf("running action %d: %v\n", action.ID, err)
+		}
+	case ActionMacro:
+		if _, err := rm.MacroManager.Start(action.MacroID); err != nil {
+			rm.Logger.Printf("running action %d: %v\n", action.ID, err)
+		}
+	default:
+		rm.Logger.Printf("running action %d: unknown type %q\n", action.ID, action.Type)
+	}
+}
+
+func (rm *RemoteManager) reload() error {
+	bindings, err := rm.Repository.ReadBinding()
+	if err != nil {
+		return err
+	}
+	rm.bindingsLock.Lock()
+	rm.bindings = bindings
+	rm.bindingsLock.Unlock()
+	return nil
+}
+
+func (rm *RemoteManager) BindingHandler(w http.ResponseWriter, r *http.Request) {
+	rm.bindingsLock.Lock()
+	bindings := rm.bindings
+	rm.bindingsLock.Unlock()
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	if err := json.NewEncoder(w).Encode(bindings); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (rm *RemoteManager) CreateBindingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	var binding Binding
+	if err := json.NewDecoder(r.Body).Decode(&binding); err != nil {
+		rm.Logger.Printf("decoding binding: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	binding.ID = 0
+	for k := range binding.Actions {
+		action := &binding.Actions[k]
+		action.ID = 0
+		action.Position = k
+		if action.Type != ActionRelay && action.Type != ActionInfrared && action.Type != ActionMacro {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	binding, err := rm.Repository.CreateBinding(binding)
+	if err != nil {
+		writeError(w, rm.Logger, "creating binding", err)
+		return
+	}
+	if err := rm.reload(); err != nil {
+		rm.Logger.Printf("reloading bindings: %v\n", err)
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(binding)
+}
+
+func (rm *RemoteManager) DeleteBindingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if err := rm.Repository.DeleteBinding(Binding{ID: id}); err != nil {
+		writeError(w, rm.Logger, "deleting binding", err)
+		return
+	}
+	if err := rm.reload(); err != nil {
+		rm.Logger.Printf("reloading bindings: %v\n", err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func (r *infraredRepository) CreateBinding(binding Binding) (Binding, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	binding.ID = len(r.bindings) + 1
+	for _, b := range r.bindings {
+		if b.ID >= binding.ID {
+			binding.ID = b.ID + 1
+		}
+	}
+	r.bindings = append(r.bindings, binding)
+	return binding, nil
+}
+
+func (r *infraredRepository) ReadBinding() ([]Binding, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Binding(nil), r.bindings...), nil
+}
+
+func (r *infraredRepository) DeleteBinding(binding Binding) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for k, b := range r.bindings {
+		if b.ID == binding.ID {
+			r.bindings = append(r.bindings[:k], r.bindings[k+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+//	testRemote binds NEC command 0x10 of address 0x04 to button 1 of the tv,
+//	then button 2 of the soundbar, on different pins
+func testRemote(t *testing.T) (*RemoteManager, *RecordingTransmitter) {
+	t.Helper()
+	i, transmitter := testInfraredManager(t)
+	repository := newInfraredRepository(
+		Infrared{ID: 1, Name: "tv", Pin: 17},
+		Infrared{ID: 2, Name: "soundbar", Pin: 18},
+	)
+	repository.WriteCommand(Command{InfraredID: 1, Button: 1, Protocol: ProtocolNEC, Code: NECCode(0x01, 0x01)})
+	repository.WriteCommand(Command{InfraredID: 2, Button: 2, Protocol: ProtocolNEC, Code: NECCode(0x02, 0x02)})
+	repository.CreateBinding(Binding{Name: "cinema", Protocol: ProtocolNEC, Address: 0x04, Command: 0x10, Actions: []BindingAction{
+		{Position: 0, Type: ActionInfrared, InfraredID: 1, Button: 1},
+		{Position: 1, Type: ActionInfrared, InfraredID: 2, Button: 2},
+	}})
+	i.Repository = repository
+	rm := NewRemoteManager()
+	rm.Logger = i.Logger
+	rm.Repository = repository
+	rm.InfraredManager = i
+	rm.Debounce = 200 * time.Millisecond
+	if err := rm.reload(); err != nil {
+		t.Fatal(err)
+	}
+	return rm, transmitter
+}
+
+func remoteFrame(command uint32) Decoded {
+	return Decoded{Protocol: ProtocolNEC, Address: 0x04, Command: command, Bits: 32, Code: NECCode(0x04, command)}
+}
+
+func sentPins(transmitter *RecordingTransmitter) (pins []int) {
+	for _, frame := range transmitter.Frames() {
+		pins = append(pins, frame.Pin)
+	}
+	return pins
+}
+
+func TestDispatchOrder(t *testing.T) {
+	rm, transmitter := testRemote(t)
+	rm.Dispatch(remoteFrame(0x11))
+	if pins := sentPins(transmitter); len(pins) != 0 {
+		t.Fatalf("unbound button sent on %v", pins)
+	}
+	rm.Dispatch(remoteFrame(0x10))
+	if pins := sentPins(transmitter); !reflect.DeepEqual(pins, []int{17, 18}) {
+		t.Fatalf("sent on pins %v, want the actions in order on 17 then 18", pins)
+	}
+	for k, frame := range transmitter.Frames() {
+		timings, _ := Encode(ProtocolNEC, NECCode(uint32(k+1), uint32(k+1)))
+		want, _ := Waveform(frame.Pin, ProtocolFrequency[ProtocolNEC], DefaultIRDutyCycle, timings)
+		if !reflect.DeepEqual(frame.Pulses, want) {
+			t.Errorf("action %d sent another frame", k)
+		}
+	}
+}
+
+func TestDispatchDebounce(t *testing.T) {
+	rm, transmitter := testRemote(t)
+	repeat := remoteFrame(0x10)
+	repeat.Repeat = true
+	rm.Dispatch(remoteFrame(0x10))
+	rm.Dispatch(repeat)
+	rm.Dispatch(remoteFrame(0x10))
+	if n := len(transmitter.Frames()); n != 2 {
+		t.Fatalf("%d frames sent for a held button, want the 2 actions once", n)
+	}
+	//Outro botão no meio encerra o debounce
+	rm.Dispatch(remoteFrame(0x11))
+	rm.Dispatch(remoteFrame(0x10))
+	if n := len(transmitter.Frames()); n != 4 {
+		t.Fatalf("%d frames sent after another button, want 4", n)
+	}
+	time.Sleep(2 * rm.Debounce)
+	rm.Dispatch(remoteFrame(0x10))
+	if n := len(transmitter.Frames()); n != 6 {
+		t.Errorf("%d frames sent after the debounce, want 6", n)
+	}
+}
+
+func TestDispatchWhileLearning(t *testing.T) {
+	rm, transmitter := testRemote(t)
+	i := rm.InfraredManager
+	session := &learnSession{expiry: time.NewTimer(time.Hour)}
+	i.learning[learnKey(1, 1)] = session
+	rm.Dispatch(remoteFrame(0x10))
+	if n := len(transmitter.Frames()); n != 0 {
+		t.Fatalf("%d frames sent while learning", n)
+	}
+	i.forgetLearning(learnKey(1, 1), session)
+	rm.Dispatch(remoteFrame(0x10))
+	if n := len(transmitter.Frames()); n != 2 {
+		t.Errorf("%d frames sent after learning, want 2", n)
+	}
+}
+
+func TestBindingHandlers(t *testing.T) {
+	rm, transmitter := testRemote(t)
+	create := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		rm.CreateBindingHandler(w, httptest.NewRequest("POST", "/api/bindings", strings.NewReader(body)))
+		return w
+	}
+	if w := create(`{"protocol": "nec", "actions": [{"type": "teleport"}]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown action type: %d, want 400", w.Code)
+	}
+	if w := create(`{`); w.Code != http.StatusBadRequest {
+		t.Errorf("malformed binding: %d, want 400", w.Code)
+	}
+	w := create(`{"name": "inverso", "protocol": "nec", "address": 4, "command": 18, "actions": [
+		{"id": 7, "position": 9, "type": "infrared", "infrared_id": 2, "button": 2},
+		{"id": 7, "position": 0, "type": "infrared", "infrared_id": 1, "button": 1}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating binding: %d", w.Code)
+	}
+	var created Binding
+	json.NewDecoder(w.Body).Decode(&created)
+	//As posições seguem a ordem da lista, não os valores enviados
+	if created.ID == 0 || created.Actions[0].Position != 0 || created.Actions[1].Position != 1 || created.Actions[0].ID != 0 {
+		t.Errorf("created %+v", created)
+	}
+	rm.Dispatch(remoteFrame(0x12))
+	if pins := sentPins(transmitter); !reflect.DeepEqual(pins, []int{18, 17}) {
+		t.Errorf("new binding sent on pins %v, want 18 then 17", pins)
+	}
+
+	w = httptest.NewRecorder()
+	rm.BindingHandler(w, httptest.NewRequest("GET", "/api/bindings", nil))
+	var bindings []Binding
+	if err := json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&bindings); err != nil || len(bindings) != 2 {
+		t.Errorf("listed %s, %v", w.Body.String(), err)
+	}
+
+	remove := func(id string) int {
+		w := httptest.NewRecorder()
+		rm.DeleteBindingHandler(w, mux.SetURLVars(httptest.NewRequest("DELETE", "/", nil), map[string]string{"id": id}))
+		return w.Code
+	}
+	if status := remove("1"); status != http.StatusOK {
+		t.Errorf("deleting binding: %d", status)
+	}
+	if status := remove("1"); status != http.StatusNotFound {
+		t.Errorf("deleting binding twice: %d, want 404", status)
+	}
+	rm.Dispatch(remoteFrame(0x10))
+	if n := len(transmitter.Frames()); n != 2 {
+		t.Errorf("deleted binding still dispatched: %d frames", n)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+//	Repositories split persistence by aggregate so that managers do not
+//	depend on a database; DatabaseManager implements all of them with gorm
+//	Reads of a single record return ErrNotFound when there is none, and
+//	writes return ErrConflict when a unique field is already taken
+
+type RelayRepository interface {
+	CreateRelay(relay Relay) (Relay, error)
+	ReadRelay() ([]Relay, error)
+	ReadRelayByID(id int) (Relay, error)
+	UpdateRelay(relay Relay) (Relay, error)
+	DeleteRelay(relay Relay) error
+}
+
+type InfoRepository interface {
+	ReadInfo() (Info, error)
+	WriteInfo(info Info) (Info, error)
+	ReadCustomer() (Customer, error)
+	WriteCustomer(customer Customer) (Customer, error)
+}
+
+type InfraredRepository interface {
+	CreateInfrared(infrared Infrared) (Infrared, error)
+	ReadInfrared() ([]Infrared, error)
+	ReadInfraredByID(id int) (Infrared, error)
+	ReadCommand(infraredID, button int) (Command, error)
+	WriteCommand(command Command) (Command, error)
+	ReadACState(infraredID int) (ACState, error)
+	WriteACState(state ACState) (ACState, error)
+	ReadRGBState(infraredID int) (RGBState, error)
+	WriteRGBState(state RGBState) (RGBState, error)
+}
+
+type BindingRepository interface {
+	CreateBinding(binding Binding) (Binding, error)
+	ReadBinding() ([]Binding, error)
+	DeleteBinding(binding Binding) error
+}
+
+type MacroRepository interface {
+	CreateMacro(macro Macro) (Macro, error)
+	ReadMacro() ([]Macro, error)
+	ReadMacroByID(id int) (Macro, error)
+	DeleteMacro(macro Macro) error
+}
+
+type ScheduleRepository interface {
+	CreateSchedule(schedule Schedule) (Schedule, error)
+	ReadSchedule() ([]Schedule, error)
+	DeleteSchedule(schedule Schedule) error
+}
+
+type BackupRepository interface {
+	Restore(backup Backup, passphrase string, dryRun bool) (RestoreReport, error)
+}
+
+//	Repository is everything the managers persist
+type Repository interface {
+	RelayRepository
+	InfoRepository
+	InfraredRepository
+	BindingRepository
+	MacroRepository
+	ScheduleRepository
+	BackupRepository
+}
+
+var _ Repository = &DatabaseManager{}
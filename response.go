@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//	ErrorReport is the last error answered by a handler, reported in telemetry
+type ErrorReport struct {
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+var lastError struct {
+	ErrorReport
+	sync.Mutex
+}
+
+func recordError(doing string, err error) {
+	lastError.Lock()
+	defer lastError.Unlock()
+	lastError.ErrorReport = ErrorReport{Message: doing + ": " + err.Error(), At: time.Now()}
+}
+
+//	LastError returns the last error recorded, with ok false if there was none
+func LastError() (report ErrorReport, ok bool) {
+	lastError.Lock()
+	defer lastError.Unlock()
+	return lastError.ErrorReport, lastError.Message != ""
+}
+
+//	writeError logs err and answers it as {"error": ...} with 404 for
+//	ErrNotFound, 409 for ErrConflict and 500 for anything else
+func writeError(w http.ResponseWriter, logger *log.Logger, doing string, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case ErrNotFound:
+		status = http.StatusNotFound
+	case ErrConflict:
+		status = http.StatusConflict
+	}
+	logger.Printf("%s: %v\n", doing, err)
+	recordError(doing, err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	RGBModel24 = "rgb24"
+	RGBModel44 = "rgb44"
+
+	RGBEffectFlash  = "flash"
+	RGBEffectStrobe = "strobe"
+	RGBEffectFade   = "fade"
+	RGBEffectSmooth = "smooth"
+	RGBEffectJump3  = "jump3"
+	RGBEffectJump7  = "jump7"
+	RGBEffectFade3  = "fade3"
+	RGBEffectFade7  = "fade7"
+
+	//Intervalo entre dois toques para o controlador registrar cada um
+	RGBPressInterval = 150 * time.Millisecond
+)
+
+var ErrRGBModelUnknown = errors.New("unknown rgb remote model")
+
+//	RGBState is the state the strip is assumed to be in, since the IR
+//	controller gives no feedback
+type RGBState struct {
+	ID         int `json:"-" gorm:"primary_key"`
+	InfraredID int `json:"infrared_id" gorm:"unique"`
+
+	Power  bool   `json:"power"`
+	Color  string `json:"color"`
+	Level  int    `json:"level"`
+	Effect string `json:"effect"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+//	RGBRequest changes the strip; absent fields are left as they are
+//	Brightness is a percentage, BrightnessStep a number of presses up or down
+type RGBRequest struct {
+	Power          *bool  `json:"power"`
+	Color          string `json:"color"`
+	Brightness     *int   `json:"brightness"`
+	BrightnessStep int    `json:"brightness_step"`
+	Effect         string `json:"effect"`
+}
+
+type rgbKey struct {
+	Color   [3]int
+	Command uint32
+}
+
+//	rgbRemote describes the NEC codes of a common LED strip remote
+//	Remotes with a single power key set On and Off to the same command
+type rgbRemote struct {
+	Address    uint32
+	On         uint32
+	Off        uint32
+	BrightUp   uint32
+	BrightDown uint32
+	Levels     int
+	Colors     []rgbKey
+	Effects    map[string]uint32
+}
+
+var rgbRemotes = map[string]rgbRemote{
+	//Mesmo controle capturado em doc/remote.md
+	RGBModel24: {
+		Address:    0xEF00,
+		On:         0x03,
+		Off:        0x02,
+		BrightUp:   0x00,
+		BrightDown: 0x01,
+		Levels:     10,
+		Colors: []rgbKey{
+			{[3]int{0xFF, 0x00, 0x00}, 0x04},
+			{[3]int{0x00, 0xFF, 0x00}, 0x05},
+			{[3]int{0x00, 0x00, 0xFF}, 0x06},
+			{[3]int{0xFF, 0xFF, 0xFF}, 0x07},
+			{[3]int{0xFF, 0x40, 0x00}, 0x08},
+			{[3]int{0x40, 0xFF, 0x40}, 0x09},
+			{[3]int{0x20, 0x40, 0xFF}, 0x0A},
+			{[3]int{0xFF, 0x80, 0x00}, 0x0C},
+			{[3]int{0x00, 0xFF, 0xFF}, 0x0D},
+			{[3]int{0x80, 0x00, 0xFF}, 0x0E},
+			{[3]int{0xFF, 0xB0, 0x00}, 0x10},
+			{[3]int{0x00, 0x80, 0xFF}, 0x11},
+			{[3]int{0xC0, 0x00, 0xC0}, 0x12},
+			{[3]int{0xFF, 0xFF, 0x00}, 0x14},
+			{[3]int{0x00, 0x40, 0x80}, 0x15},
+			{[3]int{0xFF, 0x00, 0x80}, 0x16},
+		},
+		Effects: map[string]uint32{
+			RGBEffectFlash:  0x0B,
+			RGBEffectStrobe: 0x0F,
+			RGBEffectFade:   0x13,
+			RGBEffectSmooth: 0x17,
+		},
+	},
+	RGBModel44: {
+		Address:    0x00,
+		On:         0x40,
+		Off:        0x40,
+		BrightUp:   0x5C,
+		BrightDown: 0x5D,
+		Levels:     10,
+		Colors: []rgbKey{
+			{[3]int{0xFF, 0x00, 0x00}, 0x58},
+			{[3]int{0x00, 0xFF, 0x00}, 0x59},
+			{[3]int{0x00, 0x00, 0xFF}, 0x45},
+			{[3]int{0xFF, 0xFF, 0xFF}, 0x44},
+			{[3]int{0xFF, 0x60, 0x00}, 0x54},
+			{[3]int{0x00, 0xFF, 0x80}, 0x55},
+			{[3]int{0x40, 0x00, 0xFF}, 0x49},
+			{[3]int{0xFF, 0xC0, 0xC0}, 0x48},
+			{[3]int{0xFF, 0xA0, 0x00}, 0x50},
+			{[3]int{0x00, 0xFF, 0xFF}, 0x51},
+			{[3]int{0x80, 0x00, 0xFF}, 0x4D},
+			{[3]int{0xFF, 0xE0, 0xE0}, 0x4C},
+			{[3]int{0xFF, 0xC0, 0x00}, 0x1C},
+			{[3]int{0x00, 0xC0, 0xFF}, 0x1D},
+			{[3]int{0xC0, 0x00, 0xFF}, 0x1E},
+			{[3]int{0xE0, 0xE0, 0xFF}, 0x1F},
+			{[3]int{0xFF, 0xFF, 0x00}, 0x18},
+			{[3]int{0x00, 0x80, 0xFF}, 0x19},
+			{[3]int{0xFF, 0x00, 0xFF}, 0x1A},
+			{[3]int{0xE0, 0xFF, 0xFF}, 0x1B},
+		},
+		Effects: map[string]uint32{
+			RGBEffectJump3: 0x04,
+			RGBEffectJump7: 0x05,
+			RGBEffectFade3: 0x06,
+			RGBEffectFade7: 0x07,
+			RGBEffectFlash: 0x0B,
+		},
+	},
+}
+
+func DefaultRGBState(infraredID int, remote rgbRemote) RGBState {
+	return RGBState{
+		InfraredID: infraredID,
+		Color:      "#ffffff",
+		Level:      remote.Levels,
+	}
+}
+
+//	Brightness converts the assumed level into a percentage
+func (s RGBState) Brightness(remote rgbRemote) int {
+	return s.Level * 100 / remote.Levels
+}
+
+//	parseColor reads "#rrggbb"
+func parseColor(color string) (rgb [3]int, err error) {
+	if len(color) != 7 || color[0] != '#' {
+		return rgb, fmt.Errorf("color %q is not #rrggbb", color)
+	}
+	for k := 0; k < 3; k++ {
+		v, err := strconv.ParseUint(color[1+2*k:3+2*k], 16, 8)
+		if err != nil {
+			return rgb, fmt.Errorf("color %q is not #rrggbb", color)
+		}
+		rgb[k] = int(v)
+	}
+	return rgb, nil
+}
+
+//	nearest returns the color key closest to rgb
+func (r rgbRemote) nearest(rgb [3]int) (key rgbKey) {
+	best := -1
+	for _, candidate := range r.Colors {
+		distance := 0
+		for k := 0; k < 3; k++ {
+			d := candidate.Color[k] - rgb[k]
+			distance += d * d
+		}
+		if best < 0 || distance < best {
+			best = distance
+			key = candidate
+		}
+	}
+	return key
+}
+
+//	Plan computes the key presses that take the strip from state to what is
+//	requested and the state assumed afterwards
+func (r rgbRemote) Plan(state RGBState, request RGBRequest) (presses []uint32, next RGBState, err error) {
+	next = state
+	if request.Power != nil && !*request.Power {
+		if state.Power {
+			presses = append(presses, r.Off)
+		}
+		next.Power = false
+		return presses, next, nil
+	}
+	if !state.Power {
+		presses = append(presses, r.On)
+		next.Power = true
+	}
+	if request.Color != "" {
+		rgb, err := parseColor(request.Color)
+		if err != nil {
+			return nil, state, err
+		}
+		key := r.nearest(rgb)
+		presses = append(presses, key.Command)
+		next.Color = fmt.Sprintf("#%02x%02x%02x", key.Color[0], key.Color[1], key.Color[2])
+		next.Effect = ""
+	}
+	if request.Effect != "" {
+		command, ok := r.Effects[request.Effect]
+		if !ok {
+			return nil, state, fmt.Errorf("effect %q not supported by this remote", request.Effect)
+		}
+		presses = append(presses, command)
+		next.Effect = request.Effect
+	}
+	target := next.Level + request.BrightnessStep
+	if request.Brightness != nil {
+		if *request.Brightness < 0 || *request.Brightness > 100 {
+			return nil, state, fmt.Errorf("brightness %d out of range [0, 100]", *request.Brightness)
+		}
+		target = (*request.Brightness*r.Levels + 50) / 100
+	}
+	if target < 1 {
+		target = 1
+	}
+	if target > r.Levels {
+		target = r.Levels
+	}
+	diff := target - next.Level
+	//Nos extremos o controlador satura, o que ressincroniza o estado suposto
+	if target == 1 || target == r.Levels {
+		if diff != 0 || request.Brightness != nil {
+			diff = r.Levels
+			if target == 1 {
+				diff = -r.Levels
+			}
+		}
+	}
+	for ; diff > 0; diff-- {
+		presses = append(presses, r.BrightUp)
+	}
+	for ; diff < 0; diff++ {
+		presses = append(presses, r.BrightDown)
+	}
+	next.Level = target
+	return presses, next, nil
+}
+
+//	SetRGB sends the presses needed to satisfy request and stores the assumed state
+//	The emitter is held throughout, since a press of anyone else in between
+//	would make the assumed state wrong
+func (i *InfraredManager) SetRGB(ctx context.Context, device Infrared, request RGBRequest) (state RGBState, err error) {
+	remote, ok := rgbRemotes[device.Model]
+	if !ok {
+		return state, ErrRGBModelUnknown
+	}
+	release, err := i.LockEmitter(ctx, device.Pin)
+	if err != nil {
+		return state, err
+	}
+	defer release()
+	previous, err := i.Repository.ReadRGBState(device.ID)
+	if err == ErrNotFound {
+		previous, err = DefaultRGBState(device.ID, remote), nil
+	}
+	if err != nil {
+		return state, err
+	}
+	presses, next, err := remote.Plan(previous, request)
+	if err != nil {
+		return state, err
+	}
+	for k, press := range presses {
+		if k > 0 {
+			time.Sleep(RGBPressInterval)
+		}
+		command := Command{
+			Protocol: ProtocolNEC,
+			Code:     NECCode(remote.Address, press),
+		}
+		if err := i.sendCommand(ctx, device, command); err != nil {
+			return state, err
+		}
+	}
+	i.Logger.Printf("rgb %d: %d presses, now %+v\n", device.ID, len(presses), next)
+	next.ID = previous.ID
+	next.InfraredID = device.ID
+	return i.Repository.WriteRGBState(next)
+}
+
+type RGBResponse struct {
+	State      RGBState `json:"state"`
+	Brightness int      `json:"brightness"`
+	Effects    []string `json:"effects"`
+}
+
+func rgbResponse(state RGBState, remote rgbRemote) RGBResponse {
+	effects := make([]string, 0, len(remote.Effects))
+	for effect := range remote.Effects {
+		effects = append(effects, effect)
+	}
+	sort.Strings(effects)
+	return RGBResponse{
+		State:      state,
+		Brightness: state.Brightness(remote),
+		Effects:    effects,
+	}
+}
+
+func (i *InfraredManager) readRGB(w http.ResponseWriter, r *http.Request) (device Infrared, remote rgbRemote, ok bool) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	device, err := i.Repository.ReadInfraredByID(id)
+	if err == nil && device.Type != TypeRGB {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeError(w, i.Logger, "reading rgb", err)
+		return device, remote, false
+	}
+	if remote, ok = rgbRemotes[device.Model]; !ok {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{"error": ErrRGBModelUnknown.Error()})
+		return device, remote, false
+	}
+	return device, remote, true
+}
+
+func (i *InfraredManager) RGBHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	device, remote, ok := i.readRGB(w, r)
+	if !ok {
+		return
+	}
+	state, err := i.Repository.ReadRGBState(device.ID)
+	if err == ErrNotFound {
+		state, err = DefaultRGBState(device.ID, remote), nil
+	}
+	if err != nil {
+		writeError(w, i.Logger, "reading rgb state", err)
+		return
+	}
+	json.NewEncoder(w).Encode(rgbResponse(state, remote))
+}
+
+func (i *InfraredManager) SetRGBHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	device, remote, ok := i.readRGB(w, r)
+	if !ok {
+		return
+	}
+	var request RGBRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		i.Logger.Printf("decoding rgb request: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if _, _, err := remote.Plan(RGBState{}, request); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	state, err := i.SetRGB(r.Context(), device, request)
+	if err != nil {
+		i.Logger.Printf("setting rgb %d: %v\n", device.ID, err)
+		w.WriteHeader(transmitStatus(err))
+		return
+	}
+	json.NewEncoder(w).Encode(rgbResponse(state, remote))
+}
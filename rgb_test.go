@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func (r *infraredRepository) ReadRGBState(infraredID int) (RGBState, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state, ok := r.rgbStates[infraredID]
+	if !ok {
+		return state, ErrNotFound
+	}
+	return state, nil
+}
+
+func (r *infraredRepository) WriteRGBState(state RGBState) (RGBState, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state.ID = state.InfraredID
+	r.rgbStates[state.InfraredID] = state
+	return state, nil
+}
+
+func repeat(command uint32, n int) (presses []uint32) {
+	for k := 0; k < n; k++ {
+		presses = append(presses, command)
+	}
+	return presses
+}
+
+//	TestRGBPlan checks the presses planned from an assumed state; brightness
+//	steps are relative to the assumed level, so requests reaching either end
+//	saturate the controller to resynchronise it
+func TestRGBPlan(t *testing.T) {
+	on, off := true, false
+	level := func(l int) *int { return &l }
+	remote := rgbRemotes[RGBModel24]
+	lit := RGBState{Power: true, Color: "#ffffff", Level: 5, Effect: RGBEffectFade}
+	tests := []struct {
+		name    string
+		state   RGBState
+		request RGBRequest
+		presses []uint32
+		next    RGBState
+	}{
+		{"on", RGBState{Color: "#ffffff", Level: 10}, RGBRequest{Power: &on}, []uint32{remote.On}, RGBState{Power: true, Color: "#ffffff", Level: 10}},
+		{"on while on", lit, RGBRequest{Power: &on}, nil, lit},
+		{"off", lit, RGBRequest{Power: &off, BrightnessStep: 2}, []uint32{remote.Off}, RGBState{Color: "#ffffff", Level: 5, Effect: RGBEffectFade}},
+		{"off while off", RGBState{Level: 5}, RGBRequest{Power: &off}, nil, RGBState{Level: 5}},
+		{"color", lit, RGBRequest{Color: "#fe0a05"}, []uint32{0x04}, RGBState{Power: true, Color: "#ff0000", Level: 5}},
+		{"color while off", RGBState{Level: 5}, RGBRequest{Color: "#0000ff"}, []uint32{remote.On, 0x06}, RGBState{Power: true, Color: "#0000ff", Level: 5}},
+		{"effect", lit, RGBRequest{Effect: RGBEffectStrobe}, []uint32{0x0F}, RGBState{Power: true, Color: "#ffffff", Level: 5, Effect: RGBEffectStrobe}},
+		{"step up", lit, RGBRequest{BrightnessStep: 2}, repeat(remote.BrightUp, 2), RGBState{Power: true, Color: "#ffffff", Level: 7, Effect: RGBEffectFade}},
+		{"step down", lit, RGBRequest{BrightnessStep: -3}, repeat(remote.BrightDown, 3), RGBState{Power: true, Color: "#ffffff", Level: 2, Effect: RGBEffectFade}},
+		//Nos extremos são enviados toques suficientes para saturar
+		{"step past top", lit, RGBRequest{BrightnessStep: 20}, repeat(remote.BrightUp, 10), RGBState{Power: true, Color: "#ffffff", Level: 10, Effect: RGBEffectFade}},
+		{"step past bottom", lit, RGBRequest{BrightnessStep: -20}, repeat(remote.BrightDown, 10), RGBState{Power: true, Color: "#ffffff", Level: 1, Effect: RGBEffectFade}},
+		{"step at top", RGBState{Power: true, Level: 10}, RGBRequest{BrightnessStep: 1}, nil, RGBState{Power: true, Level: 10}},
+		{"brightness", lit, RGBRequest{Brightness: level(84)}, repeat(remote.BrightUp, 3), RGBState{Power: true, Color: "#ffffff", Level: 8, Effect: RGBEffectFade}},
+		{"brightness 0", lit, RGBRequest{Brightness: level(0)}, repeat(remote.BrightDown, 10), RGBState{Power: true, Color: "#ffffff", Level: 1, Effect: RGBEffectFade}},
+		//Um valor absoluto no extremo ressincroniza mesmo sem diferença
+		{"brightness 100 at top", RGBState{Power: true, Level: 10}, RGBRequest{Brightness: level(100)}, repeat(remote.BrightUp, 10), RGBState{Power: true, Level: 10}},
+	}
+	for _, tt := range tests {
+		presses, next, err := remote.Plan(tt.state, tt.request)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(presses, tt.presses) {
+			t.Errorf("%s: presses %X, want %X", tt.name, presses, tt.presses)
+		}
+		if next != tt.next {
+			t.Errorf("%s: next %+v, want %+v", tt.name, next, tt.next)
+		}
+	}
+
+	for _, request := range []RGBRequest{
+		{Color: "red"},
+		{Color: "#12345g"},
+		{Effect: RGBEffectJump3},
+		{Brightness: level(-1)},
+		{Brightness: level(101)},
+	} {
+		if _, next, err := remote.Plan(lit, request); err == nil || next != lit {
+			t.Errorf("%+v: accepted, next %+v", request, next)
+		}
+	}
+}
+
+//	TestRGBToggle follows the assumed power of a remote whose single key
+//	toggles the strip, where a press too many inverts it
+func TestRGBToggle(t *testing.T) {
+	on, off := true, false
+	remote := rgbRemotes[RGBModel44]
+	state := DefaultRGBState(1, remote)
+	for _, step := range []struct {
+		request RGBRequest
+		presses []uint32
+		power   bool
+	}{
+		{RGBRequest{Power: &off}, nil, false},
+		{RGBRequest{Power: &on}, []uint32{0x40}, true},
+		{RGBRequest{Power: &on}, nil, true},
+		{RGBRequest{Color: "#ff0000"}, []uint32{0x58}, true},
+		{RGBRequest{Power: &off}, []uint32{0x40}, false},
+		{RGBRequest{Power: &off}, nil, false},
+		{RGBRequest{Effect: RGBEffectJump7}, []uint32{0x40, 0x05}, true},
+	} {
+		presses, next, err := remote.Plan(state, step.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(presses, step.presses) || next.Power != step.power {
+			t.Fatalf("from %+v: presses %X power %v, want %X power %v", state, presses, next.Power, step.presses, step.power)
+		}
+		state = next
+	}
+}
+
+func TestSetRGB(t *testing.T) {
+	i, transmitter := testInfraredManager(t)
+	repository := newInfraredRepository()
+	i.Repository = repository
+	device := Infrared{ID: 3, Type: TypeRGB, Model: RGBModel24, Pin: 22}
+
+	if _, err := i.SetRGB(context.Background(), Infrared{ID: 4, Type: TypeRGB, Model: "unknown", Pin: 22}, RGBRequest{}); err != ErrRGBModelUnknown {
+		t.Errorf("unknown model: %v, want ErrRGBModelUnknown", err)
+	}
+	state, err := i.SetRGB(context.Background(), device, RGBRequest{Color: "#00ff00", BrightnessStep: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Ligar, cor e um passo de brilho
+	if frames := transmitter.Frames(); len(frames) != 3 || frames[2].Pin != device.Pin {
+		t.Errorf("%d frames, want 3 on pin %d", len(frames), device.Pin)
+	}
+	want := RGBState{ID: device.ID, InfraredID: device.ID, Power: true, Color: "#00ff00", Level: 9}
+	if stored, _ := repository.ReadRGBState(device.ID); stored != state || stored != want {
+		t.Errorf("stored %+v, answered %+v, want %+v", stored, state, want)
+	}
+}
@@ -1,46 +1,65 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 //	Responsibilities:
 //	*	To schedule future relay and infrared operations
 //	ScheduleManager
 type ScheduleManager struct {
-	DatabaseManager *DatabaseManager
-	LogFile         *os.File
-	Logger          *log.Logger
+	Repository   Repository
+	MacroManager *MacroManager
+	EventManager *EventManager
+	LogFile      *os.File
+	Logger       *log.Logger
 }
 
 const (
 	ScheduleTypeRelay    = "TypeRelay"
 	ScheduleTypeInfrared = "TypeInfrared"
+	ScheduleTypeMacro    = "TypeMacro"
 
 	ScheduleFrequencySingle = "FrequencySingle"
 	ScheduleFrequencyDayly  = "FrequencyDayly"
+
+	//Intervalo entre verificações dos agendamentos
+	ScheduleTick = 15 * time.Second
 )
 
+//	Schedule runs at At; daily schedules only use the time of day of At
 type Schedule struct {
-	ID        int    `json:"id"`
-	Pin       int    `json:"pin"`
-	Type      string `json:"type"`
-	Frequency string `json:"frequency"`
+	ID        int       `json:"id" gorm:"primary_key"`
+	Pin       int       `json:"pin"`
+	Type      string    `json:"type"`
+	Frequency string    `json:"frequency"`
+	MacroID   int       `json:"macro_id"`
+	At        time.Time `json:"at"`
 }
 
 func NewScheduleManager() ScheduleManager {
 	return ScheduleManager{}
 }
 
-func (s *ScheduleManager) Initialize(logPath string, database *DatabaseManager) (err error) {
+func (s *ScheduleManager) Initialize(logPath string, repository Repository, macroManager *MacroManager, eventManager *EventManager) (err error) {
 	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
 	s.LogFile = f
 	s.Logger = log.New(s.LogFile, "", log.Ldate|log.Ltime)
-	s.DatabaseManager = database
+	s.Repository = repository
+	s.MacroManager = macroManager
+	s.EventManager = eventManager
 	s.Logger.Printf("ScheduleManager started.\n")
 	return nil
 }
@@ -49,3 +68,120 @@ func (s *ScheduleManager) Close() {
 	s.Logger.Printf("ScheduleManager closed.\n")
 	s.LogFile.Close()
 }
+
+//	Run fires every schedule due between two ticks until ctx is done
+func (s *ScheduleManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(ScheduleTick)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			schedules, err := s.Repository.ReadSchedule()
+			if err != nil {
+				s.Logger.Printf("reading schedules: %v\n", err)
+			}
+			for _, schedule := range schedules {
+				if schedule.Due(last, now) {
+					s.fire(schedule)
+				}
+			}
+			last = now
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//	Due tells whether the schedule falls in (from, to]
+func (schedule Schedule) Due(from, to time.Time) bool {
+	at := schedule.At
+	if schedule.Frequency == ScheduleFrequencyDayly {
+		local := at.In(to.Location())
+		at = time.Date(to.Year(), to.Month(), to.Day(), local.Hour(), local.Minute(), local.Second(), 0, to.Location())
+		if at.After(to) {
+			at = at.AddDate(0, 0, -1)
+		}
+	}
+	return at.After(from) && !at.After(to)
+}
+
+func (s *ScheduleManager) fire(schedule Schedule) {
+	s.Logger.Printf("firing schedule %d (%s)\n", schedule.ID, schedule.Type)
+	event := ScheduleEvent{ScheduleID: schedule.ID, Type: schedule.Type, MacroID: schedule.MacroID}
+	switch schedule.Type {
+	case ScheduleTypeMacro:
+		run, err := s.MacroManager.Start(schedule.MacroID)
+		if err != nil {
+			s.Logger.Printf("firing schedule %d: %v\n", schedule.ID, err)
+			event.Error = err.Error()
+		}
+		event.Run = run.Run
+	default:
+		s.Logger.Printf("firing schedule %d: unsupported type %q\n", schedule.ID, schedule.Type)
+		event.Error = fmt.Sprintf("unsupported type %q", schedule.Type)
+	}
+	s.EventManager.Publish(EventSchedule, event)
+	if schedule.Frequency == ScheduleFrequencySingle {
+		if err := s.Repository.DeleteSchedule(schedule); err != nil {
+			s.Logger.Printf("deleting schedule %d: %v\n", schedule.ID, err)
+		}
+	}
+}
+
+func (s *ScheduleManager) ScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	schedules, err := s.Repository.ReadSchedule()
+	if err != nil {
+		writeError(w, s.Logger, "reading schedules", err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(schedules); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *ScheduleManager) CreateScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	var schedule Schedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		s.Logger.Printf("decoding schedule: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if schedule.Frequency != ScheduleFrequencySingle && schedule.Frequency != ScheduleFrequencyDayly {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	//Agendamentos de relé e de infravermelho ainda não são executados por fire
+	if schedule.Type != ScheduleTypeMacro {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if _, err := s.Repository.ReadMacroByID(schedule.MacroID); err == ErrNotFound {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		writeError(w, s.Logger, "creating schedule", err)
+		return
+	}
+	schedule.ID = 0
+	schedule, err := s.Repository.CreateSchedule(schedule)
+	if err != nil {
+		writeError(w, s.Logger, "creating schedule", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(schedule)
+}
+
+func (s *ScheduleManager) DeleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if err := s.Repository.DeleteSchedule(Schedule{ID: id}); err != nil {
+		writeError(w, s.Logger, "deleting schedule", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -1,122 +1,412 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
-	"net/url"
+	"math/rand"
+	"net/http"
 	"os"
-	"os/signal"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	TelemetryDisconnected = "disconnected"
+	TelemetryConnecting   = "connecting"
+	TelemetryConnected    = "connected"
+
+	//Espera entre tentativas de conexão, dobrada a cada falha
+	TelemetryBackoffMin = time.Second
+	TelemetryBackoffMax = 5 * time.Minute
+	//Sem pong dentro de TelemetryPongWait a conexão é considerada perdida
+	TelemetryPongWait   = 60 * time.Second
+	TelemetryPingPeriod = TelemetryPongWait * 9 / 10
+	TelemetryWriteWait  = 10 * time.Second
+)
+
 //	Responsibilities:
 //	*	To send system state to the cloud
 //	TelemetryManager
 type TelemetryManager struct {
 	*DeviceManager
-	*DatabaseManager
-	LogFile   *os.File
-	Logger    *log.Logger
-	Websocket *websocket.Conn
+	Repository
+	LogFile *os.File
+	Logger  *log.Logger
+	Queue   *TelemetryQueue
+	Dialer  *websocket.Dialer
+
+	RelayManager        *RelayManager
+	CloudCommandManager *CloudCommandManager
+
+	fleetKey   string
+	writeLock  sync.Mutex
+	full       chan struct{}
+	status     TelemetryStatus
+	statusLock sync.Mutex
+	stopped    chan struct{}
+}
+
+//	TelemetryStatus is the state of the connection to the cloud
+type TelemetryStatus struct {
+	State     string    `json:"state"`
+	URL       string    `json:"url,omitempty"`
+	Since     time.Time `json:"since"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	Queued    int       `json:"queued"`
 }
 
-type TelemetryInfo struct {
-	UUID        string    `json:"uuid"`
-	Identifier  string    `json:"identifier"`
-	Temperature float64   `json:"temperature"`
-	LastUpdate  time.Time `json:"last_update"`
+//	TelemetryEventData is the data of an event record
+type TelemetryEventData struct {
+	Name string      `json:"name"`
+	Data interface{} `json:"data,omitempty"`
 }
 
-func NewTelemetryManager() TelemetryManager {
-	return TelemetryManager{}
+func NewTelemetryManager() *TelemetryManager {
+	return &TelemetryManager{
+		status:  TelemetryStatus{State: TelemetryDisconnected, Since: time.Now()},
+		stopped: make(chan struct{}),
+		full:    make(chan struct{}, 1),
+	}
 }
 
-func (t *TelemetryManager) Initialize(logPath string, database *DatabaseManager, deviceManager *DeviceManager) (err error) {
+func (t *TelemetryManager) Initialize(logPath string, repository Repository, deviceManager *DeviceManager, relayManager *RelayManager, cloudCommandManager *CloudCommandManager, eventManager *EventManager) (err error) {
 	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
 	t.LogFile = f
 	t.Logger = log.New(t.LogFile, "", log.Ldate|log.Ltime)
-	t.DatabaseManager = database
+	t.Repository = repository
 	t.DeviceManager = deviceManager
-	t.Logger.Printf("TelemetryManager started.\n")
+	t.RelayManager = relayManager
+	t.CloudCommandManager = cloudCommandManager
+	t.Queue, err = OpenTelemetryQueue(
+		envString(ConfigTelemetryQueueFile, DefaultTelemetryQueueFile),
+		envInt(ConfigTelemetryQueueSize, DefaultTelemetryQueueSize),
+	)
+	if err != nil {
+		return err
+	}
+	if t.Dialer, err = TelemetryDialer(); err != nil {
+		return err
+	}
+	eventManager.Listen(t.forward)
+	t.fleetKey = envString(ConfigTelemetryFleetKey, "")
+	if info, err := t.Repository.ReadInfo(); err == nil && !info.Enrolled && t.fleetKey == "" {
+		t.Logger.Printf("%s not set, the device secret can not be enrolled.\n", ConfigTelemetryFleetKey)
+	}
+	t.Logger.Printf("TelemetryManager started with %d queued records.\n", t.Queue.Len())
 	return nil
 }
 
+//	Close waits for Run to close the connection, for at most TelemetryWriteWait
 func (t *TelemetryManager) Close() {
+	select {
+	case <-t.stopped:
+	case <-time.After(TelemetryWriteWait):
+	}
 	t.Logger.Printf("TelemetryManager closed.\n")
 	t.LogFile.Close()
-	t.Websocket.Close()
-}
-
-func (t *TelemetryManager) Communicate() {
-	t.Logger.Printf("TelemetryManager#Communicate(): Starting communication proccess...")
-	defer t.Communicate()
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	info := t.DatabaseManager.ReadInfo()
-	environment := info.Environment
-	var host string
-	if environment == EnvironmentDevelopment {
-		host = "179.234.70.32:8081"
-	} else if environment == EnvironmentProduction {
-		host = "http://solutech.site"
-	}
-	u := url.URL{Scheme: "ws", Host: host, Path: "/shc/telemetria"}
-	t.Logger.Printf("connecting to %s", u.String())
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	t.Queue.Close()
+}
+
+//	Sample queues a report of the system state at every tick, connected or
+//	not: a full one first, at every TELEMETRY_FULL_INTERVAL and after each
+//	connection, and otherwise only the fields that changed
+func (t *TelemetryManager) Sample(ctx context.Context) {
+	info, err := t.Repository.ReadInfo()
+	for err != nil {
+		t.Logger.Printf("reading info: %v\n", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(15 * time.Second):
+		}
+		info, err = t.Repository.ReadInfo()
+	}
+	var ticker *time.Ticker
+	if info.Environment == EnvironmentDevelopment {
+		ticker = time.NewTicker(5 * time.Second)
+	} else if info.Environment == EnvironmentProduction {
+		ticker = time.NewTicker(60 * time.Second)
+	} else {
+		ticker = time.NewTicker(15 * time.Second)
+	}
+	defer ticker.Stop()
+	fullTicker := time.NewTicker(envInterval(ConfigTelemetryFullInterval, DefaultTelemetryFullInterval))
+	defer fullTicker.Stop()
+	last := make(map[string]json.RawMessage)
+	t.sample(info, last, true, time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case instant := <-ticker.C:
+			t.sample(info, last, false, instant)
+		case instant := <-fullTicker.C:
+			t.sample(info, last, true, instant)
+		case <-t.full:
+			t.sample(info, last, true, time.Now())
+		}
+	}
+}
+
+func (t *TelemetryManager) sample(info Info, last map[string]json.RawMessage, full bool, instant time.Time) {
+	report, ok, err := t.Report(info, t.Snapshot(), last, full, instant)
 	if err != nil {
-		t.Logger.Printf("communicating: %v\n", err)
-		time.Sleep(15 * time.Second)
+		t.Logger.Printf("building telemetry report: %v\n", err)
 		return
 	}
-	t.Logger.Printf("TelemetryManager#Communicate(): Communication proccess started succesfuly.")
+	if ok {
+		t.push(TelemetrySample, instant, report)
+	}
+}
+
+//	Event queues an event, sent with the samples in the order it happened
+func (t *TelemetryManager) Event(name string, data interface{}) {
+	t.push(TelemetryEvent, time.Now(), TelemetryEventData{Name: name, Data: data})
+}
+
+//	forward queues the relay, infrared and schedule events; sensor readings
+//	already go in the samples
+func (t *TelemetryManager) forward(event Event) {
+	switch event.Topic {
+	case EventRelay, EventInfrared, EventSchedule:
+		t.Event(event.Topic, event.Data)
+	}
+}
+
+func (t *TelemetryManager) push(kind string, timestamp time.Time, data interface{}) {
+	record, err := NewTelemetryRecord(kind, timestamp, data)
+	if err != nil {
+		t.Logger.Printf("creating telemetry record: %v\n", err)
+		return
+	}
+	if err := t.Queue.Push(record); err != nil {
+		t.Logger.Printf("queueing telemetry record: %v\n", err)
+	}
+}
+
+//	write sends v as JSON; commands answer from their own goroutines, and the
+//	connection allows a single writer at a time
+func (t *TelemetryManager) write(c *websocket.Conn, v interface{}) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	c.SetWriteDeadline(time.Now().Add(TelemetryWriteWait))
+	return c.WriteJSON(v)
+}
+
+//	flush sends the queued records not sent yet on this connection, oldest
+//	first, and adds them to sent. Records stay queued until the cloud
+//	acknowledges them, so the ones left unacknowledged are sent again on the
+//	next connection
+func (t *TelemetryManager) flush(c *websocket.Conn, sent map[string]bool) error {
+	pending := t.Queue.Pending()
+	queued := make(map[string]bool, len(pending))
+	for _, record := range pending {
+		queued[record.ID] = true
+		if sent[record.ID] {
+			continue
+		}
+		if err := t.write(c, record); err != nil {
+			return err
+		}
+		sent[record.ID] = true
+	}
+	//Os confirmados saem da fila e não precisam mais ser lembrados
+	for id := range sent {
+		if !queued[id] {
+			delete(sent, id)
+		}
+	}
+	return nil
+}
+
+//	acknowledge removes the records acknowledged by message and returns
+//	false if it is not an acknowledgement
+func (t *TelemetryManager) acknowledge(message []byte) bool {
+	var ack TelemetryAckMessage
+	if err := json.Unmarshal(message, &ack); err != nil || ack.Type != TelemetryAck {
+		return false
+	}
+	if err := t.Queue.Remove(ack.IDs); err != nil {
+		t.Logger.Printf("removing acknowledged telemetry records: %v\n", err)
+	}
+	return true
+}
+
+//	Run keeps the connection to the cloud up until ctx is done, waiting a
+//	jittered, exponentially growing delay between failed attempts
+func (t *TelemetryManager) Run(ctx context.Context) {
+	defer close(t.stopped)
+	backoff := TelemetryBackoffMin
+	for {
+		t.setStatus(TelemetryConnecting, nil)
+		up, err := t.session(ctx)
+		if ctx.Err() != nil {
+			t.setStatus(TelemetryDisconnected, nil)
+			t.Logger.Printf("TelemetryManager#Run(): stopped.\n")
+			return
+		}
+		//Uma conexão que durou volta ao intervalo mínimo
+		if up > TelemetryPongWait {
+			backoff = TelemetryBackoffMin
+		}
+		delay := jitter(backoff)
+		t.setStatus(TelemetryDisconnected, err)
+		t.Logger.Printf("telemetry connection: %v; reconnecting in %s\n", err, delay)
+		select {
+		case <-ctx.Done():
+			t.Logger.Printf("TelemetryManager#Run(): stopped.\n")
+			return
+		case <-time.After(delay):
+		}
+		if backoff *= 2; backoff > TelemetryBackoffMax {
+			backoff = TelemetryBackoffMax
+		}
+	}
+}
+
+//	jitter returns a random delay between half and all of backoff, so that
+//	devices that lost the same server do not reconnect all at once
+func jitter(backoff time.Duration) time.Duration {
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+//	session connects, sends the queued records and keeps the connection alive
+//	with pings until it fails or ctx is done; up is how long it was connected
+func (t *TelemetryManager) session(ctx context.Context) (up time.Duration, err error) {
+	info, err := EnsureDeviceSecret(t.Repository)
+	if err != nil {
+		return 0, err
+	}
+	u, err := TelemetryURL(info)
+	if err != nil {
+		return 0, err
+	}
+	t.setURL(u)
+	t.Logger.Printf("connecting to %s", u)
+	header, enrolling := TelemetryHeader(info, t.fleetKey, strings.HasPrefix(u, "wss:"), time.Now())
+	dialCtx, cancel := context.WithTimeout(ctx, TelemetryWriteWait)
+	c, response, err := t.Dialer.DialContext(dialCtx, u, header)
+	cancel()
+	if err != nil {
+		//Credencial recusada aparece como falha no handshake
+		if response != nil {
+			return 0, fmt.Errorf("%v (%s)", err, response.Status)
+		}
+		return 0, err
+	}
 	defer c.Close()
-	done := make(chan struct{})
+	if enrolling {
+		//A nuvem aceitou o segredo; daqui em diante ele assina as conexões
+		info.Enrolled = true
+		if _, err := t.Repository.WriteInfo(info); err != nil {
+			return 0, fmt.Errorf("saving enrollment: %v", err)
+		}
+		t.Logger.Printf("TelemetryManager#Run(): device secret enrolled.\n")
+	}
+	connected := time.Now()
+	t.setStatus(TelemetryConnected, nil)
+	t.Logger.Printf("TelemetryManager#Run(): connected to %s.\n", u)
+
+	//Leitura: cada pong adia o prazo; sem ele a leitura falha e a sessão termina
+	c.SetReadDeadline(time.Now().Add(TelemetryPongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(TelemetryPongWait))
+	})
+	done := make(chan error, 1)
 	go func() {
-		defer close(done)
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil {
-				t.Logger.Println("Ao receber mensagem: ", err)
-				time.Sleep(15 * time.Second)
+				done <- err
 				return
 			}
-			t.Logger.Printf("Recebido: %s", message)
+			reply := func(r CloudReply) error {
+				return t.write(c, r)
+			}
+			if t.acknowledge(message) {
+				continue
+			}
+			if !t.CloudCommandManager.Handle(message, reply) {
+				t.Logger.Printf("Recebido: %s", message)
+			}
 		}
 	}()
-	t.Websocket = c
-	var ticker *time.Ticker
-	if environment == EnvironmentDevelopment {
-		ticker = time.NewTicker(5 * time.Second)
-	} else if environment == EnvironmentProduction {
-		ticker = time.NewTicker(60 * time.Second)
-	} else {
-		ticker = time.NewTicker(15 * time.Second)
+
+	ping := time.NewTicker(TelemetryPingPeriod)
+	defer ping.Stop()
+	//Registros guardados enquanto desconectado vão primeiro, seguidos de um
+	//relatório completo, já que a nuvem pode ter perdido deltas
+	sent := make(map[string]bool)
+	err = t.flush(c, sent)
+	select {
+	case t.full <- struct{}{}:
+	default:
 	}
-	defer ticker.Stop()
-	isUp := true
-	for isUp {
+	for err == nil {
 		select {
-		case <-done:
-			isUp = false
-		case instant := <-ticker.C:
-			telemetryInfo := TelemetryInfo{
-				Identifier:  info.Identifier,
-				LastUpdate:  instant,
-				Temperature: t.DeviceManager.Temperature().TemperatureValue,
-				UUID:        info.UUID,
-			}
-			err = c.WriteJSON(telemetryInfo)
-			if err != nil {
-				t.Logger.Printf("writing JSON: %v\n", err)
-				isUp = false
-				time.Sleep(15 * time.Second)
-			}
-		case <-interrupt:
-			isUp = false
+		case <-ctx.Done():
+			c.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(TelemetryWriteWait))
+			return time.Since(connected), nil
+		case err = <-done:
+		case <-ping.C:
+			err = c.WriteControl(websocket.PingMessage, nil, time.Now().Add(TelemetryWriteWait))
+		case <-t.Queue.Notify():
+			err = t.flush(c, sent)
 		}
 	}
+	return time.Since(connected), err
+}
+
+func (t *TelemetryManager) setStatus(state string, err error) {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	if state != t.status.State {
+		t.status.State = state
+		t.status.Since = time.Now()
+	}
+	switch state {
+	case TelemetryConnecting:
+		t.status.Attempts++
+	case TelemetryConnected:
+		t.status.Attempts = 0
+		t.status.LastError = ""
+	}
+	if err != nil {
+		t.status.LastError = err.Error()
+	}
+}
+
+func (t *TelemetryManager) setURL(u string) {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	t.status.URL = u
+}
+
+//	Status returns the state of the connection and how many records are queued
+func (t *TelemetryManager) Status() TelemetryStatus {
+	t.statusLock.Lock()
+	status := t.status
+	t.statusLock.Unlock()
+	status.Queued = t.Queue.Len()
+	return status
+}
+
+func (t *TelemetryManager) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	if err := json.NewEncoder(w).Encode(t.Status()); err != nil {
+		t.Logger.Printf("encoding telemetry status: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//	telemetryRepository only knows the device info and the relays
+type telemetryRepository struct {
+	Repository
+	info   Info
+	relays []Relay
+	lock   sync.Mutex
+}
+
+func (r *telemetryRepository) ReadRelay() ([]Relay, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.relays, nil
+}
+
+func (r *telemetryRepository) setRelays(relays []Relay) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.relays = relays
+}
+
+func (r *telemetryRepository) ReadInfo() (Info, error) {
+	return r.info, nil
+}
+
+func (r *telemetryRepository) WriteInfo(info Info) (Info, error) {
+	r.info = info
+	return info, nil
+}
+
+func testTelemetryManager(t *testing.T) *TelemetryManager {
+	t.Helper()
+	queue, err := OpenTelemetryQueue(filepath.Join(t.TempDir(), "telemetry.jsonl"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { queue.Close() })
+	tm := NewTelemetryManager()
+	tm.Logger = log.New(ioutil.Discard, "", 0)
+	tm.Queue = queue
+	tm.Dialer = &websocket.Dialer{HandshakeTimeout: TelemetryWriteWait}
+	tm.Repository = &telemetryRepository{info: Info{UUID: "device", Environment: EnvironmentDevelopment}}
+	tm.CloudCommandManager = NewCloudCommandManager()
+	tm.CloudCommandManager.Logger = tm.Logger
+	tm.CloudCommandManager.Repository = tm.Repository
+	return tm
+}
+
+func pushTelemetry(t *testing.T, tm *TelemetryManager, n int) (ids []string) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		record, err := NewTelemetryRecord(TelemetryEvent, time.Now(), TelemetryEventData{Name: "test", Data: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tm.Queue.Push(record); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, record.ID)
+	}
+	return ids
+}
+
+//	TestTelemetryAck sends three records, of which the cloud acknowledges two
+//	before the connection drops; only the third is sent on the next one
+func TestTelemetryAck(t *testing.T) {
+	tm := testTelemetryManager(t)
+	ids := pushTelemetry(t, tm, 3)
+
+	connections := make(chan []string, 2)
+	first := true
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var received []string
+		for len(received) < tm.Queue.Len() {
+			var record TelemetryRecord
+			if err := c.ReadJSON(&record); err != nil {
+				return
+			}
+			received = append(received, record.ID)
+		}
+		acked := received
+		if first {
+			acked, first = received[:2], false
+		}
+		c.WriteJSON(TelemetryAckMessage{Type: TelemetryAck, IDs: acked})
+		connections <- received
+	}))
+	defer server.Close()
+	os.Setenv(ConfigTelemetryURL, "ws"+strings.TrimPrefix(server.URL, "http")+"/telemetria")
+	defer os.Unsetenv(ConfigTelemetryURL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := tm.session(ctx); err == nil {
+		t.Fatal("first session ended without error")
+	}
+	if first := <-connections; strings.Join(first, ",") != strings.Join(ids, ",") {
+		t.Errorf("first connection received %v, want %v", first, ids)
+	}
+	pending := tm.Queue.Pending()
+	if len(pending) != 1 || pending[0].ID != ids[2] {
+		t.Fatalf("pending %v after acknowledging %v", pending, ids[:2])
+	}
+
+	tm.session(ctx)
+	if second := <-connections; len(second) != 1 || second[0] != ids[2] {
+		t.Errorf("second connection received %v, want %v", second, ids[2:])
+	}
+	if n := tm.Queue.Len(); n != 0 {
+		t.Errorf("%d records queued after every ack", n)
+	}
+}
+
+//	TestTelemetryQueueReopen checks that unacknowledged records survive a restart
+func TestTelemetryQueueReopen(t *testing.T) {
+	tm := testTelemetryManager(t)
+	ids := pushTelemetry(t, tm, 3)
+	if err := tm.Queue.Remove([]string{ids[1], "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+	tm.Queue.Close()
+	queue, err := OpenTelemetryQueue(tm.Queue.Path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	pending := queue.Pending()
+	if len(pending) != 2 || pending[0].ID != ids[0] || pending[1].ID != ids[2] {
+		t.Errorf("reopened queue has %v, want %v and %v", pending, ids[0], ids[2])
+	}
+}
+
+func TestTelemetryForwardsEvents(t *testing.T) {
+	tm := testTelemetryManager(t)
+	em := NewEventManager()
+	em.Listen(tm.forward)
+	em.Publish(EventRelay, RelayEvent{RelayID: 1, Command: CommandOn})
+	em.Publish(EventSensor, SensorEvent{Temperature: 21})
+	em.Publish(EventSchedule, ScheduleEvent{ScheduleID: 2, Type: ScheduleTypeMacro})
+	em.Publish(EventInfrared, Decoded{Protocol: ProtocolNEC})
+
+	var names []string
+	for _, record := range tm.Queue.Pending() {
+		var event TelemetryEventData
+		if err := json.Unmarshal(record.Data, &event); err != nil || record.Type != TelemetryEvent {
+			t.Fatalf("record %+v: %v", record, err)
+		}
+		names = append(names, event.Name)
+	}
+	if got := strings.Join(names, ","); got != "relay,schedule,infrared" {
+		t.Errorf("forwarded %s, want relay,schedule,infrared", got)
+	}
+}
+
+//	TestTelemetryEnrollment enrolls the device secret on the first
+//	connection and signs the next ones, and cloud commands, with it
+func TestTelemetryEnrollment(t *testing.T) {
+	tm := testTelemetryManager(t)
+	tm.fleetKey = "fleet"
+	info, err := EnsureDeviceSecret(tm.Repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(DeviceCredential(info)) != DeviceSecretSize || info.Enrolled {
+		t.Fatalf("generated %+v", info)
+	}
+	if again, _ := EnsureDeviceSecret(tm.Repository); again.Secret != info.Secret {
+		t.Error("EnsureDeviceSecret replaced the secret")
+	}
+	now := time.Now()
+	command := CloudCommand{Type: CloudMessageCommand, ID: "1", Action: CloudActionConfig, Expires: now.Add(time.Minute)}
+	command.Signature = hex.EncodeToString(command.Sign(DeviceCredential(info)))
+	if err := tm.CloudCommandManager.Verify(command, now); err != ErrCloudCommandDisabled {
+		t.Errorf("verifying before enrollment: %v, want ErrCloudCommandDisabled", err)
+	}
+
+	if header, enrolling := TelemetryHeader(info, tm.fleetKey, false, now); enrolling || header.Get(TelemetryHeaderSecret) != "" {
+		t.Error("secret sent without TLS")
+	}
+	header, enrolling := TelemetryHeader(info, tm.fleetKey, true, now)
+	if !enrolling || header.Get(TelemetryHeaderSecret) != info.Secret || header.Get(TelemetryHeaderEnrollment) == "" {
+		t.Fatalf("enrollment header %v", header)
+	}
+	fleet := hmac.New(sha256.New, []byte(tm.fleetKey))
+	fleet.Write([]byte(info.UUID))
+	mac := hmac.New(sha256.New, fleet.Sum(nil))
+	mac.Write([]byte(info.UUID + "\n" + header.Get(TelemetryHeaderTimestamp) + "\n" + info.Secret))
+	if header.Get(TelemetryHeaderEnrollment) != hex.EncodeToString(mac.Sum(nil)) {
+		t.Error("enrollment not signed with the fleet credential")
+	}
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := upgrader.Upgrade(w, r, nil); err == nil {
+			c.Close()
+		}
+	}))
+	defer server.Close()
+	tm.Dialer.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	os.Setenv(ConfigTelemetryURL, "wss"+strings.TrimPrefix(server.URL, "https")+"/telemetria")
+	defer os.Unsetenv(ConfigTelemetryURL)
+	tm.session(context.Background())
+	if info, _ = tm.Repository.ReadInfo(); !info.Enrolled {
+		t.Fatal("device not enrolled after connecting")
+	}
+
+	header, enrolling = TelemetryHeader(info, tm.fleetKey, true, now)
+	if enrolling || header.Get(TelemetryHeaderSecret) != "" {
+		t.Error("enrolled device sent its secret")
+	}
+	mac = hmac.New(sha256.New, DeviceCredential(info))
+	mac.Write([]byte(info.UUID + "\n" + header.Get(TelemetryHeaderTimestamp)))
+	if header.Get(TelemetryHeaderSignature) != hex.EncodeToString(mac.Sum(nil)) {
+		t.Error("handshake not signed with the device secret")
+	}
+	if err := tm.CloudCommandManager.Verify(command, now); err != nil {
+		t.Errorf("verifying command signed with the device secret: %v", err)
+	}
+	other := Info{UUID: info.UUID, Secret: hex.EncodeToString(make([]byte, DeviceSecretSize))}
+	command.Signature = hex.EncodeToString(command.Sign(DeviceCredential(other)))
+	if err := tm.CloudCommandManager.Verify(command, now); err != ErrCloudCommandSignature {
+		t.Errorf("verifying command signed with another secret: %v, want ErrCloudCommandSignature", err)
+	}
+}
+
+func TestSnapshotSensors(t *testing.T) {
+	defer func(temperature, analogVariance string) {
+		temperatureCommand, analogVarianceCommand = temperature, analogVariance
+	}(temperatureCommand, analogVarianceCommand)
+	tm := testTelemetryManager(t)
+	tm.DeviceManager = &DeviceManager{Logger: tm.Logger}
+	tm.Repository.(*telemetryRepository).relays = []Relay{
+		{ID: 1, Name: "sala", Type: TypeLamp},
+		{ID: 2, Name: "portão", Type: "gate"},
+	}
+
+	temperatureCommand, analogVarianceCommand = "echo \"temp=48.3'C\"", "echo 0.010"
+	snapshot := tm.Snapshot()
+	if snapshot.Temperature == nil || *snapshot.Temperature != 48.3 {
+		t.Errorf("temperature %v, want 48.3", snapshot.Temperature)
+	}
+	if len(snapshot.Relays) != 2 || snapshot.Relays[0].State != RelayOn || snapshot.Relays[1].State != RelayOff {
+		t.Errorf("relays %+v, want the lamp on and the gate off", snapshot.Relays)
+	}
+
+	//Sensores com falha não travam a amostra e ficam de fora dela
+	temperatureCommand, analogVarianceCommand = "echo garbage", "exit 1"
+	snapshot = tm.Snapshot()
+	if snapshot.Temperature != nil || snapshot.AnalogVariance != nil || snapshot.Relays != nil {
+		t.Errorf("snapshot %+v, want failed readings omitted", snapshot)
+	}
+}
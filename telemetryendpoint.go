@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	//URL completa, como wss://solutech.site/shc/telemetria; sem ela vale a do ambiente
+	ConfigTelemetryURL   = "TELEMETRY_URL"
+	ConfigTelemetryPath  = "TELEMETRY_PATH"
+	DefaultTelemetryPath = "/shc/telemetria"
+	//Certificados PEM confiáveis além dos do sistema, para servidores com CA própria
+	ConfigTelemetryCAFile     = "TELEMETRY_CA_FILE"
+	ConfigTelemetryServerName = "TELEMETRY_TLS_SERVER_NAME"
+	//Chave da frota, usada apenas para registrar o segredo de cada dispositivo
+	ConfigTelemetryFleetKey = "TELEMETRY_FLEET_KEY"
+	DeviceSecretSize        = 32
+
+	TelemetryHeaderUUID       = "X-Device-UUID"
+	TelemetryHeaderIdentifier = "X-Device-Identifier"
+	TelemetryHeaderTimestamp  = "X-Device-Timestamp"
+	TelemetryHeaderSignature  = "X-Device-Signature"
+	TelemetryHeaderSecret     = "X-Device-Secret"
+	TelemetryHeaderEnrollment = "X-Device-Enrollment"
+)
+
+//	Endpoints used when TELEMETRY_URL is not set
+var TelemetryEndpoints = map[string]string{
+	EnvironmentDevelopment: "ws://179.234.70.32:8081",
+	EnvironmentProduction:  "wss://solutech.site",
+}
+
+var ErrTelemetryEndpoint = errors.New("no telemetry endpoint configured")
+
+//	TelemetryURL returns the websocket URL for the environment of info
+//	http and https URLs are accepted and turned into ws and wss ones
+func TelemetryURL(info Info) (string, error) {
+	raw := envString(ConfigTelemetryURL, TelemetryEndpoints[info.Environment])
+	if raw == "" {
+		return "", fmt.Errorf("%v for environment %q", ErrTelemetryEndpoint, info.Environment)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("telemetry URL %q: unsupported scheme %q", raw, u.Scheme)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("telemetry URL %q: missing host", raw)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = envString(ConfigTelemetryPath, DefaultTelemetryPath)
+	}
+	return u.String(), nil
+}
+
+//	TelemetryDialer returns a dialer that trusts the system certificates plus
+//	the ones in TELEMETRY_CA_FILE, if set
+func TelemetryDialer() (*websocket.Dialer, error) {
+	config := &tls.Config{
+		ServerName: envString(ConfigTelemetryServerName, ""),
+	}
+	if file := envString(ConfigTelemetryCAFile, ""); file != "" {
+		pool, err := loadRootCAs(file)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: TelemetryWriteWait,
+		TLSClientConfig:  config,
+	}, nil
+}
+
+//	loadRootCAs returns the system certificates plus the PEM ones in file
+func loadRootCAs(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", file)
+	}
+	return pool, nil
+}
+
+//	DeviceCredential is the secret of a device, generated on it by
+//	EnsureDeviceSecret and registered with the cloud on the first connection;
+//	nil while there is none
+func DeviceCredential(info Info) []byte {
+	secret, err := hex.DecodeString(info.Secret)
+	if err != nil || len(secret) == 0 {
+		return nil
+	}
+	return secret
+}
+
+//	EnsureDeviceSecret generates the secret of the device if it has none
+//	It never leaves the device except to enroll and in sealed backups
+func EnsureDeviceSecret(repository InfoRepository) (Info, error) {
+	info, err := repository.ReadInfo()
+	if err != nil || info.Secret != "" {
+		return info, err
+	}
+	secret := make([]byte, DeviceSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return info, err
+	}
+	info.Secret = hex.EncodeToString(secret)
+	info.Enrolled = false
+	return repository.WriteInfo(info)
+}
+
+//	TelemetryHeader identifies the device and proves it holds its secret by
+//	signing "<uuid>\n<unix timestamp>"; the timestamp lets the server refuse
+//	replayed handshakes
+//	A device not enrolled yet sends its secret instead, only over TLS, signed
+//	with the credential the server derives from the fleet key and the UUID;
+//	the server keeps the first secret enrolled for a UUID, so a leaked fleet
+//	key does not give access to devices already enrolled
+//	Without either only the identification is sent
+func TelemetryHeader(info Info, fleetKey string, secure bool, now time.Time) (header http.Header, enrolling bool) {
+	header = http.Header{}
+	header.Set(TelemetryHeaderUUID, info.UUID)
+	header.Set(TelemetryHeaderIdentifier, info.Identifier)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	credential := DeviceCredential(info)
+	switch {
+	case credential != nil && info.Enrolled:
+		mac := hmac.New(sha256.New, credential)
+		mac.Write([]byte(info.UUID + "\n" + timestamp))
+		header.Set(TelemetryHeaderTimestamp, timestamp)
+		header.Set(TelemetryHeaderSignature, hex.EncodeToString(mac.Sum(nil)))
+	case credential != nil && fleetKey != "" && secure:
+		fleet := hmac.New(sha256.New, []byte(fleetKey))
+		fleet.Write([]byte(info.UUID))
+		mac := hmac.New(sha256.New, fleet.Sum(nil))
+		mac.Write([]byte(info.UUID + "\n" + timestamp + "\n" + info.Secret))
+		header.Set(TelemetryHeaderTimestamp, timestamp)
+		header.Set(TelemetryHeaderSecret, info.Secret)
+		header.Set(TelemetryHeaderEnrollment, hex.EncodeToString(mac.Sum(nil)))
+		enrolling = true
+	}
+	return header, enrolling
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	TelemetrySample = "sample"
+	TelemetryEvent  = "event"
+	//Confirmação da nuvem, com os IDs dos registros já guardados
+	TelemetryAck = "telemetry_ack"
+
+	//Registros guardados enquanto a nuvem está inacessível; os mais antigos são descartados
+	DefaultTelemetryQueueSize = 10000
+	ConfigTelemetryQueueSize  = "TELEMETRY_QUEUE_SIZE"
+	DefaultTelemetryQueueFile = "data/telemetry.jsonl"
+	ConfigTelemetryQueueFile  = "TELEMETRY_QUEUE_FILE"
+)
+
+//	TelemetryRecord is a sample or event as sent to the cloud
+//	ID is unique per record, so the cloud can ignore records sent twice
+type TelemetryRecord struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Timestamp time.Time       `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+//	TelemetryAckMessage is sent by the cloud once it has stored records
+type TelemetryAckMessage struct {
+	Type string   `json:"type"`
+	IDs  []string `json:"ids"`
+}
+
+//	TelemetryQueue keeps records on disk, one JSON per line, until the cloud
+//	acknowledges them
+type TelemetryQueue struct {
+	Path string
+	Max  int
+
+	records []TelemetryRecord
+	file    *os.File
+	notify  chan struct{}
+	lock    sync.Mutex
+}
+
+func NewTelemetryRecord(kind string, timestamp time.Time, data interface{}) (record TelemetryRecord, err error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return record, err
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return record, err
+	}
+	return TelemetryRecord{
+		ID:        hex.EncodeToString(id),
+		Type:      kind,
+		Timestamp: timestamp,
+		Data:      raw,
+	}, nil
+}
+
+//	OpenTelemetryQueue loads the records left by a previous run
+//	Lines that can not be decoded, like one cut by a power loss, are skipped
+func OpenTelemetryQueue(path string, max int) (*TelemetryQueue, error) {
+	q := &TelemetryQueue{
+		Path:   path,
+		Max:    max,
+		notify: make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var record TelemetryRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err == nil {
+				q.records = append(q.records, record)
+			}
+		}
+		f.Close()
+	}
+	if len(q.records) > q.Max {
+		q.records = q.records[len(q.records)-q.Max:]
+	}
+	if err := q.rewrite(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+//	Push appends record, dropping the oldest one when the queue is full
+func (q *TelemetryQueue) Push(record TelemetryRecord) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.records = append(q.records, record)
+	var err error
+	if len(q.records) > q.Max {
+		q.records = q.records[len(q.records)-q.Max:]
+		err = q.rewrite()
+	} else {
+		err = q.append(record)
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+//	Pending returns the queued records, oldest first
+func (q *TelemetryQueue) Pending() []TelemetryRecord {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return append([]TelemetryRecord(nil), q.records...)
+}
+
+//	Remove drops the records acknowledged by the cloud; unknown IDs, of
+//	records already dropped or acknowledged twice, are ignored
+func (q *TelemetryQueue) Remove(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	acked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		acked[id] = true
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	kept := q.records[:0]
+	for _, record := range q.records {
+		if !acked[record.ID] {
+			kept = append(kept, record)
+		}
+	}
+	if len(kept) == len(q.records) {
+		return nil
+	}
+	q.records = kept
+	return q.rewrite()
+}
+
+func (q *TelemetryQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.records)
+}
+
+//	Notify receives a value whenever a record is pushed
+func (q *TelemetryQueue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+func (q *TelemetryQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	return q.file.Close()
+}
+
+func (q *TelemetryQueue) append(record TelemetryRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := q.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return q.file.Sync()
+}
+
+//	rewrite replaces the file with the records in memory, through a
+//	temporary file so that a crash leaves either the old or the new queue
+func (q *TelemetryQueue) rewrite() error {
+	tmp := q.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, record := range q.records {
+		if err := encoder.Encode(record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, q.Path); err != nil {
+		return err
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file, err = os.OpenFile(q.Path, os.O_APPEND|os.O_WRONLY, 0644)
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+const (
+	//Versão do formato das amostras; a 1 era TelemetryInfo, sem campo version
+	TelemetryReportVersion = 2
+
+	//Além da reconexão, um relatório completo é enviado periodicamente
+	//para que a nuvem se recupere de amostras descartadas da fila
+	DefaultTelemetryFullInterval = time.Hour
+	ConfigTelemetryFullInterval  = "TELEMETRY_FULL_INTERVAL"
+	DefaultTelemetryDiskPath     = "/"
+	ConfigTelemetryDiskPath      = "TELEMETRY_DISK_PATH"
+)
+
+//	TelemetryReport is a sample of the system state
+//	A full report carries every field; the others carry only the fields that
+//	changed since the previous report, so the cloud applies them in order
+type TelemetryReport struct {
+	Version    int                        `json:"version"`
+	UUID       string                     `json:"uuid"`
+	Identifier string                     `json:"identifier"`
+	Timestamp  time.Time                  `json:"timestamp"`
+	Full       bool                       `json:"full"`
+	Fields     map[string]json.RawMessage `json:"fields"`
+}
+
+//	TelemetrySnapshot holds the readings of a report; readings that fail are
+//	left nil and omitted, so the cloud keeps their previous value
+type TelemetrySnapshot struct {
+	Temperature     *float64         `json:"temperature,omitempty"`
+	AnalogVariance  *float64         `json:"analog_variance,omitempty"`
+	Relays          []TelemetryRelay `json:"relays,omitempty"`
+	BootTime        *time.Time       `json:"boot_time,omitempty"`
+	Memory          *MemoryUsage     `json:"memory,omitempty"`
+	Disk            *DiskUsage       `json:"disk,omitempty"`
+	Wireless        *WirelessSignal  `json:"wireless,omitempty"`
+	SoftwareVersion string           `json:"software_version"`
+	LastError       *ErrorReport     `json:"last_error,omitempty"`
+}
+
+type TelemetryRelay struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	State string `json:"state"`
+}
+
+//	Snapshot reads the current system state
+func (t *TelemetryManager) Snapshot() TelemetrySnapshot {
+	snapshot := TelemetrySnapshot{SoftwareVersion: Version}
+	if temperature, err := t.DeviceManager.ReadTemperature(); err != nil {
+		t.Logger.Printf("%v\n", err)
+	} else {
+		snapshot.Temperature = &temperature
+	}
+	//Uma só leitura do sensor de corrente serve a todos os relés
+	analogVariance, err := t.DeviceManager.ReadAnalogVariance()
+	if err != nil {
+		t.Logger.Printf("%v\n", err)
+	} else {
+		snapshot.AnalogVariance = &analogVariance
+	}
+	if relays, err := t.Repository.ReadRelay(); err != nil {
+		t.Logger.Printf("reading relays: %v\n", err)
+	} else if snapshot.AnalogVariance != nil {
+		//Sem a leitura os relés ficam de fora e a nuvem mantém os estados anteriores
+		snapshot.Relays = make([]TelemetryRelay, 0, len(relays))
+		for _, relay := range relays {
+			relay.State = RelayOff
+			if relay.Type == TypeLamp {
+				relay.State = lampState(relay, analogVariance)
+			}
+			snapshot.Relays = append(snapshot.Relays, TelemetryRelay{
+				ID:    relay.ID,
+				Name:  relay.Name,
+				Type:  relay.Type,
+				State: relay.State,
+			})
+		}
+	}
+	if bootTime, err := t.DeviceManager.BootTime(); err != nil {
+		t.Logger.Printf("reading boot time: %v\n", err)
+	} else {
+		snapshot.BootTime = &bootTime
+	}
+	if memory, err := t.DeviceManager.Memory(); err != nil {
+		t.Logger.Printf("reading memory: %v\n", err)
+	} else {
+		snapshot.Memory = &memory
+	}
+	if disk, err := t.DeviceManager.Disk(envString(ConfigTelemetryDiskPath, DefaultTelemetryDiskPath)); err != nil {
+		t.Logger.Printf("reading disk: %v\n", err)
+	} else {
+		snapshot.Disk = &disk
+	}
+	if wireless, err := t.DeviceManager.WirelessSignal(); err != nil {
+		t.Logger.Printf("reading wireless signal: %v\n", err)
+	} else {
+		snapshot.Wireless = &wireless
+	}
+	if lastError, ok := LastError(); ok {
+		snapshot.LastError = &lastError
+	}
+	return snapshot
+}
+
+//	Report builds the report of snapshot; last holds the fields as last
+//	reported and is updated. ok is false for a delta with no changes
+func (t *TelemetryManager) Report(info Info, snapshot TelemetrySnapshot, last map[string]json.RawMessage, full bool, instant time.Time) (report TelemetryReport, ok bool, err error) {
+	current, err := snapshotFields(snapshot)
+	if err != nil {
+		return report, false, err
+	}
+	fields := current
+	if !full {
+		fields = make(map[string]json.RawMessage)
+		for name, value := range current {
+			if !bytes.Equal(last[name], value) {
+				fields[name] = value
+			}
+		}
+	}
+	for name, value := range fields {
+		last[name] = value
+	}
+	return TelemetryReport{
+		Version:    TelemetryReportVersion,
+		UUID:       info.UUID,
+		Identifier: info.Identifier,
+		Timestamp:  instant,
+		Full:       full,
+		Fields:     fields,
+	}, full || len(fields) > 0, nil
+}
+
+func snapshotFields(snapshot TelemetrySnapshot) (fields map[string]json.RawMessage, err error) {
+	raw, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(raw, &fields)
+	return fields, err
+}
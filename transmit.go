@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//Quadros aguardando envio em cada pino antes de recusar novos
+	DefaultTransmitQueueSize = 16
+	ConfigTransmitQueueSize  = "IR_TRANSMIT_QUEUE"
+
+	//Espera máxima por um quadro na fila, e pelo emissor de quem envia
+	//sem uma requisição, como o MQTT
+	TransmitWait = 30 * time.Second
+)
+
+var ErrTransmitQueueFull = errors.New("infrared transmit queue full")
+
+//	waveLock serialises every frame: pigpio transmits a single waveform at a
+//	time, so frames on different pins can not overlap either
+var waveLock sync.Mutex
+
+//	transmission is a frame waiting in the queue of a pin
+type transmission struct {
+	send   func() error
+	result chan error
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+//	transmit queues send on the emitter pin and waits for its result
+//	Frames on the same pin are sent in the order they were queued
+func (i *InfraredManager) transmit(ctx context.Context, pin int, send func() error) error {
+	t, err := i.enqueue(ctx, pin, send)
+	if err != nil {
+		return err
+	}
+	return i.wait(pin, t)
+}
+
+//	enqueue queues send without waiting for it, failing when the queue of pin is full
+//	The frame is dropped if ctx is done, or TransmitWait passes, before its turn
+func (i *InfraredManager) enqueue(ctx context.Context, pin int, send func() error) (t transmission, err error) {
+	queue := i.queue(pin)
+	t = transmission{send: send, result: make(chan error, 1)}
+	t.ctx, t.cancel = context.WithTimeout(ctx, TransmitWait)
+	select {
+	case queue <- t:
+		return t, nil
+	default:
+		t.cancel()
+		irSendFailures.Inc(strconv.Itoa(pin))
+		return t, ErrTransmitQueueFull
+	}
+}
+
+//	wait returns the result of a queued transmission, or the error of its
+//	context once it is done; a frame already being sent is not interrupted
+func (i *InfraredManager) wait(pin int, t transmission) error {
+	defer t.cancel()
+	var err error
+	select {
+	case err = <-t.result:
+	case <-t.ctx.Done():
+		err = t.ctx.Err()
+	}
+	if err != nil {
+		irSendFailures.Inc(strconv.Itoa(pin))
+	} else {
+		irSent.Inc(strconv.Itoa(pin))
+	}
+	return err
+}
+
+//	queue returns the queue of pin, starting its worker on first use
+func (i *InfraredManager) queue(pin int) chan transmission {
+	i.queuesLock.Lock()
+	defer i.queuesLock.Unlock()
+	queue, ok := i.queues[pin]
+	if !ok {
+		queue = make(chan transmission, envInt(ConfigTransmitQueueSize, DefaultTransmitQueueSize))
+		i.queues[pin] = queue
+		go i.drain(pin, queue)
+	}
+	return queue
+}
+
+func (i *InfraredManager) drain(pin int, queue chan transmission) {
+	for t := range queue {
+		//Quem enviou já desistiu de esperar
+		if err := t.ctx.Err(); err != nil {
+			t.result <- err
+			continue
+		}
+		waveLock.Lock()
+		err := t.send()
+		waveLock.Unlock()
+		if err != nil {
+			i.Logger.Printf("transmitting on pin %d: %v\n", pin, err)
+		}
+		t.result <- err
+	}
+}
+
+//	transmitStatus maps a transmit error to the HTTP status answered
+func transmitStatus(err error) int {
+	//O emissor ficou ocupado por uma macro além do prazo de quem envia
+	if err == ErrTransmitQueueFull || err == context.DeadlineExceeded {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
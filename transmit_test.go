@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+//	gatedTransmitter records frames only once the gate opens, telling when
+//	each one starts
+type gatedTransmitter struct {
+	*RecordingTransmitter
+	started chan int
+	gate    chan struct{}
+}
+
+func (t *gatedTransmitter) Transmit(pin int, pulses []Pulse) error {
+	t.started <- pin
+	<-t.gate
+	return t.RecordingTransmitter.Transmit(pin, pulses)
+}
+
+//	TestTransmitQueue fills the queue of a pin behind a frame that does not
+//	finish, then checks back-pressure, abandoned frames and the order sent
+func TestTransmitQueue(t *testing.T) {
+	defer os.Unsetenv(ConfigTransmitQueueSize)
+	os.Setenv(ConfigTransmitQueueSize, "3")
+	i, recording := testInfraredManager(t)
+	transmitter := &gatedTransmitter{RecordingTransmitter: recording, started: make(chan int, 8), gate: make(chan struct{})}
+	i.Transmitter = transmitter
+
+	//Quadros de tamanhos diferentes, para reconhecer a ordem de envio
+	frame := func(pin, marks int) func() error {
+		timings := make([]int, 2*marks-1)
+		for k := range timings {
+			timings[k] = 560
+		}
+		send, err := i.timingsFrame(pin, ProtocolFrequency[ProtocolNEC], timings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return send
+	}
+	var queued []transmission
+	var pins []int
+	enqueue := func(ctx context.Context, pin, marks int) error {
+		q, err := i.enqueue(ctx, pin, frame(pin, marks))
+		if err == nil {
+			queued, pins = append(queued, q), append(pins, pin)
+		}
+		return err
+	}
+
+	if err := enqueue(context.Background(), 17, 1); err != nil {
+		t.Fatal(err)
+	}
+	<-transmitter.started
+	abandoned, cancel := context.WithCancel(context.Background())
+	for k, ctx := range []context.Context{context.Background(), abandoned, context.Background()} {
+		if err := enqueue(ctx, 17, k+2); err != nil {
+			t.Fatalf("frame %d: %v", k+2, err)
+		}
+	}
+	if err := enqueue(context.Background(), 17, 5); err != ErrTransmitQueueFull {
+		t.Fatalf("full queue: %v, want ErrTransmitQueueFull", err)
+	}
+	if err := enqueue(context.Background(), 18, 1); err != nil {
+		t.Fatalf("another pin: %v", err)
+	}
+	cancel()
+	if err := i.wait(17, queued[2]); err != context.Canceled {
+		t.Errorf("abandoned frame: %v, want context.Canceled", err)
+	}
+
+	//Um quadro que não termina não prende quem espera além do seu prazo
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := i.transmit(ctx, 19, frame(19, 1)); err != context.DeadlineExceeded {
+		t.Errorf("stuck transmitter: %v, want context.DeadlineExceeded", err)
+	}
+
+	close(transmitter.gate)
+	for k, q := range queued {
+		if k != 2 {
+			if err := i.wait(pins[k], q); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var lengths []int
+	for _, f := range transmitter.Frames() {
+		if f.Pin == 17 {
+			lengths = append(lengths, len(f.Pulses))
+		}
+	}
+	if len(lengths) != 3 || lengths[0] >= lengths[1] || lengths[1] >= lengths[2] {
+		t.Errorf("pulses of the frames sent on 17: %v, want the 1st, 2nd and 4th in order", lengths)
+	}
+}
@@ -0,0 +1,22 @@
+// +build !cgo,!irrecord
+
+package main
+
+import "errors"
+
+var ErrNoTransmitter = errors.New("built without cgo: infrared transmission needs pigpio")
+
+const platformTransmitterWarning = "built without cgo: infrared frames can not be sent"
+
+//	UnavailableTransmitter refuses every frame in builds without cgo, such as
+//	cross compiled ones, so that a missing pigpio is reported instead of
+//	frames being dropped
+type UnavailableTransmitter struct{}
+
+func NewPlatformTransmitter() IRTransmitter {
+	return UnavailableTransmitter{}
+}
+
+func (UnavailableTransmitter) Transmit(pin int, pulses []Pulse) error {
+	return ErrNoTransmitter
+}
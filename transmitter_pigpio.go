@@ -0,0 +1,59 @@
+// +build cgo,!irrecord
+
+package main
+
+/*
+#cgo LDFLAGS: -lpigpio -pthread -lrt
+#include <pigpio.h>
+*/
+import "C"
+import (
+	"fmt"
+	"time"
+)
+
+const platformTransmitterWarning = ""
+
+//	PigpioTransmitter sends pulse lists as pigpio DMA waveforms
+//	pigpio requires root and is initialised around every frame, like irslinger did
+type PigpioTransmitter struct{}
+
+func NewPlatformTransmitter() IRTransmitter {
+	return PigpioTransmitter{}
+}
+
+func (PigpioTransmitter) Transmit(pin int, pulses []Pulse) error {
+	if len(pulses) == 0 {
+		return fmt.Errorf("pigpio: empty waveform")
+	}
+	if C.gpioInitialise() < 0 {
+		return fmt.Errorf("pigpio: initialisation failed")
+	}
+	defer C.gpioTerminate()
+	C.gpioSetMode(C.unsigned(pin), C.PI_OUTPUT)
+
+	cPulses := make([]C.gpioPulse_t, len(pulses))
+	for k, pulse := range pulses {
+		cPulses[k] = C.gpioPulse_t{
+			gpioOn:  C.uint32_t(pulse.On),
+			gpioOff: C.uint32_t(pulse.Off),
+			usDelay: C.uint32_t(pulse.Delay),
+		}
+	}
+	C.gpioWaveClear()
+	if n := C.gpioWaveAddGeneric(C.unsigned(len(cPulses)), &cPulses[0]); n < 0 {
+		return fmt.Errorf("pigpio: adding %d pulses returned %d", len(pulses), int(n))
+	}
+	wave := C.gpioWaveCreate()
+	if wave < 0 {
+		return fmt.Errorf("pigpio: creating waveform returned %d", int(wave))
+	}
+	defer C.gpioWaveDelete(C.unsigned(wave))
+	if n := C.gpioWaveTxSend(C.unsigned(wave), C.PI_WAVE_MODE_ONE_SHOT); n < 0 {
+		return fmt.Errorf("pigpio: sending waveform returned %d", int(n))
+	}
+	for C.gpioWaveTxBusy() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+// +build irrecord
+
+package main
+
+const platformTransmitterWarning = "built with irrecord: infrared frames are recorded and not sent"
+
+//	Builds with the irrecord tag record frames instead of sending them, for
+//	tests and development machines without pigpio:
+//		go test -tags irrecord
+func NewPlatformTransmitter() IRTransmitter {
+	return NewRecordingTransmitter()
+}
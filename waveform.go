@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+const (
+	//Fração do período da portadora em que o LED fica aceso
+	DefaultIRDutyCycle = 0.5
+	ConfigIRDutyCycle  = "IR_DUTY_CYCLE"
+
+	//Quadros mantidos pelo RecordingTransmitter
+	RecordingTransmitterFrames = 32
+)
+
+//	Pulse mirrors pigpio's gpioPulse_t: the GPIO masks switched on and off,
+//	then the time in microseconds until the next pulse
+type Pulse struct {
+	On    uint32
+	Off   uint32
+	Delay uint32
+}
+
+//	IRTransmitter outputs a pulse list on an emitter pin
+//	Only one frame is transmitted at a time
+type IRTransmitter interface {
+	Transmit(pin int, pulses []Pulse) error
+}
+
+//	Waveform modulates marks and spaces, in microseconds, with a carrier of
+//	frequency Hz and dutyCycle; every pulse ends on the rounded absolute time
+//	of its edge so that rounding errors do not add up along the frame
+func Waveform(pin, frequency int, dutyCycle float64, timings []int) (pulses []Pulse, err error) {
+	if pin < 0 || pin > 31 {
+		return nil, fmt.Errorf("waveform: invalid pin %d", pin)
+	}
+	if frequency <= 0 {
+		return nil, fmt.Errorf("waveform: invalid frequency %d", frequency)
+	}
+	if dutyCycle <= 0 || dutyCycle >= 1 {
+		return nil, fmt.Errorf("waveform: invalid duty cycle %.2f", dutyCycle)
+	}
+	mask := uint32(1) << uint(pin)
+	period := 1e6 / float64(frequency)
+	clock := 0
+	edge := func(on bool, at float64) {
+		delay := int(math.Round(at)) - clock
+		if delay <= 0 {
+			return
+		}
+		clock += delay
+		pulse := Pulse{Off: mask, Delay: uint32(delay)}
+		if on {
+			pulse = Pulse{On: mask, Delay: uint32(delay)}
+		}
+		if n := len(pulses); n > 0 && pulses[n-1].On == pulse.On && pulses[n-1].Off == pulse.Off {
+			pulses[n-1].Delay += pulse.Delay
+			return
+		}
+		pulses = append(pulses, pulse)
+	}
+
+	start := 0.0
+	for k, micros := range timings {
+		if micros <= 0 {
+			return nil, fmt.Errorf("waveform: invalid duration %d at %d", micros, k)
+		}
+		if k%2 == 1 {
+			start += float64(micros)
+			edge(false, start)
+			continue
+		}
+		cycles := int(math.Round(float64(micros) / period))
+		for c := 0; c < cycles; c++ {
+			at := start + float64(c)*period
+			edge(true, at+dutyCycle*period)
+			edge(false, at+period)
+		}
+		start += float64(micros)
+	}
+	//A última marca termina apagada, sem espera
+	if n := len(pulses); n > 0 && pulses[n-1].On == 0 {
+		pulses[n-1].Delay = 0
+	}
+	return pulses, nil
+}
+
+//	RecordedFrame is a frame kept by RecordingTransmitter
+type RecordedFrame struct {
+	Pin    int
+	Pulses []Pulse
+}
+
+//	RecordingTransmitter keeps the last frames instead of sending them
+//	It is the backend of builds with the irrecord tag and of tests
+type RecordingTransmitter struct {
+	frames []RecordedFrame
+	lock   sync.Mutex
+}
+
+func NewRecordingTransmitter() *RecordingTransmitter {
+	return &RecordingTransmitter{}
+}
+
+func (t *RecordingTransmitter) Transmit(pin int, pulses []Pulse) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.frames = append(t.frames, RecordedFrame{Pin: pin, Pulses: pulses})
+	if len(t.frames) > RecordingTransmitterFrames {
+		t.frames = t.frames[len(t.frames)-RecordingTransmitterFrames:]
+	}
+	return nil
+}
+
+//	Frames returns the recorded frames, oldest first
+func (t *RecordingTransmitter) Frames() []RecordedFrame {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]RecordedFrame(nil), t.frames...)
+}
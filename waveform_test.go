@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+//	TestWaveform checks that every mark starts on the rounded absolute time
+//	of its edge, however the carrier periods round, and that the carrier
+//	keeps the duty cycle
+func TestWaveform(t *testing.T) {
+	timings := []int{9000, 4500, 562, 1687, 562, 562, 562}
+	for _, dutyCycle := range []float64{0.33, 0.5} {
+		pulses, err := Waveform(17, 38000, dutyCycle, timings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		period := 1e6 / 38000.0
+		//Uma marca começa depois de um intervalo maior que um período
+		var starts []int
+		clock, gap := 0, period+1
+		for k, pulse := range pulses {
+			switch {
+			case pulse.On == 1<<17 && pulse.Off == 0:
+				if gap > period {
+					starts = append(starts, clock)
+				}
+				if math.Abs(float64(pulse.Delay)-dutyCycle*period) >= 1 {
+					t.Fatalf("duty %.2f: carrier on for %d µs at %d, want %.1f", dutyCycle, pulse.Delay, k, dutyCycle*period)
+				}
+			case pulse.Off == 1<<17 && pulse.On == 0:
+				gap = float64(pulse.Delay)
+			default:
+				t.Fatalf("pulse %d switches %#x on and %#x off", k, pulse.On, pulse.Off)
+			}
+			clock += int(pulse.Delay)
+		}
+		want, edge := []int{0}, 0
+		for k := 1; k+1 < len(timings); k += 2 {
+			edge += timings[k-1] + timings[k]
+			want = append(want, edge)
+		}
+		if len(starts) != len(want) {
+			t.Fatalf("duty %.2f: marks start at %v, want %v", dutyCycle, starts, want)
+		}
+		for k := range want {
+			if starts[k] != want[k] {
+				t.Errorf("duty %.2f: marks start at %v, want %v", dutyCycle, starts, want)
+				break
+			}
+		}
+		if last := pulses[len(pulses)-1]; last.Off == 0 || last.Delay != 0 {
+			t.Errorf("duty %.2f: frame ends with %+v, want the carrier off", dutyCycle, last)
+		}
+	}
+}
+
+func TestWaveformErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		pin       int
+		frequency int
+		dutyCycle float64
+		timings   []int
+	}{
+		{"pin", 32, 38000, 0.5, []int{562}},
+		{"negative pin", -1, 38000, 0.5, []int{562}},
+		{"frequency", 17, 0, 0.5, []int{562}},
+		{"duty cycle 0", 17, 38000, 0, []int{562}},
+		{"duty cycle 1", 17, 38000, 1, []int{562}},
+		{"duration", 17, 38000, 0.5, []int{562, 0, 562}},
+	}
+	for _, tt := range tests {
+		if _, err := Waveform(tt.pin, tt.frequency, tt.dutyCycle, tt.timings); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
@@ -12,17 +12,17 @@ import (
 //	*	To register system's Wifi - HTTP endpoints
 //	WifiManager
 type WifiManager struct {
-	LogFile         *os.File
-	Logger          *log.Logger
-	Router          *mux.Router
-	DatabaseManager *DatabaseManager
+	LogFile    *os.File
+	Logger     *log.Logger
+	Router     *mux.Router
+	Repository Repository
 }
 
 func NewWifiManager() (wm *WifiManager) {
 	return &WifiManager{}
 }
 
-func (wm *WifiManager) Initialize(logPath string, database *DatabaseManager) (err error) {
+func (wm *WifiManager) Initialize(logPath string, repository Repository) (err error) {
 	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return err
@@ -30,7 +30,8 @@ func (wm *WifiManager) Initialize(logPath string, database *DatabaseManager) (er
 	wm.LogFile = f
 	wm.Logger = log.New(wm.LogFile, "", log.Ldate|log.Ltime)
 	wm.Router = mux.NewRouter()
-	wm.DatabaseManager = database
+	wm.Router.Use(metricsMiddleware)
+	wm.Repository = repository
 	wm.Logger.Printf("WifiManager started.\n")
 	return nil
 }